@@ -1,8 +1,11 @@
 // sidecar-slim is a thin Go shim that wraps tsnet for the Rust truffle-core.
 //
 // It provides two communication channels:
-//   - Command channel: stdin/stdout JSON lines for lifecycle commands
-//   - Data bridge: local TCP connections to Rust's bridge port with binary headers
+//   - Command channel: stdin/stdout JSON lines (or negotiated length-prefixed
+//     CBOR) for lifecycle commands, plus an optional Unix socket
+//     (TRUFFLE_CONTROL_SOCKET) other local tools attach to
+//   - Data bridge: local TCP (or Unix socket) connections to Rust's bridge
+//     listener with binary headers
 //
 // All application logic (WebSocket, mesh, file transfer) lives in Rust.
 // This shim only handles tsnet lifecycle and transparent TCP proxying.
@@ -10,14 +13,21 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -26,23 +36,34 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/fxamacker/cbor/v2"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/ipn/store"
+	"tailscale.com/ipn/store/mem"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
+	"tailscale.com/types/key"
+	"tailscale.com/util/dnsname"
 )
 
 // Bridge header constants (must match Rust truffle-core/src/bridge/header.rs)
 const (
-	headerMagic   = 0x54524646 // "TRFF"
-	headerVersion = 0x01
+	headerMagic    = 0x54524646 // "TRFF"
+	headerVersion  = 0x01
+	headerVersion2 = 0x02 // TLV header; see "Bridge header v2"
 
 	// maxRemoteDNSNameLen bounds the RemoteDNSName header field, which carries
 	// JSON-encoded peer identity. Must match MAX_REMOTE_DNS_NAME_LEN in
@@ -59,10 +80,15 @@ const (
 	// dialTimeout bounds an outbound tsnet dial so a blackholed peer can't hang
 	// a dial goroutine until stop.
 	dialTimeout = 30 * time.Second
+	// coreDialTimeout bounds a connect to the core's bridge listener. It is
+	// local, so a core that can't take a connection within it is wedged.
+	coreDialTimeout = 5 * time.Second
 	// whoisTimeout bounds the per-connection WhoIs identity lookup.
 	whoisTimeout = 3 * time.Second
 	// statusTimeout bounds LocalClient.Status() calls.
 	statusTimeout = 10 * time.Second
+	// controlProbeTimeout bounds the reachability check of a custom controlUrl.
+	controlProbeTimeout = 10 * time.Second
 	// maxCommandBytes caps a single stdin command line. Over-size lines are
 	// skipped with an error rather than killing the sidecar.
 	maxCommandBytes = 8 * 1024 * 1024
@@ -72,13 +98,34 @@ const (
 
 // Command/Event JSON types
 type command struct {
+	// ID is an optional caller-chosen correlation id. When set, it is echoed
+	// on every event the command produces (including tsnet:error), so the core
+	// can run commands concurrently and match each reply to its request.
+	ID string `json:"id,omitempty"`
+	// Node names the tsnet node the command targets. Empty is the default
+	// node, so single-node parents never set it. Process-wide commands
+	// (sidecar:*, events:replay) ignore it.
+	Node    string          `json:"node,omitempty"`
 	Command string          `json:"command"`
 	Data    json.RawMessage `json:"data,omitempty"`
 }
 
 type event struct {
-	Event string      `json:"event"`
-	Data  interface{} `json:"data,omitempty"`
+	Event string `json:"event"`
+	// ID echoes command.ID; empty for unsolicited events (monitors, proxy
+	// request-path errors) and for commands sent without one.
+	ID string `json:"id,omitempty"`
+	// Node names the node that emitted the event; empty for the default node
+	// and for process-wide events.
+	Node string      `json:"node,omitempty"`
+	Data interface{} `json:"data,omitempty"`
+	// Seq numbers stdout events 1, 2, 3… in write order, so the core can
+	// detect lost output and ask for it via events:replay. Control-socket
+	// streams carry no seq.
+	Seq uint64 `json:"seq,omitempty"`
+	// Replay marks a re-emitted copy of an already-delivered event; Seq is
+	// the original's.
+	Replay bool `json:"replay,omitempty"`
 }
 
 type startData struct {
@@ -92,6 +139,30 @@ type startData struct {
 	// IdleTimeoutSecs overrides the bridged-connection idle-reap deadline.
 	// nil or <=0 falls back to idleDeadline (RFC 021 §6.5).
 	IdleTimeoutSecs *int `json:"idleTimeoutSecs,omitempty"`
+	// ControlURL points the node at a self-hosted coordination server
+	// (Headscale, testcontrol). Empty keeps tsnet's default.
+	ControlURL string `json:"controlUrl,omitempty"`
+	// StateStore selects file (default), mem or encrypted node state.
+	StateStore *stateStoreData `json:"stateStore,omitempty"`
+	// HeartbeatSecs, if > 0, arms the heartbeat watchdog: the parent sends
+	// sidecar:heartbeat at this interval and the sidecar emits its own.
+	HeartbeatSecs int `json:"heartbeatSecs,omitempty"`
+	// QueueUntilRunning holds serving commands that arrive while the node
+	// starts and runs them once it is Running, instead of failing them.
+	QueueUntilRunning bool `json:"queueUntilRunning,omitempty"`
+	// BridgeMuxConns, if > 0, multiplexes bridged connections as streams
+	// over this many persistent connections to bridgePort (at most
+	// muxMaxConns) instead of dialling one per connection.
+	BridgeMuxConns int `json:"bridgeMuxConns,omitempty"`
+	// BridgeSocket, if set, is the path of a Unix socket the core listens
+	// on for the data bridge, used instead of 127.0.0.1:bridgePort.
+	BridgeSocket string `json:"bridgeSocket,omitempty"`
+	// BridgeHeaderVersion picks the bridge header layout: 0 or 1 for the
+	// RFC 003 v1 header, 2 for the TLV header.
+	BridgeHeaderVersion int `json:"bridgeHeaderVersion,omitempty"`
+	// BridgeAck makes the sidecar wait for the core's one-byte verdict after
+	// each bridge header; bridge:dial then reports success once accepted.
+	BridgeAck bool `json:"bridgeAck,omitempty"`
 }
 
 type dialData struct {
@@ -107,6 +178,7 @@ type dialResultData struct {
 	RequestID string `json:"requestId"`
 	Success   bool   `json:"success"`
 	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"` // set for bridge ack failures and DRAINING
 }
 
 // sidecarProtocolVersion is the serve/proxy protocol version this sidecar
@@ -116,6 +188,100 @@ type dialResultData struct {
 // changes to the proxy/serve command surface.
 const sidecarProtocolVersion = 2
 
+// Version is the sidecar build version, stamped by the release workflows via
+// -ldflags "-X main.Version=<tag>". Local builds report "dev".
+var Version = "dev"
+
+// Feature flags advertised by sidecar:hello. A core feature-detects on the
+// presence of a name instead of inferring capabilities from
+// sidecarProtocolVersion alone.
+const (
+	featureCommandIDs      = "commandIds"      // command.id echoed on every event
+	featureProxyRoutes     = "proxyRoutes"     // proxy:add routes (RFC 023 §7)
+	featureProxyAllow      = "proxyAllow"      // proxy:add allow-lists (§9.7)
+	featureProxyPlainHTTP  = "proxyPlainHttp"  // proxy:add tls:false (D5)
+	featureUDPRelayFraming = "udpRelayFraming" // [IPv4][port][payload] relay frames + REGISTER
+	featureDialTLS         = "dialTls"         // bridge:dial explicit tls flag (RFC 021 §6.4)
+	featureIdleTimeout     = "idleTimeout"     // tsnet:start idleTimeoutSecs (RFC 021 §6.5)
+	featureControlSocket   = "controlSocket"   // TRUFFLE_CONTROL_SOCKET multi-client channel
+	featureCBORFraming     = "cborFraming"     // sidecar:hello framing:"cbor"
+	featureEventSeq        = "eventSeq"        // event.seq + events:replay
+	featureLogLevels       = "logLevels"       // JSON stderr logs + sidecar:setLogLevel
+	featureDrain           = "drain"           // tsnet:drain graceful wind-down
+	featureMultiNode       = "multiNode"       // command.node / event.node
+	featureControlURL      = "controlUrl"      // tsnet:start controlUrl + CONTROL_UNREACHABLE
+	featureStateStore      = "stateStore"      // tsnet:start stateStore mem/file/encrypted
+	featureLoginLogout     = "loginLogout"     // tsnet:login / tsnet:logout / tsnet:reauth
+	featureSetHostnameTags = "setHostnameTags" // tsnet:setHostname / tsnet:setTags
+	featurePrefs           = "prefs"           // tsnet:getPrefs / tsnet:editPrefs / tsnet:prefsChanged
+	featureExitNodes       = "exitNodes"       // tsnet:exitNodes / tsnet:setExitNode, statusData.exitNode
+	featureHeartbeat       = "heartbeat"       // tsnet:start heartbeatSecs + sidecar:heartbeat watchdog
+	featureSupervisor      = "supervisor"      // tsnet:recovering / tsnet:recovered auto-restart
+	featureServeConfig     = "serveConfig"     // truffle-serve.json restore + config:apply
+	featureStartQueue      = "startQueue"      // tsnet:start queueUntilRunning + tsnet:queued
+	featureBridgeMux       = "bridgeMux"       // tsnet:start bridgeMuxConns stream-muxed bridge
+	featureBridgeSocket    = "bridgeSocket"    // tsnet:start bridgeSocket Unix-socket bridge
+	featureBridgeHeaderV2  = "bridgeHeaderV2"  // tsnet:start bridgeHeaderVersion 2 TLV header
+	featureBridgeAck       = "bridgeAck"       // tsnet:start bridgeAck core verdict + dialResult success
+	featureBridgeConns     = "bridgeConns"     // bridge:list / bridge:close / bridge:closed
+)
+
+// sidecarFeatures is the feature list reported by sidecar:hello.
+var sidecarFeatures = []string{
+	featureCommandIDs,
+	featureProxyRoutes,
+	featureProxyAllow,
+	featureProxyPlainHTTP,
+	featureUDPRelayFraming,
+	featureDialTLS,
+	featureIdleTimeout,
+	featureControlSocket,
+	featureCBORFraming,
+	featureEventSeq,
+	featureLogLevels,
+	featureDrain,
+	featureMultiNode,
+	featureControlURL,
+	featureStateStore,
+	featureLoginLogout,
+	featureSetHostnameTags,
+	featurePrefs,
+	featureExitNodes,
+	featureHeartbeat,
+	featureSupervisor,
+	featureServeConfig,
+	featureStartQueue,
+	featureBridgeMux,
+	featureBridgeSocket,
+	featureBridgeHeaderV2,
+	featureBridgeAck,
+	featureBridgeConns,
+}
+
+// Command/event channel framings, negotiated via sidecar:hello.
+const (
+	framingJSON = "json" // '\n'-terminated JSON lines (the default)
+	framingCBOR = "cbor" // [u32 BE length][CBOR-encoded command/event]
+)
+
+// helloRequestData is the optional payload for sidecar:hello commands.
+type helloRequestData struct {
+	// Framing asks to switch this channel's framing once the hello reply has
+	// been written in the current one. Empty keeps the current framing.
+	Framing string `json:"framing,omitempty"`
+}
+
+// helloData is the payload for sidecar:hello events. It is answered without a
+// running node, so the core can negotiate before tsnet:start.
+type helloData struct {
+	ProtocolVersion int      `json:"protocolVersion"`
+	Version         string   `json:"version"`
+	Commands        []string `json:"commands"`
+	Features        []string `json:"features"`
+	// Framing is the framing in effect for every frame after this reply.
+	Framing string `json:"framing"`
+}
+
 type statusData struct {
 	State       string `json:"state"`
 	Hostname    string `json:"hostname,omitempty"`
@@ -123,6 +289,12 @@ type statusData struct {
 	TailscaleIP string `json:"tailscaleIP,omitempty"`
 	NodeID      string `json:"nodeId,omitempty"`
 	Error       string `json:"error,omitempty"`
+	// Code classifies an "error" state when the core can act on it, e.g.
+	// CONTROL_UNREACHABLE.
+	Code string `json:"code,omitempty"`
+	// ExitNode is the stable ID of the exit node traffic is routed through,
+	// on "running" statuses; empty when none is in use.
+	ExitNode string `json:"exitNode,omitempty"`
 	// ProtocolVersion advertises sidecarProtocolVersion on every emission (no
 	// omitempty: a status event must always carry it, and the "running" one is
 	// what the core reads to gate v2 features).
@@ -175,7 +347,8 @@ type listenData struct {
 
 // listeningData is the payload for tsnet:listening events.
 type listeningData struct {
-	Port uint16 `json:"port"`
+	Port       uint16 `json:"port"`
+	ListenerID uint32 `json:"listenerId,omitempty"` // as in bridge header v2
 }
 
 // unlistenData is the payload for tsnet:unlisten commands.
@@ -258,7 +431,8 @@ type deleteWaitingFileResultData struct {
 
 // stateChangeData is the payload for tsnet:stateChange events.
 type stateChangeData struct {
-	State string `json:"state"`
+	State    string `json:"state"`
+	Previous string `json:"previous,omitempty"` // empty for the first state seen
 }
 
 // watchPeersData is the payload for tsnet:watchPeers commands.
@@ -379,6 +553,7 @@ type proxyEntry struct {
 	listener     net.Listener
 	server       *http.Server
 	cancel       context.CancelFunc
+	spec         json.RawMessage // the proxy:add data, replayed after a recovery
 
 	// wsConns tracks live hijacked WebSocket connections. http.Server.Shutdown
 	// does NOT close hijacked conns, so we close them explicitly on teardown (P1).
@@ -442,29 +617,74 @@ type udpRelay struct {
 	cancel    context.CancelFunc
 }
 
-// shim is the main application state.
+// sidecar is the process-wide state every node shares: the event channel
+// (framing, seq, replay ring, queue), dispatch, and the control socket.
+type sidecar struct {
+	writeMu sync.Mutex   // protects stdout writes, writer swaps, seq and ring
+	writer  eventEncoder // stdout in the negotiated framing
+	stdout  io.Writer    // raw stdout, re-wrapped on a framing switch
+	seq     uint64       // last stdout event seq written
+	ring    *eventRing   // recently written stdout events, for events:replay
+
+	// stdinCBOR is set once sidecar:hello switches stdin to CBOR framing.
+	stdinCBOR atomic.Bool
+
+	// events decouples emitters from stdout: sendEvent enqueues and a single
+	// writer goroutine drains. nil (unit tests) writes synchronously.
+	events *eventQueue
+
+	// dispatchMu serializes dispatch across the stdin loop and control-socket
+	// clients: handlers assume a single dispatcher (e.g. G12's start check).
+	dispatchMu sync.Mutex
+	// shutDown is set by stopAll; later commands are dropped. Guarded by
+	// dispatchMu.
+	shutDown bool
+
+	// control is the optional Unix-socket command channel. Set once in main()
+	// before any command runs; nil when TRUFFLE_CONTROL_SOCKET is unset.
+	control *controlServer
+
+	// nodes holds every node by name; "" is the default node, which always
+	// exists. Other nodes are created by tsnet:start and removed on stop.
+	nodesMu sync.Mutex
+	nodes   map[string]*shim
+
+	// lastHeartbeat is when the parent last sent sidecar:heartbeat, in unix
+	// nanoseconds (0 before the first).
+	lastHeartbeat atomic.Int64
+
+	// nextConnID numbers bridged connections across all nodes.
+	nextConnID atomic.Uint64
+}
+
+// shim is the state of one tsnet node. Its handlers emit events tagged with
+// the node's name through the shared sidecar.
 type shim struct {
+	*sidecar
+	node string // "" for the default node
+
 	// serverMu guards server, dnsName, sessionToken, bridgePort, idleTimeout,
-	// ctx, and cancel — all written from the dispatch loop (start/stop) and read
-	// from many spawned goroutines.
+	// stateDir, ctx, and cancel — all written from the dispatch loop
+	// (start/stop) and read from many spawned goroutines.
 	serverMu     sync.RWMutex
 	server       *tsnet.Server
 	dnsName      string // set when status becomes "running"
 	sessionToken []byte // 32 bytes
 	bridgePort   uint16
 	idleTimeout  time.Duration // bridged-conn idle-reap deadline (RFC 021 §6.5)
+	stateDir     string        // tsnet state dir of the running server
 	ctx          context.Context
 	cancel       context.CancelFunc
 
-	writeMu sync.Mutex // protects stdout writes
-	writer  *json.Encoder
-
 	listenerMu sync.Mutex     // protects listeners
 	listeners  []net.Listener // active listeners (dynamic), closed on stop
 
 	// dynamicListeners tracks listeners created via tsnet:listen, keyed by port.
+	// listenTLS records which of those ports terminate TLS, for the supervisor
+	// to re-create them after a recovery.
 	dynamicListenerMu sync.Mutex
 	dynamicListeners  map[uint16]net.Listener
+	listenTLS         map[uint16]bool
 
 	// udpRelays tracks active UDP relays created via tsnet:listenPacket, keyed by port.
 	udpRelayMu sync.Mutex
@@ -490,6 +710,173 @@ type shim struct {
 	// past a minute (RFC 023 §7 identity headers).
 	identityCacheMu sync.Mutex
 	identityCache   map[string]cachedIdentity
+
+	// pathCache holds every peer's path from one Status snapshot, so v2
+	// bridge headers don't fetch the full status per connection. Refreshed
+	// when older than pathCacheTTL.
+	pathCacheMu sync.Mutex
+	pathCache   map[key.NodePublic]byte
+	pathCacheAt time.Time
+
+	// draining is set by tsnet:drain and cleared by tsnet:stop. While set,
+	// tsnet:listen, tsnet:listenPacket, proxy:add and bridge:dial are
+	// refused.
+	draining atomic.Bool
+
+	// bridgeConns and proxyRequests count live bridged streams and in-flight
+	// proxy requests (WebSocket upgrades included) for tsnet:drain progress.
+	bridgeConns   atomic.Int64
+	proxyRequests atomic.Int64
+
+	// startSpec and startStore are the tsnet:start the node runs under and
+	// the state store it opened, kept for the supervisor to restart from
+	// (guarded by serverMu).
+	startSpec  *startData
+	startStore ipn.StateStore
+
+	// recovering is set while the supervisor is restarting the server. The
+	// node has no server meanwhile but still owns its stateDir.
+	recovering atomic.Bool
+
+	// adds collects the outcomes of the listeners, relays and proxies the
+	// sidecar adds on its own behalf (see trackAdd).
+	adds addTracker
+
+	// serveConfigPending is set by tsnet:start and consumed when the node
+	// first reaches Running, which then restores the serve config file.
+	serveConfigPending atomic.Bool
+
+	// configMu runs serve config applies (config:apply and the start's
+	// restore) one at a time, each from its diff to its config:applied. It
+	// is taken before dispatchMu, which is released while the adds finish.
+	configMu sync.Mutex
+
+	// queueMu guards queueing and queue: the serving commands held back
+	// while a tsnet:start with queueUntilRunning comes up.
+	queueMu  sync.Mutex
+	queueing bool
+	queue    []command
+
+	// mux is the multiplexed bridge a tsnet:start with bridgeMuxConns asked
+	// for; nil bridges each connection over its own dial. Guarded by serverMu.
+	mux *muxPool
+	// bridgeSocket is the core's Unix socket for the data bridge, or "" for
+	// loopback TCP to bridgePort. Guarded by serverMu.
+	bridgeSocket string
+	// headerVersion is the bridge header version tsnet:start chose.
+	// Guarded by serverMu.
+	headerVersion byte
+	// bridgeAck is tsnet:start's bridgeAck. Guarded by serverMu.
+	bridgeAck bool
+
+	// nextListenerID numbers this node's dynamic listeners.
+	nextListenerID atomic.Uint32
+
+	// bridgesMu guards bridges, the live bridged connections by connId.
+	bridgesMu sync.Mutex
+	bridges   map[uint64]*bridgeConn
+}
+
+// newSidecar returns the process state with its default node, emitting
+// events through writer.
+func newSidecar(writer eventEncoder, stdout io.Writer) *sidecar {
+	sc := &sidecar{writer: writer, stdout: stdout, nodes: make(map[string]*shim)}
+	sc.nodes[""] = sc.newNode("")
+	return sc
+}
+
+// newNode builds an idle, unregistered node.
+func (sc *sidecar) newNode(name string) *shim {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &shim{
+		sidecar:          sc,
+		node:             name,
+		dynamicListeners: make(map[uint16]net.Listener),
+		listenTLS:        make(map[uint16]bool),
+		bridges:          make(map[uint64]*bridgeConn),
+		udpRelays:        make(map[uint16]*udpRelay),
+		proxies:          make(map[string]*proxyEntry),
+		ctx:              ctx,
+		cancel:           cancel,
+	}
+}
+
+func (sc *sidecar) defaultNode() *shim {
+	sc.nodesMu.Lock()
+	defer sc.nodesMu.Unlock()
+	return sc.nodes[""]
+}
+
+// lookupNode returns the named node, registering a fresh one when create is
+// set (tsnet:start). It returns nil for an unknown name otherwise.
+func (sc *sidecar) lookupNode(name string, create bool) *shim {
+	sc.nodesMu.Lock()
+	defer sc.nodesMu.Unlock()
+	n, ok := sc.nodes[name]
+	if !ok && create {
+		n = sc.newNode(name)
+		sc.nodes[name] = n
+	}
+	return n
+}
+
+// removeNode forgets a stopped non-default node, so a later tsnet:start with
+// the same name gets fresh state.
+func (sc *sidecar) removeNode(n *shim) {
+	if n.node == "" {
+		return
+	}
+	sc.nodesMu.Lock()
+	if sc.nodes[n.node] == n {
+		delete(sc.nodes, n.node)
+	}
+	sc.nodesMu.Unlock()
+}
+
+// allNodes snapshots the registered nodes, default node first.
+func (sc *sidecar) allNodes() []*shim {
+	sc.nodesMu.Lock()
+	defer sc.nodesMu.Unlock()
+	out := make([]*shim, 0, len(sc.nodes))
+	out = append(out, sc.nodes[""])
+	for name, n := range sc.nodes {
+		if name != "" {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// stateDirOwner returns the running node other than self whose tsnet state
+// lives in dir, or nil. Two servers sharing a state dir would fight over the
+// same node key.
+func (sc *sidecar) stateDirOwner(dir string, self *shim) *shim {
+	for _, n := range sc.allNodes() {
+		if n == self || (n.getServer() == nil && !n.recovering.Load()) {
+			continue
+		}
+		n.serverMu.RLock()
+		same := n.stateDir == dir
+		n.serverMu.RUnlock()
+		if same {
+			return n
+		}
+	}
+	return nil
+}
+
+// stopAll stops every node, default node last so its tsnet:stopped is the
+// final event as before. Control-socket clients may still be sending
+// commands, so it stops under dispatchMu and leaves dispatch refusing any
+// that arrive afterwards.
+func (sc *sidecar) stopAll() {
+	sc.dispatchMu.Lock()
+	defer sc.dispatchMu.Unlock()
+	sc.shutDown = true
+	nodes := sc.allNodes()
+	for i := len(nodes) - 1; i >= 0; i-- {
+		nodes[i].handleStop("")
+	}
 }
 
 // cachedIdentity is one identityCache slot.
@@ -582,105 +969,454 @@ func (s *shim) idleTimeoutOrDefault() time.Duration {
 // mesh). Deferred at the top of every goroutine and bridgeToRust.
 func (s *shim) recoverPanic(where string) {
 	if r := recover(); r != nil {
-		log.Printf("panic recovered in %s: %v", where, r)
+		sidecarLog.Errorf("panic recovered in %s: %v", where, r)
 	}
 }
 
-// debugEnabled is read once at startup from TRUFFLE_DEBUG (any non-empty value).
-// When false, per-packet/per-connection debug chatter is suppressed and the
-// tsnet backend logger is left unset (tsnet discards it). Genuine errors and
-// warnings, plus startup milestones, are logged unconditionally via log.Printf.
-var debugEnabled = os.Getenv("TRUFFLE_DEBUG") != ""
+// Log components. Every stderr line is a JSON slog record carrying a
+// "component" attribute; sidecar:setLogLevel tunes each one independently at
+// runtime. logTsnet is tsnet's own backend/user logging (srv.Logf/UserLogf).
+const (
+	logSidecar  = "sidecar"
+	logBridge   = "bridge"
+	logUDP      = "udp"
+	logProxy    = "proxy"
+	logWatch    = "watch"
+	logTaildrop = "taildrop"
+	logTsnet    = "tsnet"
+)
 
-// debugf routes verbose per-packet/per-connection tracing to stderr only when
-// TRUFFLE_DEBUG is set. Real errors and warnings must call log.Printf directly
-// so they stay visible in the default (quiet) mode.
-func debugf(format string, args ...any) {
-	if debugEnabled {
-		log.Printf(format, args...)
+// logComponents is the fixed component set, in the order sidecar:logLevels
+// reports it.
+var logComponents = []string{logSidecar, logBridge, logUDP, logProxy, logWatch, logTaildrop, logTsnet}
+
+// defaultLogLevel is Info, or Debug when TRUFFLE_DEBUG is set (any non-empty
+// value). At Info, per-packet/per-connection chatter and tsnet's backend
+// firehose (magicsock/netcheck/netmap, "fake tun", etc.) are suppressed;
+// errors, warnings and milestones stay visible.
+func defaultLogLevel() slog.Level {
+	if os.Getenv("TRUFFLE_DEBUG") != "" {
+		return slog.LevelDebug
 	}
+	return slog.LevelInfo
 }
 
-func main() {
-	log.SetOutput(os.Stderr) // all logs go to stderr; stdout is JSON events only
+// logWriter serializes writes from every component's handler onto one
+// destination so JSON lines never interleave. The destination is swappable
+// for tests.
+type logWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	s := &shim{
-		writer:           json.NewEncoder(os.Stdout),
-		dynamicListeners: make(map[uint16]net.Listener),
-		udpRelays:        make(map[uint16]*udpRelay),
-		proxies:          make(map[string]*proxyEntry),
-		ctx:              ctx,
-		cancel:           cancel,
+func (lw *logWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+func (lw *logWriter) setOutput(w io.Writer) {
+	lw.mu.Lock()
+	lw.w = w
+	lw.mu.Unlock()
+}
+
+// componentLogger is a printf-style front end over one component's slog
+// logger. Messages are only formatted when the record would be emitted, so
+// hot-path Debugf calls cost a level check at the default level.
+type componentLogger struct {
+	level  *slog.LevelVar
+	logger *slog.Logger
+}
+
+func (c *componentLogger) logf(level slog.Level, format string, args ...any) {
+	ctx := context.Background()
+	if !c.logger.Enabled(ctx, level) {
+		return
+	}
+	c.logger.Log(ctx, level, fmt.Sprintf(format, args...))
+}
+
+func (c *componentLogger) Debugf(format string, args ...any) {
+	c.logf(slog.LevelDebug, format, args...)
+}
+
+func (c *componentLogger) Infof(format string, args ...any) {
+	c.logf(slog.LevelInfo, format, args...)
+}
+
+func (c *componentLogger) Warnf(format string, args ...any) {
+	c.logf(slog.LevelWarn, format, args...)
+}
+
+func (c *componentLogger) Errorf(format string, args ...any) {
+	c.logf(slog.LevelError, format, args...)
+}
+
+// logSink owns the per-component loggers. stdout is reserved for events, so
+// everything lands on stderr.
+type logSink struct {
+	out        *logWriter
+	components map[string]*componentLogger
+}
+
+func newLogSink(w io.Writer, level slog.Level) *logSink {
+	ls := &logSink{
+		out:        &logWriter{w: w},
+		components: make(map[string]*componentLogger, len(logComponents)),
+	}
+	for _, name := range logComponents {
+		lv := new(slog.LevelVar)
+		lv.Set(level)
+		h := slog.NewJSONHandler(ls.out, &slog.HandlerOptions{Level: lv})
+		ls.components[name] = &componentLogger{
+			level:  lv,
+			logger: slog.New(h).With("component", name),
+		}
+	}
+	return ls
+}
+
+func (ls *logSink) component(name string) *componentLogger {
+	return ls.components[name]
+}
+
+// setLevel applies level to one component, or to all of them when name is
+// empty. It returns false for an unknown component.
+func (ls *logSink) setLevel(name string, level slog.Level) bool {
+	if name == "" {
+		for _, c := range ls.components {
+			c.level.Set(level)
+		}
+		return true
+	}
+	c, ok := ls.components[name]
+	if !ok {
+		return false
+	}
+	c.level.Set(level)
+	return true
+}
+
+// levels snapshots every component's current level as lower-case names.
+func (ls *logSink) levels() map[string]string {
+	out := make(map[string]string, len(ls.components))
+	for name, c := range ls.components {
+		out[name] = strings.ToLower(c.level.Level().String())
+	}
+	return out
+}
+
+var (
+	logs        = newLogSink(os.Stderr, defaultLogLevel())
+	sidecarLog  = logs.component(logSidecar)
+	bridgeLog   = logs.component(logBridge)
+	udpLog      = logs.component(logUDP)
+	proxyLog    = logs.component(logProxy)
+	watchLog    = logs.component(logWatch)
+	taildropLog = logs.component(logTaildrop)
+	tsnetLog    = logs.component(logTsnet)
+)
+
+// setLogLevelData is the payload for sidecar:setLogLevel. An empty Component
+// applies Level to every component. Level accepts slog's names (debug, info,
+// warn, error, optionally with an offset such as "debug-4").
+type setLogLevelData struct {
+	Component string `json:"component,omitempty"`
+	Level     string `json:"level"`
+}
+
+// logLevelsData answers sidecar:setLogLevel with the resulting level of every
+// component.
+type logLevelsData struct {
+	Levels map[string]string `json:"levels"`
+}
+
+// handleSetLogLevel adjusts a component's (or every component's) log level.
+// It needs no running node, so the parent can turn on tracing before
+// tsnet:start to capture startup.
+func (s *shim) handleSetLogLevel(id string, data json.RawMessage) {
+	var d setLogLevelData
+	if err := json.Unmarshal(data, &d); err != nil {
+		s.sendErrorID(id, "LOG_LEVEL_ERROR", fmt.Sprintf("invalid setLogLevel data: %v", err))
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(d.Level)); err != nil {
+		s.sendErrorID(id, "LOG_LEVEL_ERROR", fmt.Sprintf("invalid level %q", d.Level))
+		return
+	}
+	if !logs.setLevel(d.Component, level) {
+		s.sendErrorID(id, "LOG_LEVEL_ERROR", fmt.Sprintf("unknown log component %q (want one of %s)", d.Component, strings.Join(logComponents, ", ")))
+		return
+	}
+	sidecarLog.Infof("log level for %s set to %s", cmp.Or(d.Component, "all components"), level)
+	s.sendEventID(id, "sidecar:logLevels", logLevelsData{Levels: logs.levels()})
+}
+
+func main() {
+	// Stray log.Printf output (ours or a dependency's) joins the JSON stream.
+	// stdout is events only; every log line goes to stderr via logs.
+	slog.SetDefault(sidecarLog.logger)
+
+	s := newSidecar(json.NewEncoder(os.Stdout), os.Stdout).defaultNode()
+	s.events = newEventQueue(eventQueueCap)
+	go s.runEventWriter()
+	// Flush what the final tsnet:stopped et al. queued before exiting.
+	defer s.events.close(eventFlushTimeout)
+
+	if path := os.Getenv(controlSocketEnv); path != "" {
+		cs, err := startControlServer(s, path)
+		if err != nil {
+			sidecarLog.Warnf("control socket %s disabled: %v", path, err)
+		} else {
+			s.control = cs
+			defer cs.close()
+			sidecarLog.Debugf("control socket listening on %s", path)
+		}
 	}
 
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
-		line, tooLong, err := readCommandLine(reader, maxCommandBytes)
+		cmd, problem, err := readCommand(reader, s.stdinCBOR.Load())
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("stdin read error: %v", err)
+				sidecarLog.Errorf("stdin read error: %v", err)
 			}
 			break
 		}
-		if tooLong {
-			s.sendError("COMMAND_TOO_LARGE", fmt.Sprintf("command exceeded %d bytes; skipped", maxCommandBytes))
-			continue
-		}
-		line = strings.TrimSpace(line)
-		if line == "" {
+		if problem != nil {
+			s.sendError(problem.Code, problem.Message)
 			continue
 		}
 
-		var cmd command
-		if err := json.Unmarshal([]byte(line), &cmd); err != nil {
-			s.sendError("PARSE_ERROR", fmt.Sprintf("failed to parse command: %v", err))
-			continue
+		s.dispatch(cmd)
+	}
+
+	// Stdin closed — clean shutdown. The parent on stdin owns the nodes'
+	// lifecycles; control-socket clients are attachments and don't keep them up.
+	s.stopAll()
+}
+
+// supportedCommands lists every command dispatch accepts, in dispatch order.
+// It is reported verbatim by sidecar:hello; TestSupportedCommandsDispatch keeps
+// it in lockstep with the switch below.
+var supportedCommands = []string{
+	"sidecar:hello",
+	"tsnet:start",
+	"tsnet:stop",
+	"tsnet:getPeers",
+	"bridge:dial",
+	"tsnet:listen",
+	"tsnet:unlisten",
+	"tsnet:ping",
+	"tsnet:watchPeers",
+	"tsnet:listenPacket",
+	"tsnet:unlistenPacket",
+	"tsnet:pushFile",
+	"tsnet:waitingFiles",
+	"tsnet:getWaitingFile",
+	"tsnet:deleteWaitingFile",
+	"proxy:add",
+	"proxy:remove",
+	"proxy:list",
+	"events:replay",
+	"sidecar:setLogLevel",
+	"tsnet:drain",
+	"tsnet:login",
+	"tsnet:logout",
+	"tsnet:reauth",
+	"tsnet:setHostname",
+	"tsnet:setTags",
+	"tsnet:getPrefs",
+	"tsnet:editPrefs",
+	"tsnet:exitNodes",
+	"tsnet:setExitNode",
+	"sidecar:heartbeat",
+	"config:apply",
+	"bridge:list",
+	"bridge:close",
+}
+
+// processCommands are answered by the sidecar itself rather than a node; they
+// ignore command.node and their replies carry no node tag.
+var processCommands = map[string]bool{
+	"sidecar:hello":       true,
+	"events:replay":       true,
+	"sidecar:setLogLevel": true,
+	"sidecar:heartbeat":   true,
+}
+
+// dispatch routes one parsed command to its handler on the node it names.
+// Handlers receive cmd.ID and echo it on every event they emit.
+func (sc *sidecar) dispatch(cmd command) {
+	sc.dispatchMu.Lock()
+	defer sc.dispatchMu.Unlock()
+	if sc.shutDown {
+		sidecarLog.Debugf("dropping %s: sidecar shutting down", cmd.Command)
+		return
+	}
+
+	s := sc.defaultNode()
+	if !processCommands[cmd.Command] {
+		s = sc.lookupNode(cmd.Node, cmd.Command == "tsnet:start")
+		if s == nil {
+			// Tag the reply with the unknown name so the caller can match it.
+			unknown := &shim{sidecar: sc, node: cmd.Node}
+			unknown.sendErrorID(cmd.ID, "UNKNOWN_NODE", fmt.Sprintf("no node %q (tsnet:start creates it)", cmd.Node))
+			return
 		}
+	}
+	if s.enqueue(cmd) {
+		return
+	}
+	s.handleCommand(cmd)
+}
 
-		switch cmd.Command {
-		case "tsnet:start":
-			s.handleStart(cmd.Data)
-		case "tsnet:stop":
-			s.handleStop()
-		case "tsnet:getPeers":
-			s.handleGetPeers()
-		case "bridge:dial":
-			s.handleDial(cmd.Data)
-		case "tsnet:listen":
-			s.handleListen(cmd.Data)
-		case "tsnet:unlisten":
-			s.handleUnlisten(cmd.Data)
-		case "tsnet:ping":
-			s.handlePing(cmd.Data)
-		case "tsnet:watchPeers":
-			s.handleWatchPeers(cmd.Data)
-		case "tsnet:listenPacket":
-			s.handleListenPacket(cmd.Data)
-		case "tsnet:unlistenPacket":
-			s.handleUnlistenPacket(cmd.Data)
-		case "tsnet:pushFile":
-			s.handlePushFile(cmd.Data)
-		case "tsnet:waitingFiles":
-			s.handleWaitingFiles()
-		case "tsnet:getWaitingFile":
-			s.handleGetWaitingFile(cmd.Data)
-		case "tsnet:deleteWaitingFile":
-			s.handleDeleteWaitingFile(cmd.Data)
-		case "proxy:add":
-			s.handleProxyAdd(cmd.Data)
-		case "proxy:remove":
-			s.handleProxyRemove(cmd.Data)
-		case "proxy:list":
-			s.handleProxyList()
-		default:
-			s.sendError("UNKNOWN_CMD", fmt.Sprintf("unknown command: %s", cmd.Command))
+// handleCommand runs cmd on s. The caller holds dispatchMu.
+func (s *shim) handleCommand(cmd command) {
+	switch cmd.Command {
+	case "sidecar:hello":
+		s.handleHello(cmd.ID, cmd.Data)
+	case "tsnet:start":
+		s.handleStart(cmd.ID, cmd.Data)
+	case "tsnet:stop":
+		s.handleStop(cmd.ID)
+	case "tsnet:getPeers":
+		s.handleGetPeers(cmd.ID)
+	case "bridge:dial":
+		s.handleDial(cmd.ID, cmd.Data)
+	case "tsnet:listen":
+		s.handleListen(cmd.ID, cmd.Data)
+	case "tsnet:unlisten":
+		s.handleUnlisten(cmd.ID, cmd.Data)
+	case "tsnet:ping":
+		s.handlePing(cmd.ID, cmd.Data)
+	case "tsnet:watchPeers":
+		s.handleWatchPeers(cmd.ID, cmd.Data)
+	case "tsnet:listenPacket":
+		s.handleListenPacket(cmd.ID, cmd.Data)
+	case "tsnet:unlistenPacket":
+		s.handleUnlistenPacket(cmd.ID, cmd.Data)
+	case "tsnet:pushFile":
+		s.handlePushFile(cmd.ID, cmd.Data)
+	case "tsnet:waitingFiles":
+		s.handleWaitingFiles(cmd.ID)
+	case "tsnet:getWaitingFile":
+		s.handleGetWaitingFile(cmd.ID, cmd.Data)
+	case "tsnet:deleteWaitingFile":
+		s.handleDeleteWaitingFile(cmd.ID, cmd.Data)
+	case "proxy:add":
+		s.handleProxyAdd(cmd.ID, cmd.Data)
+	case "proxy:remove":
+		s.handleProxyRemove(cmd.ID, cmd.Data)
+	case "proxy:list":
+		s.handleProxyList(cmd.ID)
+	case "events:replay":
+		s.handleEventsReplay(cmd.ID, cmd.Data)
+	case "sidecar:setLogLevel":
+		s.handleSetLogLevel(cmd.ID, cmd.Data)
+	case "tsnet:drain":
+		s.handleDrain(cmd.ID, cmd.Data)
+	case "tsnet:login":
+		s.handleLogin(cmd.ID)
+	case "tsnet:logout":
+		s.handleLogout(cmd.ID)
+	case "tsnet:reauth":
+		s.handleReauth(cmd.ID)
+	case "tsnet:setHostname":
+		s.handleSetHostname(cmd.ID, cmd.Data)
+	case "tsnet:setTags":
+		s.handleSetTags(cmd.ID, cmd.Data)
+	case "tsnet:getPrefs":
+		s.handleGetPrefs(cmd.ID)
+	case "tsnet:editPrefs":
+		s.handleEditPrefs(cmd.ID, cmd.Data)
+	case "tsnet:exitNodes":
+		s.handleExitNodes(cmd.ID)
+	case "tsnet:setExitNode":
+		s.handleSetExitNode(cmd.ID, cmd.Data)
+	case "sidecar:heartbeat":
+		s.handleHeartbeat()
+	case "config:apply":
+		s.handleConfigApply(cmd.ID, cmd.Data)
+	case "bridge:list":
+		s.handleBridgeList(cmd.ID)
+	case "bridge:close":
+		s.handleBridgeClose(cmd.ID, cmd.Data)
+	default:
+		s.sendErrorID(cmd.ID, "UNKNOWN_CMD", fmt.Sprintf("unknown command: %s", cmd.Command))
+	}
+}
+
+// handleHello answers the capability handshake. It needs no running node.
+// A framing request is honored for the channel the hello arrived on: the
+// reply goes out in the old framing, everything after it in the new one.
+func (s *shim) handleHello(id string, data json.RawMessage) {
+	var d helloRequestData
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &d); err != nil {
+			s.sendErrorID(id, "HELLO_ERROR", fmt.Sprintf("invalid hello data: %v", err))
+			return
 		}
 	}
+	if d.Framing != "" && d.Framing != framingJSON && d.Framing != framingCBOR {
+		s.sendErrorID(id, "UNSUPPORTED_FRAMING", fmt.Sprintf("unknown framing %q (valid: json, cbor)", d.Framing))
+		return
+	}
+
+	reply := helloData{
+		ProtocolVersion: sidecarProtocolVersion,
+		Version:         Version,
+		Commands:        supportedCommands,
+		Features:        sidecarFeatures,
+	}
+	if d.Framing == "" {
+		reply.Framing = s.channelFraming(id)
+		s.sendEventID(id, "sidecar:hello", reply)
+		return
+	}
+	reply.Framing = d.Framing
+	if err := s.switchFraming(id, d.Framing == framingCBOR, reply); err != nil {
+		s.sendErrorID(id, "UNSUPPORTED_FRAMING", err.Error())
+	}
+}
 
-	// Stdin closed — clean shutdown
-	s.handleStop()
+// readCommand reads and decodes one command in the channel's framing, skipping
+// blank JSON lines. problem is set for a recoverable per-command failure
+// (oversize or unparseable) that the caller reports and skips; err is a fatal
+// stream error.
+func readCommand(r *bufio.Reader, cborFraming bool) (cmd command, problem *errorData, err error) {
+	for {
+		var raw []byte
+		var tooLong bool
+		if cborFraming {
+			raw, tooLong, err = readCommandFrame(r, maxCommandBytes)
+		} else {
+			var line string
+			line, tooLong, err = readCommandLine(r, maxCommandBytes)
+			raw = []byte(strings.TrimSpace(line))
+		}
+		if err != nil {
+			return command{}, nil, err
+		}
+		if tooLong {
+			return command{}, &errorData{Code: "COMMAND_TOO_LARGE", Message: fmt.Sprintf("command exceeded %d bytes; skipped", maxCommandBytes)}, nil
+		}
+		if len(raw) == 0 && !cborFraming {
+			continue
+		}
+		if cborFraming {
+			err = cbor.Unmarshal(raw, &cmd)
+		} else {
+			err = json.Unmarshal(raw, &cmd)
+		}
+		if err != nil {
+			return command{}, &errorData{Code: "PARSE_ERROR", Message: fmt.Sprintf("failed to parse command: %v", err)}, nil
+		}
+		return cmd, nil, nil
+	}
 }
 
 // readCommandLine reads one '\n'-terminated command line, bounding memory usage
@@ -718,151 +1454,265 @@ func resolveIdleTimeout(secs *int) time.Duration {
 	return idleDeadline
 }
 
-func (s *shim) handleStart(data json.RawMessage) {
+func (s *shim) handleStart(id string, data json.RawMessage) {
+	// dispatch registered a new node for this start; one the start fails to
+	// get going is dropped again, so its name stays UNKNOWN_NODE.
+	defer func() {
+		s.serverMu.RLock()
+		started := s.startSpec != nil
+		s.serverMu.RUnlock()
+		if !started {
+			s.removeNode(s)
+		}
+	}()
+
 	var d startData
 	if err := json.Unmarshal(data, &d); err != nil {
-		s.sendError("START_ERROR", fmt.Sprintf("invalid start data: %v", err))
+		s.sendErrorID(id, "START_ERROR", fmt.Sprintf("invalid start data: %v", err))
 		return
 	}
 
 	// G12: reject a double start rather than orphaning the previous server.
 	if s.getServer() != nil {
-		s.sendError("START_ERROR", "node already started")
+		s.sendErrorID(id, "START_ERROR", "node already started")
+		return
+	}
+	if s.recovering.Load() {
+		s.sendErrorID(id, "START_ERROR", "node is recovering; tsnet:stop it first")
+		return
+	}
+	// Nodes must not share tsnet state. An empty stateDir is tsnet's
+	// per-program default, so two empty ones collide as well.
+	if other := s.stateDirOwner(d.StateDir, s); other != nil {
+		s.sendErrorID(id, "START_ERROR", fmt.Sprintf("stateDir %q is in use by node %q", d.StateDir, other.node))
 		return
 	}
 
 	token, err := hex.DecodeString(d.SessionToken)
 	if err != nil || len(token) != 32 {
-		s.sendError("START_ERROR", "sessionToken must be 64 hex chars (32 bytes)")
+		s.sendErrorID(id, "START_ERROR", "sessionToken must be 64 hex chars (32 bytes)")
+		return
+	}
+	if d.ControlURL != "" {
+		if u, err := url.Parse(d.ControlURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			s.sendErrorID(id, "START_ERROR", fmt.Sprintf("controlUrl %q must be an absolute http(s) URL", d.ControlURL))
+			return
+		}
+	}
+	if d.HeartbeatSecs < 0 {
+		s.sendErrorID(id, "START_ERROR", "heartbeatSecs must not be negative")
+		return
+	}
+	if d.BridgeMuxConns < 0 || d.BridgeMuxConns > muxMaxConns {
+		s.sendErrorID(id, "START_ERROR", fmt.Sprintf("bridgeMuxConns must be between 0 and %d", muxMaxConns))
+		return
+	}
+	if d.BridgeHeaderVersion < 0 || d.BridgeHeaderVersion > headerVersion2 {
+		s.sendErrorID(id, "START_ERROR", fmt.Sprintf("bridgeHeaderVersion %d not supported (max %d)", d.BridgeHeaderVersion, headerVersion2))
+		return
+	}
+	if d.BridgeSocket != "" {
+		if err := checkBridgeSocket(d.BridgeSocket); err != nil {
+			s.sendErrorID(id, "START_ERROR", err.Error())
+			return
+		}
+	}
+	stateStore, migrated, err := openStateStore(d.StateStore, d.StateDir, d.Ephemeral)
+	if err != nil {
+		s.sendErrorID(id, "START_ERROR", fmt.Sprintf("stateStore: %v", err))
 		return
 	}
+	if migrated > 0 {
+		s.sendEventID(id, "tsnet:stateMigrated", stateMigratedData{From: stateStoreFile, To: stateStoreEncrypted, Keys: migrated})
+	}
 	ctx := s.armLifecycle(token, d.BridgePort)
 	s.setIdleTimeout(resolveIdleTimeout(d.IdleTimeoutSecs))
 
-	s.sendStatus("starting", d.Hostname, "", "", "")
+	s.sendStatus(id, "starting", d.Hostname, "", "", "")
 
-	srv := &tsnet.Server{
-		Hostname:  d.Hostname,
-		Dir:       d.StateDir,
-		Ephemeral: d.Ephemeral,
-	}
-	// tsnet's backend Logf is a verbose firehose (magicsock/netcheck/netmap,
-	// "fake tun", etc.). Leaving it nil makes tsnet discard those logs; only
-	// wire it to stderr under TRUFFLE_DEBUG. UserLogf is intentionally left
-	// unset so tsnet still surfaces user-facing messages (the login AuthURL)
-	// via its log.Printf default.
-	if debugEnabled {
-		srv.Logf = log.Printf
-	}
-	if d.AuthKey != "" {
-		srv.AuthKey = d.AuthKey
+	s.serverMu.Lock()
+	s.stateDir = d.StateDir
+	s.startSpec = &d
+	s.startStore = stateStore
+	s.bridgeSocket = d.BridgeSocket
+	s.headerVersion = max(headerVersion, byte(d.BridgeHeaderVersion))
+	s.bridgeAck = d.BridgeAck
+	s.mux = nil
+	if d.BridgeMuxConns > 0 {
+		s.mux = newMuxPool(s, d.BridgeMuxConns)
 	}
-	if len(d.Tags) > 0 {
-		srv.AdvertiseTags = d.Tags
+	s.serverMu.Unlock()
+	s.serveConfigPending.Store(d.StateDir != "")
+	if d.QueueUntilRunning {
+		s.queueMu.Lock()
+		s.queueing = true
+		s.queueMu.Unlock()
 	}
 
+	srv := newTsnetServer(d, stateStore)
 	// M4: only publish the server after a successful Start(), so a failed start
-	// doesn't leave a dead server visible to later commands.
+	// doesn't leave a dead server visible to later commands. The supervisor
+	// keeps retrying it.
 	if err := srv.Start(); err != nil {
-		s.sendStatus("error", "", "", "", err.Error())
+		s.sendStatus(id, "error", "", "", "", err.Error())
+		s.abortQueue("start failed: " + err.Error())
+		s.recovering.Store(true)
+		go s.supervise(ctx, id, d, stateStore, servingSpec{}, err, recoverBackoffMin)
 		return
 	}
 	s.setServer(srv)
 
+	if d.HeartbeatSecs > 0 {
+		go s.watchHeartbeat(ctx, time.Duration(d.HeartbeatSecs)*time.Second)
+	}
+
 	// Wait for running state in background
-	go s.waitForRunning(ctx, d.Hostname)
+	go s.waitForRunning(ctx, id, d.Hostname, d.ControlURL)
+}
+
+// nameAndTags returns the hostname and tags the node should have: its
+// tsnet:start's, with later successful tsnet:setHostname/tsnet:setTags
+// edits applied.
+func (s *shim) nameAndTags() (string, []string) {
+	s.serverMu.RLock()
+	defer s.serverMu.RUnlock()
+	if s.startSpec == nil {
+		return "", nil
+	}
+	return s.startSpec.Hostname, s.startSpec.Tags
+}
+
+// updateStartSpec applies edit to the tsnet:start the node runs under, so a
+// later restart or login picks the change up. The spec is replaced, never
+// modified, since readers hold on to it outside the lock.
+func (s *shim) updateStartSpec(edit func(*startData)) {
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+	if s.startSpec == nil {
+		return
+	}
+	d := *s.startSpec
+	edit(&d)
+	s.startSpec = &d
+}
+
+// newTsnetServer builds the (unstarted) server for a tsnet:start.
+func newTsnetServer(d startData, store ipn.StateStore) *tsnet.Server {
+	srv := &tsnet.Server{
+		Hostname:   d.Hostname,
+		Dir:        d.StateDir,
+		Ephemeral:  d.Ephemeral,
+		ControlURL: d.ControlURL,
+		Store:      store,
+	}
+	// tsnet's backend Logf is a verbose firehose (magicsock/netcheck/netmap,
+	// "fake tun", etc.), so it logs at Debug under the tsnet component and is
+	// dropped at the default level. User-facing messages (the login AuthURL)
+	// log at Info so they stay visible.
+	srv.Logf = tsnetLog.Debugf
+	srv.UserLogf = tsnetLog.Infof
+	if d.AuthKey != "" {
+		srv.AuthKey = d.AuthKey
+	}
+	if len(d.Tags) > 0 {
+		srv.AdvertiseTags = d.Tags
+	}
+	return srv
 }
 
-func (s *shim) waitForRunning(ctx context.Context, hostname string) {
+func (s *shim) waitForRunning(ctx context.Context, id, hostname, controlURL string) {
 	defer s.recoverPanic("waitForRunning")
 
 	srv := s.getServer()
 	if srv == nil {
 		return
 	}
-	lc, err := srv.LocalClient()
-	if err != nil {
-		log.Printf("failed to get local client: %v", err)
-		s.sendStatus("error", "", "", "", err.Error())
-		return
-	}
-
-	authURLSent := false
-	needsApprovalSent := false
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
 
-		status, err := lc.StatusWithoutPeers(ctx)
-		if err != nil {
+	// tsnet retries an unreachable control server forever, which would leave
+	// the core waiting on "starting" with no clue why. A self-hosted control
+	// URL is the usual culprit (typo, server down), so check it answers at
+	// all and fail the start cleanly if not.
+	if controlURL != "" {
+		if err := probeControl(ctx, controlURL); err != nil {
 			if ctx.Err() != nil {
 				return
 			}
-			log.Printf("status check failed: %v", err)
-			time.Sleep(500 * time.Millisecond)
-			continue
-		}
-
-		if !authURLSent && status.AuthURL != "" {
-			s.sendEvent("tsnet:authRequired", authRequiredData{AuthURL: status.AuthURL})
-			authURLSent = true
-		}
-
-		// G10: emit needsApproval only when entering the state, not every 500ms.
-		if status.BackendState == "NeedsMachineAuth" {
-			if !needsApprovalSent {
-				s.sendEvent("tsnet:needsApproval", nil)
-				needsApprovalSent = true
-			}
-		} else {
-			needsApprovalSent = false
-		}
-
-		if status.BackendState == "Running" {
-			var ip string
-			if len(status.TailscaleIPs) > 0 {
-				ip = status.TailscaleIPs[0].String()
+			sidecarLog.Errorf("control %s unreachable: %v", controlURL, err)
+			// Fail the start like a tsnet:stop would end it, under the
+			// dispatcher's lock, unless a stop or restart got there first.
+			s.dispatchMu.Lock()
+			defer s.dispatchMu.Unlock()
+			if ctx.Err() != nil || s.getServer() != srv {
+				return
 			}
-			dnsName := strings.TrimSuffix(status.Self.DNSName, ".")
-			nodeID := string(status.Self.ID)
-			s.setDNSName(dnsName)
-
-			s.sendStatus("running", hostname, dnsName, ip, "")
-			s.sendEvent("tsnet:started", statusData{
-				State:           "running",
+			s.abortQueue("control server unreachable")
+			s.teardown(false) // control can't be told we're leaving
+			s.sendEventID(id, "tsnet:status", statusData{
+				State:           "error",
 				Hostname:        hostname,
-				DNSName:         dnsName,
-				TailscaleIP:     ip,
-				NodeID:          nodeID,
+				Error:           fmt.Sprintf("control server %s unreachable: %v", controlURL, err),
+				Code:            "CONTROL_UNREACHABLE",
 				ProtocolVersion: sidecarProtocolVersion,
 			})
-
-			// The sidecar opens no listeners at startup. The Rust session layer
-			// starts the :9417 TCP listener dynamically via tsnet:listen (avoids a
-			// double-bind with that dynamic listener); serving listeners are
-			// created on demand by tsnet:listen/proxy:add. RFC 023 removed the
-			// v1-era fossil :443 TLS listener that used to start here.
-
-			// Start background state monitor
-			go s.monitorState(ctx, lc)
+			s.removeNode(s)
 			return
 		}
-
-		time.Sleep(500 * time.Millisecond)
 	}
+	lc, err := srv.LocalClient()
+	if err != nil {
+		sidecarLog.Errorf("failed to get local client: %v", err)
+		s.sendStatus(id, "error", "", "", "", err.Error())
+		s.abortQueue("start failed: " + err.Error())
+		return
+	}
+
+	// The sidecar opens no listeners at startup. The Rust session layer
+	// starts the :9417 TCP listener dynamically via tsnet:listen (avoids a
+	// double-bind with that dynamic listener); serving listeners are created
+	// on demand by tsnet:listen/proxy:add. RFC 023 removed the v1-era fossil
+	// :443 TLS listener that used to start here.
+	s.watchState(ctx, id, hostname, localStateSource{lc})
 }
 
-// trackListener adds a listener to the tracked set for cleanup on stop.
+// probeControl reports whether the coordination server at controlURL answers
+// HTTP. Any response counts, even an error status: only transport failures
+// (DNS, refused, TLS, timeout) mean it is unreachable.
+func probeControl(ctx context.Context, controlURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, controlProbeTimeout)
+	defer cancel()
+	keyURL := strings.TrimSuffix(controlURL, "/") + "/key?v=" + strconv.Itoa(int(tailcfg.CurrentCapabilityVersion))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, keyURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// trackListener adds a listener to the tracked set for cleanup on stop.
 func (s *shim) trackListener(ln net.Listener) {
 	s.listenerMu.Lock()
 	defer s.listenerMu.Unlock()
 	s.listeners = append(s.listeners, ln)
 }
 
-func (s *shim) handleStop() {
+func (s *shim) handleStop(id string) {
+	s.abortQueue("node stopped")
+	s.teardown(true)
+	s.recovering.Store(false)
+	s.draining.Store(false)
+	s.sendEventID(id, "tsnet:stopped", nil)
+	s.removeNode(s)
+}
+
+// teardown ends the lifecycle and closes everything the node serves, then
+// the server. offline first tells control the node is leaving on purpose; a
+// recovery skips that because it restarts straight away.
+func (s *shim) teardown(offline bool) {
 	s.serverMu.RLock()
 	cancel := s.cancel
 	s.serverMu.RUnlock()
@@ -882,7 +1732,7 @@ func (s *shim) handleStop() {
 	s.listenerMu.Lock()
 	for _, ln := range s.listeners {
 		if err := ln.Close(); err != nil {
-			log.Printf("listener close error: %v", err)
+			bridgeLog.Warnf("listener close error: %v", err)
 		}
 	}
 	s.listeners = nil
@@ -892,7 +1742,7 @@ func (s *shim) handleStop() {
 	s.dynamicListenerMu.Lock()
 	for port, ln := range s.dynamicListeners {
 		if err := ln.Close(); err != nil {
-			log.Printf("dynamic listener :%d close error: %v", port, err)
+			bridgeLog.Warnf("dynamic listener :%d close error: %v", port, err)
 		}
 	}
 	s.dynamicListeners = make(map[uint16]net.Listener)
@@ -901,7 +1751,7 @@ func (s *shim) handleStop() {
 	// Close UDP relays
 	s.udpRelayMu.Lock()
 	for port, relay := range s.udpRelays {
-		debugf("closing UDP relay :%d", port)
+		udpLog.Debugf("closing UDP relay :%d", port)
 		relay.cancel()
 		relay.tsnetConn.Close()
 		relay.localConn.Close()
@@ -922,10 +1772,20 @@ func (s *shim) handleStop() {
 	s.proxyMu.Unlock()
 
 	for _, entry := range proxyEntries {
-		debugf("shutting down proxy %s", entry.id)
+		proxyLog.Debugf("shutting down proxy %s", entry.id)
 		entry.shutdown(2 * time.Second)
 	}
 
+	// Close what's still bridged; the listeners and proxies feeding it are
+	// gone.
+	s.closeBridges(closeReasonStop, "")
+
+	// Drop the multiplexed bridge connections, resetting whatever streams
+	// are left. The pool itself stays and redials for a recovered server.
+	if mux := s.bridgeMux(); mux != nil {
+		mux.closeAll()
+	}
+
 	if srv := s.getServer(); srv != nil {
 		// Explicitly disconnect from the control plane before closing.
 		// This makes the control server detect the disconnect immediately
@@ -933,7 +1793,7 @@ func (s *shim) handleStop() {
 		// We use EditPrefs to set WantRunning=false which tells the control
 		// server we're intentionally going offline (vs a crash/network issue).
 		lc, lcErr := srv.LocalClient()
-		if lcErr == nil {
+		if lcErr == nil && offline {
 			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 			_, _ = lc.EditPrefs(ctx, &ipn.MaskedPrefs{
 				Prefs: ipn.Prefs{
@@ -944,17 +1804,16 @@ func (s *shim) handleStop() {
 			cancel()
 		}
 		if err := srv.Close(); err != nil {
-			log.Printf("server close error: %v", err)
+			sidecarLog.Warnf("server close error: %v", err)
 		}
 		s.setServer(nil)
 	}
-	s.sendEvent("tsnet:stopped", nil)
 }
 
-func (s *shim) handleGetPeers() {
+func (s *shim) handleGetPeers(id string) {
 	srv := s.getServer()
 	if srv == nil {
-		s.sendError("NOT_RUNNING", "node not running")
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
 		return
 	}
 
@@ -965,7 +1824,7 @@ func (s *shim) handleGetPeers() {
 
 		lc, err := srv.LocalClient()
 		if err != nil {
-			s.sendError("PEERS_ERROR", err.Error())
+			s.sendErrorID(id, "PEERS_ERROR", err.Error())
 			return
 		}
 
@@ -973,7 +1832,7 @@ func (s *shim) handleGetPeers() {
 		defer cancel()
 		status, err := lc.Status(ctx)
 		if err != nil {
-			s.sendError("PEERS_ERROR", err.Error())
+			s.sendErrorID(id, "PEERS_ERROR", err.Error())
 			return
 		}
 
@@ -982,7 +1841,7 @@ func (s *shim) handleGetPeers() {
 			peers = append(peers, statusPeerToInfo(peer))
 		}
 
-		s.sendEvent("tsnet:peers", peersData{Peers: peers})
+		s.sendEventID(id, "tsnet:peers", peersData{Peers: peers})
 	}()
 }
 
@@ -998,10 +1857,10 @@ func shouldWrapTLS(port uint16, tls *bool) bool {
 	return false
 }
 
-func (s *shim) handleDial(data json.RawMessage) {
+func (s *shim) handleDial(id string, data json.RawMessage) {
 	var d dialData
 	if err := json.Unmarshal(data, &d); err != nil {
-		s.sendError("DIAL_ERROR", fmt.Sprintf("invalid dial data: %v", err))
+		s.sendErrorID(id, "DIAL_ERROR", fmt.Sprintf("invalid dial data: %v", err))
 		return
 	}
 
@@ -1010,14 +1869,23 @@ func (s *shim) handleDial(data json.RawMessage) {
 
 		srv := s.getServer()
 		if srv == nil {
-			debugf("[handleDial] rid=%s FAIL: node not running", d.RequestID)
-			s.sendEvent("bridge:dialResult", dialResultData{
+			bridgeLog.Debugf("[handleDial] rid=%s FAIL: node not running", d.RequestID)
+			s.sendEventID(id, "bridge:dialResult", dialResultData{
 				RequestID: d.RequestID,
 				Success:   false,
 				Error:     "node not running",
 			})
 			return
 		}
+		if s.draining.Load() {
+			s.sendEventID(id, "bridge:dialResult", dialResultData{
+				RequestID: d.RequestID,
+				Success:   false,
+				Error:     "node is draining; not accepting new bridges",
+				Code:      "DRAINING",
+			})
+			return
+		}
 
 		// G8: bound the dial so a blackholed peer can't hang this goroutine.
 		dialCtx, cancel := context.WithTimeout(s.lifecycleCtx(), dialTimeout)
@@ -1025,18 +1893,18 @@ func (s *shim) handleDial(data json.RawMessage) {
 
 		// Dial via tsnet
 		addr := fmt.Sprintf("%s:%d", d.Target, d.Port)
-		debugf("[handleDial] rid=%s dialing %s", d.RequestID, addr)
+		bridgeLog.Debugf("[handleDial] rid=%s dialing %s", d.RequestID, addr)
 		tsnetConn, err := srv.Dial(dialCtx, "tcp", addr)
 		if err != nil {
-			debugf("[handleDial] rid=%s DIAL FAILED: %v", d.RequestID, err)
-			s.sendEvent("bridge:dialResult", dialResultData{
+			bridgeLog.Debugf("[handleDial] rid=%s DIAL FAILED: %v", d.RequestID, err)
+			s.sendEventID(id, "bridge:dialResult", dialResultData{
 				RequestID: d.RequestID,
 				Success:   false,
 				Error:     err.Error(),
 			})
 			return
 		}
-		debugf("[handleDial] rid=%s dial succeeded, bridging to Rust", d.RequestID)
+		bridgeLog.Debugf("[handleDial] rid=%s dial succeeded, bridging to Rust", d.RequestID)
 
 		// TLS-wrap when requested (explicit tls flag, or legacy port==443).
 		var conn net.Conn = tsnetConn
@@ -1046,7 +1914,7 @@ func (s *shim) handleDial(data json.RawMessage) {
 			})
 			if err := tlsConn.HandshakeContext(dialCtx); err != nil {
 				tsnetConn.Close()
-				s.sendEvent("bridge:dialResult", dialResultData{
+				s.sendEventID(id, "bridge:dialResult", dialResultData{
 					RequestID: d.RequestID,
 					Success:   false,
 					Error:     fmt.Sprintf("TLS handshake failed: %v", err),
@@ -1056,21 +1924,53 @@ func (s *shim) handleDial(data json.RawMessage) {
 			conn = tlsConn
 		}
 
-		// Bridge to Rust
-		s.bridgeToRust(conn, d.Port, dirOutgoing, d.RequestID, addr, d.Target)
+		m := bridgeMeta{direction: dirOutgoing, port: d.Port, requestID: d.RequestID, remoteAddr: addr, target: d.Target}
+		if s.bridgeHeaderVersion() >= headerVersion2 {
+			if lc, err := srv.LocalClient(); err == nil {
+				s.describePeer(lc, conn, &m)
+			}
+		}
+
+		// With bridgeAck, success is reported once the core accepts the
+		// stream; without it, only failures are.
+		var accepted func()
+		if s.bridgeAckEnabled() {
+			accepted = func() {
+				s.sendEventID(id, "bridge:dialResult", dialResultData{RequestID: d.RequestID, Success: true})
+			}
+		}
+
+		// Bridge to Rust. BUG-8: report a bridge connect/header failure, or the
+		// core is left waiting on a stream that never arrives.
+		if err := s.bridgeToRust(conn, m, accepted); err != nil {
+			r := dialResultData{
+				RequestID: d.RequestID,
+				Success:   false,
+				Error:     err.Error(),
+			}
+			var rejected *bridgeAckError
+			if errors.As(err, &rejected) {
+				r.Code = rejected.code
+			}
+			s.sendEventID(id, "bridge:dialResult", r)
+		}
 	}()
 }
 
-func (s *shim) handleListen(data json.RawMessage) {
+func (s *shim) handleListen(id string, data json.RawMessage) {
 	var d listenData
 	if err := json.Unmarshal(data, &d); err != nil {
-		s.sendError("LISTEN_ERROR", fmt.Sprintf("invalid listen data: %v", err))
+		s.sendErrorID(id, "LISTEN_ERROR", fmt.Sprintf("invalid listen data: %v", err))
 		return
 	}
 
 	srv := s.getServer()
 	if srv == nil {
-		s.sendError("NOT_RUNNING", "node not running")
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
+		return
+	}
+	if s.draining.Load() {
+		s.sendErrorID(id, "DRAINING", "node is draining; not accepting new listeners")
 		return
 	}
 
@@ -1078,7 +1978,7 @@ func (s *shim) handleListen(data json.RawMessage) {
 	s.dynamicListenerMu.Lock()
 	if _, exists := s.dynamicListeners[d.Port]; exists {
 		s.dynamicListenerMu.Unlock()
-		s.sendError("LISTEN_ERROR", fmt.Sprintf("already listening on port %d", d.Port))
+		s.sendErrorID(id, "LISTEN_ERROR", fmt.Sprintf("already listening on port %d", d.Port))
 		return
 	}
 	s.dynamicListenerMu.Unlock()
@@ -1090,7 +1990,7 @@ func (s *shim) handleListen(data json.RawMessage) {
 
 		lc, err := srv.LocalClient()
 		if err != nil {
-			s.sendError("LISTEN_ERROR", fmt.Sprintf("failed to get local client: %v", err))
+			s.sendErrorID(id, "LISTEN_ERROR", fmt.Sprintf("failed to get local client: %v", err))
 			return
 		}
 
@@ -1103,7 +2003,7 @@ func (s *shim) handleListen(data json.RawMessage) {
 			ln, err = srv.Listen("tcp", addr)
 		}
 		if err != nil {
-			s.sendError("LISTEN_ERROR", fmt.Sprintf("Listen :%d: %v", d.Port, err))
+			s.sendErrorID(id, "LISTEN_ERROR", fmt.Sprintf("Listen :%d: %v", d.Port, err))
 			return
 		}
 
@@ -1139,22 +2039,24 @@ func (s *shim) handleListen(data json.RawMessage) {
 		if _, exists := s.dynamicListeners[actualPort]; exists {
 			s.dynamicListenerMu.Unlock()
 			ln.Close()
-			s.sendError("LISTEN_ERROR", fmt.Sprintf("already listening on port %d", actualPort))
+			s.sendErrorID(id, "LISTEN_ERROR", fmt.Sprintf("already listening on port %d", actualPort))
 			return
 		}
 		s.dynamicListeners[actualPort] = ln
+		s.listenTLS[actualPort] = d.TLS
 		s.dynamicListenerMu.Unlock()
+		listenerID := s.nextListenerID.Add(1)
 
 		// Also track in the main listener list for cleanup on stop
 		s.trackListener(ln)
 
-		s.sendEvent("tsnet:listening", listeningData{Port: actualPort})
+		s.sendEventID(id, "tsnet:listening", listeningData{Port: actualPort, ListenerID: listenerID})
 
 		proto := "TCP"
 		if d.TLS {
 			proto = "TLS"
 		}
-		debugf("listening %s on :%d (dynamic, requested :%d)", proto, actualPort, d.Port)
+		bridgeLog.Debugf("listening %s on :%d (dynamic, requested :%d)", proto, actualPort, d.Port)
 
 		for {
 			conn, err := ln.Accept()
@@ -1171,24 +2073,29 @@ func (s *shim) handleListen(data json.RawMessage) {
 				if !stillActive {
 					return
 				}
-				log.Printf("accept :%d error: %v", actualPort, err)
+				bridgeLog.Errorf("accept :%d error: %v", actualPort, err)
 				continue
 			}
 			// Route using actualPort — the Rust bridge registered its
 			// listener channel under the real port, not the requested 0.
 			// G7: resolve identity inside the goroutine, off the accept path.
 			go func(c net.Conn) {
-				peerIdentity := s.resolvePeerIdentity(lc, c.RemoteAddr().String())
-				s.bridgeToRust(c, actualPort, dirIncoming, "", c.RemoteAddr().String(), peerIdentity)
+				m := bridgeMeta{direction: dirIncoming, port: actualPort, remoteAddr: c.RemoteAddr().String(), listenerID: listenerID}
+				if err := s.describePeer(lc, c, &m); err != nil {
+					bridgeLog.Debugf("accept :%d: %v", actualPort, err)
+					c.Close()
+					return
+				}
+				s.bridgeToRust(c, m, nil)
 			}(conn)
 		}
 	}()
 }
 
-func (s *shim) handleUnlisten(data json.RawMessage) {
+func (s *shim) handleUnlisten(id string, data json.RawMessage) {
 	var d unlistenData
 	if err := json.Unmarshal(data, &d); err != nil {
-		s.sendError("UNLISTEN_ERROR", fmt.Sprintf("invalid unlisten data: %v", err))
+		s.sendErrorID(id, "UNLISTEN_ERROR", fmt.Sprintf("invalid unlisten data: %v", err))
 		return
 	}
 
@@ -1196,30 +2103,34 @@ func (s *shim) handleUnlisten(data json.RawMessage) {
 	ln, exists := s.dynamicListeners[d.Port]
 	if !exists {
 		s.dynamicListenerMu.Unlock()
-		s.sendError("UNLISTEN_ERROR", fmt.Sprintf("no listener on port %d", d.Port))
+		s.sendErrorID(id, "UNLISTEN_ERROR", fmt.Sprintf("no listener on port %d", d.Port))
 		return
 	}
 	delete(s.dynamicListeners, d.Port)
 	s.dynamicListenerMu.Unlock()
 
 	if err := ln.Close(); err != nil {
-		log.Printf("close listener :%d error: %v", d.Port, err)
+		bridgeLog.Warnf("close listener :%d error: %v", d.Port, err)
 	}
 
-	debugf("stopped listening on :%d (dynamic)", d.Port)
-	s.sendEvent("tsnet:unlistened", unlistenedData{Port: d.Port})
+	bridgeLog.Debugf("stopped listening on :%d (dynamic)", d.Port)
+	s.sendEventID(id, "tsnet:unlistened", unlistenedData{Port: d.Port})
 }
 
-func (s *shim) handleListenPacket(data json.RawMessage) {
+func (s *shim) handleListenPacket(id string, data json.RawMessage) {
 	var d listenPacketData
 	if err := json.Unmarshal(data, &d); err != nil {
-		s.sendError("LISTEN_PACKET_ERROR", fmt.Sprintf("invalid listenPacket data: %v", err))
+		s.sendErrorID(id, "LISTEN_PACKET_ERROR", fmt.Sprintf("invalid listenPacket data: %v", err))
 		return
 	}
 
 	srv := s.getServer()
 	if srv == nil {
-		s.sendError("NOT_RUNNING", "node not running")
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
+		return
+	}
+	if s.draining.Load() {
+		s.sendErrorID(id, "DRAINING", "node is draining; not accepting new relays")
 		return
 	}
 
@@ -1227,7 +2138,7 @@ func (s *shim) handleListenPacket(data json.RawMessage) {
 	s.udpRelayMu.Lock()
 	if _, exists := s.udpRelays[d.Port]; exists {
 		s.udpRelayMu.Unlock()
-		s.sendError("LISTEN_PACKET_ERROR", fmt.Sprintf("already listening UDP on port %d", d.Port))
+		s.sendErrorID(id, "LISTEN_PACKET_ERROR", fmt.Sprintf("already listening UDP on port %d", d.Port))
 		return
 	}
 	s.udpRelayMu.Unlock()
@@ -1240,18 +2151,18 @@ func (s *shim) handleListenPacket(data json.RawMessage) {
 		// Get the tailscale IP for binding
 		status, err := srv.LocalClient()
 		if err != nil {
-			s.sendError("LISTEN_PACKET_ERROR", fmt.Sprintf("failed to get local client: %v", err))
+			s.sendErrorID(id, "LISTEN_PACKET_ERROR", fmt.Sprintf("failed to get local client: %v", err))
 			return
 		}
 
 		st, err := status.StatusWithoutPeers(ctx)
 		if err != nil {
-			s.sendError("LISTEN_PACKET_ERROR", fmt.Sprintf("failed to get status: %v", err))
+			s.sendErrorID(id, "LISTEN_PACKET_ERROR", fmt.Sprintf("failed to get status: %v", err))
 			return
 		}
 
 		if len(st.TailscaleIPs) == 0 {
-			s.sendError("LISTEN_PACKET_ERROR", "no Tailscale IPs available")
+			s.sendErrorID(id, "LISTEN_PACKET_ERROR", "no Tailscale IPs available")
 			return
 		}
 
@@ -1259,19 +2170,19 @@ func (s *shim) handleListenPacket(data json.RawMessage) {
 		listenAddr := fmt.Sprintf("%s:%d", tsIP, d.Port)
 
 		// Bind tsnet PacketConn
-		debugf("UDP relay: calling ListenPacket(%q, %q)", "udp", listenAddr)
+		udpLog.Debugf("UDP relay: calling ListenPacket(%q, %q)", "udp", listenAddr)
 		tsnetPC, err := srv.ListenPacket("udp", listenAddr)
 		if err != nil {
-			s.sendError("LISTEN_PACKET_ERROR", fmt.Sprintf("ListenPacket %s: %v", listenAddr, err))
+			s.sendErrorID(id, "LISTEN_PACKET_ERROR", fmt.Sprintf("ListenPacket %s: %v", listenAddr, err))
 			return
 		}
-		debugf("UDP relay: ListenPacket succeeded, local addr = %v", tsnetPC.LocalAddr())
+		udpLog.Debugf("UDP relay: ListenPacket succeeded, local addr = %v", tsnetPC.LocalAddr())
 
 		// Bind local relay UDP socket on ephemeral port
 		localPC, err := net.ListenPacket("udp", "127.0.0.1:0")
 		if err != nil {
 			tsnetPC.Close()
-			s.sendError("LISTEN_PACKET_ERROR", fmt.Sprintf("local UDP bind: %v", err))
+			s.sendErrorID(id, "LISTEN_PACKET_ERROR", fmt.Sprintf("local UDP bind: %v", err))
 			return
 		}
 
@@ -1296,18 +2207,18 @@ func (s *shim) handleListenPacket(data json.RawMessage) {
 			relayCancel()
 			tsnetPC.Close()
 			localPC.Close()
-			s.sendError("LISTEN_PACKET_ERROR", fmt.Sprintf("already listening UDP on port %d", d.Port))
+			s.sendErrorID(id, "LISTEN_PACKET_ERROR", fmt.Sprintf("already listening UDP on port %d", d.Port))
 			return
 		}
 		s.udpRelays[d.Port] = relay
 		s.udpRelayMu.Unlock()
 
-		s.sendEvent("tsnet:listeningPacket", listeningPacketData{
+		s.sendEventID(id, "tsnet:listeningPacket", listeningPacketData{
 			Port:      d.Port,
 			LocalPort: localPort,
 		})
 
-		debugf("UDP relay started: tsnet %s <-> 127.0.0.1:%d", listenAddr, localPort)
+		udpLog.Debugf("UDP relay started: tsnet %s <-> 127.0.0.1:%d", listenAddr, localPort)
 
 		// Self-test: verify the tsnet PacketConn can send to itself.
 		// This catches misconfigurations early (wrong address format, etc).
@@ -1315,12 +2226,12 @@ func (s *shim) handleListenPacket(data json.RawMessage) {
 		go func() {
 			selfAddr := tsnetPC.LocalAddr()
 			testPayload := []byte("truffle-udp-selftest")
-			debugf("UDP relay self-test: sending %d bytes to self at %v", len(testPayload), selfAddr)
+			udpLog.Debugf("UDP relay self-test: sending %d bytes to self at %v", len(testPayload), selfAddr)
 			nw, werr := tsnetPC.WriteTo(testPayload, selfAddr)
 			if werr != nil {
-				debugf("UDP relay self-test: WriteTo FAILED: %v", werr)
+				udpLog.Debugf("UDP relay self-test: WriteTo FAILED: %v", werr)
 			} else {
-				debugf("UDP relay self-test: WriteTo sent %d bytes to self OK", nw)
+				udpLog.Debugf("UDP relay self-test: WriteTo sent %d bytes to self OK", nw)
 			}
 		}()
 
@@ -1345,22 +2256,22 @@ func (s *shim) handleListenPacket(data json.RawMessage) {
 					if relayCtx.Err() != nil {
 						return
 					}
-					log.Printf("UDP relay tsnet read error: %v", err)
+					udpLog.Errorf("UDP relay tsnet read error: %v", err)
 					continue
 				}
 
-				debugf("UDP relay inbound: %d bytes from %v", n, remoteAddr)
+				udpLog.Debugf("UDP relay inbound: %d bytes from %v", n, remoteAddr)
 
 				// Parse remote address to get IP and port for the header
 				udpAddr, ok := remoteAddr.(*net.UDPAddr)
 				if !ok {
-					debugf("UDP relay: unexpected remote addr type: %T", remoteAddr)
+					udpLog.Debugf("UDP relay: unexpected remote addr type: %T", remoteAddr)
 					continue
 				}
 
 				ip4 := udpAddr.IP.To4()
 				if ip4 == nil {
-					debugf("UDP relay: non-IPv4 remote addr: %v", udpAddr)
+					udpLog.Debugf("UDP relay: non-IPv4 remote addr: %v", udpAddr)
 					continue
 				}
 
@@ -1375,16 +2286,16 @@ func (s *shim) handleListenPacket(data json.RawMessage) {
 				rustAddrMu.Unlock()
 
 				if ra == nil {
-					debugf("UDP relay: no Rust peer address yet, dropping inbound packet from %v", remoteAddr)
+					udpLog.Debugf("UDP relay: no Rust peer address yet, dropping inbound packet from %v", remoteAddr)
 					continue
 				}
 
-				debugf("UDP relay inbound: forwarding %d framed bytes to Rust at %v", len(framed), ra)
+				udpLog.Debugf("UDP relay inbound: forwarding %d framed bytes to Rust at %v", len(framed), ra)
 				if _, err := localPC.WriteTo(framed, ra); err != nil {
 					if relayCtx.Err() != nil {
 						return
 					}
-					log.Printf("UDP relay local write error: %v", err)
+					udpLog.Errorf("UDP relay local write error: %v", err)
 				}
 			}
 		}()
@@ -1403,7 +2314,7 @@ func (s *shim) handleListenPacket(data json.RawMessage) {
 				if relayCtx.Err() != nil {
 					return
 				}
-				log.Printf("UDP relay local read error: %v", err)
+				udpLog.Errorf("UDP relay local read error: %v", err)
 				continue
 			}
 
@@ -1417,7 +2328,7 @@ func (s *shim) handleListenPacket(data json.RawMessage) {
 			rustAddrMu.Lock()
 			if isRegister {
 				if rustAddr == nil {
-					debugf("UDP relay: learned Rust peer address: %v", senderAddr)
+					udpLog.Debugf("UDP relay: learned Rust peer address: %v", senderAddr)
 				}
 				rustAddr = senderAddr
 			}
@@ -1425,17 +2336,17 @@ func (s *shim) handleListenPacket(data json.RawMessage) {
 			rustAddrMu.Unlock()
 
 			if isRegister {
-				debugf("UDP relay: registration packet from Rust at %v", senderAddr)
+				udpLog.Debugf("UDP relay: registration packet from Rust at %v", senderAddr)
 				continue
 			}
 
 			if !trusted {
-				debugf("UDP relay: dropping datagram from untrusted local sender %v", senderAddr)
+				udpLog.Debugf("UDP relay: dropping datagram from untrusted local sender %v", senderAddr)
 				continue
 			}
 
 			if n < 6 {
-				debugf("UDP relay: outbound packet too short (%d bytes)", n)
+				udpLog.Debugf("UDP relay: outbound packet too short (%d bytes)", n)
 				continue
 			}
 
@@ -1451,23 +2362,23 @@ func (s *shim) handleListenPacket(data json.RawMessage) {
 			payload := buf[6:n]
 
 			targetAddr := &net.UDPAddr{IP: targetIP, Port: int(targetPort)}
-			debugf("UDP relay outbound: %d payload bytes -> %v (IP len=%d, raw IP=%x)", len(payload), targetAddr, len(targetIP), []byte(targetIP))
+			udpLog.Debugf("UDP relay outbound: %d payload bytes -> %v (IP len=%d, raw IP=%x)", len(payload), targetAddr, len(targetIP), []byte(targetIP))
 			if _, err := tsnetPC.WriteTo(payload, targetAddr); err != nil {
 				if relayCtx.Err() != nil {
 					return
 				}
-				log.Printf("UDP relay tsnet write error to %v: %v", targetAddr, err)
+				udpLog.Errorf("UDP relay tsnet write error to %v: %v", targetAddr, err)
 			} else {
-				debugf("UDP relay outbound: sent %d bytes to %v OK", len(payload), targetAddr)
+				udpLog.Debugf("UDP relay outbound: sent %d bytes to %v OK", len(payload), targetAddr)
 			}
 		}
 	}()
 }
 
-func (s *shim) handleUnlistenPacket(data json.RawMessage) {
+func (s *shim) handleUnlistenPacket(id string, data json.RawMessage) {
 	var d listenPacketData
 	if err := json.Unmarshal(data, &d); err != nil {
-		s.sendError("UNLISTEN_PACKET_ERROR", fmt.Sprintf("invalid unlistenPacket data: %v", err))
+		s.sendErrorID(id, "UNLISTEN_PACKET_ERROR", fmt.Sprintf("invalid unlistenPacket data: %v", err))
 		return
 	}
 
@@ -1475,7 +2386,7 @@ func (s *shim) handleUnlistenPacket(data json.RawMessage) {
 	relay, exists := s.udpRelays[d.Port]
 	if !exists {
 		s.udpRelayMu.Unlock()
-		s.sendError("UNLISTEN_PACKET_ERROR", fmt.Sprintf("no UDP relay on port %d", d.Port))
+		s.sendErrorID(id, "UNLISTEN_PACKET_ERROR", fmt.Sprintf("no UDP relay on port %d", d.Port))
 		return
 	}
 	delete(s.udpRelays, d.Port)
@@ -1487,20 +2398,20 @@ func (s *shim) handleUnlistenPacket(data json.RawMessage) {
 	relay.tsnetConn.Close()
 	relay.localConn.Close()
 
-	debugf("stopped UDP relay on :%d", d.Port)
-	s.sendEvent("tsnet:unlistenedPacket", listenPacketData{Port: d.Port})
+	udpLog.Debugf("stopped UDP relay on :%d", d.Port)
+	s.sendEventID(id, "tsnet:unlistenedPacket", listenPacketData{Port: d.Port})
 }
 
-func (s *shim) handlePing(data json.RawMessage) {
+func (s *shim) handlePing(id string, data json.RawMessage) {
 	var d pingData
 	if err := json.Unmarshal(data, &d); err != nil {
-		s.sendError("PING_ERROR", fmt.Sprintf("invalid ping data: %v", err))
+		s.sendErrorID(id, "PING_ERROR", fmt.Sprintf("invalid ping data: %v", err))
 		return
 	}
 
 	srv := s.getServer()
 	if srv == nil {
-		s.sendError("NOT_RUNNING", "node not running")
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
 		return
 	}
 
@@ -1512,7 +2423,7 @@ func (s *shim) handlePing(data json.RawMessage) {
 		emit := func(r pingResultData) {
 			r.Target = d.Target
 			r.RequestID = d.RequestID
-			s.sendEvent("tsnet:pingResult", r)
+			s.sendEventID(id, "tsnet:pingResult", r)
 		}
 
 		lc, err := srv.LocalClient()
@@ -1568,16 +2479,16 @@ func (s *shim) handlePing(data json.RawMessage) {
 	}()
 }
 
-func (s *shim) handleWatchPeers(data json.RawMessage) {
+func (s *shim) handleWatchPeers(id string, data json.RawMessage) {
 	srv := s.getServer()
 	if srv == nil {
-		s.sendError("NOT_RUNNING", "node not running")
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
 		return
 	}
 
 	lc, err := srv.LocalClient()
 	if err != nil {
-		s.sendError("WATCH_PEERS_ERROR", fmt.Sprintf("failed to get local client: %v", err))
+		s.sendErrorID(id, "WATCH_PEERS_ERROR", fmt.Sprintf("failed to get local client: %v", err))
 		return
 	}
 
@@ -1609,7 +2520,7 @@ func (s *shim) handleWatchPeers(data json.RawMessage) {
 			newStatus, err := lc.Status(ctx)
 			if err != nil {
 				if watchCtx.Err() == nil {
-					log.Printf("WatchIPNBus: status fetch failed: %v", err)
+					watchLog.Warnf("WatchIPNBus: status fetch failed: %v", err)
 				}
 				return
 			}
@@ -1625,21 +2536,21 @@ func (s *shim) handleWatchPeers(data json.RawMessage) {
 				seeded = true
 				return
 			}
-			for id, pi := range current {
-				if _, ok := knownPeers[id]; !ok {
+			for peerID, pi := range current {
+				if _, ok := knownPeers[peerID]; !ok {
 					piCopy := pi
-					s.sendEvent("tsnet:peerChanged", peerChangedData{ChangeType: "joined", PeerID: id, Peer: &piCopy})
+					s.sendEventID(id, "tsnet:peerChanged", peerChangedData{ChangeType: "joined", PeerID: peerID, Peer: &piCopy})
 				}
 			}
-			for id := range knownPeers {
-				if _, ok := current[id]; !ok {
-					s.sendEvent("tsnet:peerChanged", peerChangedData{ChangeType: "left", PeerID: id})
+			for peerID := range knownPeers {
+				if _, ok := current[peerID]; !ok {
+					s.sendEventID(id, "tsnet:peerChanged", peerChangedData{ChangeType: "left", PeerID: peerID})
 				}
 			}
-			for id, newPi := range current {
-				if oldPi, ok := knownPeers[id]; ok && watchPeerChanged(oldPi, newPi) {
+			for peerID, newPi := range current {
+				if oldPi, ok := knownPeers[peerID]; ok && watchPeerChanged(oldPi, newPi) {
 					piCopy := newPi
-					s.sendEvent("tsnet:peerChanged", peerChangedData{ChangeType: "updated", PeerID: id, Peer: &piCopy})
+					s.sendEventID(id, "tsnet:peerChanged", peerChangedData{ChangeType: "updated", PeerID: peerID, Peer: &piCopy})
 				}
 			}
 			knownPeers = current
@@ -1662,8 +2573,8 @@ func (s *shim) handleWatchPeers(data json.RawMessage) {
 				if watchCtx.Err() != nil {
 					return
 				}
-				log.Printf("WatchIPNBus failed: %v", err)
-				s.sendEvent("tsnet:watchPeersError", errorData{Code: "WATCH_PEERS_ERROR", Message: err.Error()})
+				watchLog.Errorf("WatchIPNBus failed: %v", err)
+				s.sendEventID(id, "tsnet:watchPeersError", errorData{Code: "WATCH_PEERS_ERROR", Message: err.Error()})
 				select {
 				case <-watchCtx.Done():
 					return
@@ -1675,7 +2586,7 @@ func (s *shim) handleWatchPeers(data json.RawMessage) {
 				continue
 			}
 			backoff = time.Second // reset on a successful (re)connect
-			debugf("WatchIPNBus started, listening for peer changes")
+			watchLog.Debugf("WatchIPNBus started, listening for peer changes")
 
 			// Seed / re-baseline on (re)connect.
 			diff()
@@ -1716,8 +2627,8 @@ func (s *shim) handleWatchPeers(data json.RawMessage) {
 					if watchCtx.Err() != nil {
 						return
 					}
-					log.Printf("WatchIPNBus error: %v", werr)
-					s.sendEvent("tsnet:watchPeersError", errorData{Code: "WATCH_PEERS_ERROR", Message: werr.Error()})
+					watchLog.Errorf("WatchIPNBus error: %v", werr)
+					s.sendEventID(id, "tsnet:watchPeersError", errorData{Code: "WATCH_PEERS_ERROR", Message: werr.Error()})
 					break inner // reconnect
 				}
 			}
@@ -1775,16 +2686,16 @@ func watchPeerChanged(old, new peerInfo) bool {
 	return false
 }
 
-func (s *shim) handlePushFile(data json.RawMessage) {
+func (s *shim) handlePushFile(id string, data json.RawMessage) {
 	var d pushFileData
 	if err := json.Unmarshal(data, &d); err != nil {
-		s.sendError("PUSH_FILE_ERROR", fmt.Sprintf("invalid pushFile data: %v", err))
+		s.sendErrorID(id, "PUSH_FILE_ERROR", fmt.Sprintf("invalid pushFile data: %v", err))
 		return
 	}
 
 	srv := s.getServer()
 	if srv == nil {
-		s.sendError("NOT_RUNNING", "node not running")
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
 		return
 	}
 
@@ -1793,7 +2704,7 @@ func (s *shim) handlePushFile(data json.RawMessage) {
 
 		lc, err := srv.LocalClient()
 		if err != nil {
-			s.sendEvent("tsnet:pushFileResult", pushFileResultData{
+			s.sendEventID(id, "tsnet:pushFileResult", pushFileResultData{
 				Success: false,
 				Error:   fmt.Sprintf("failed to get local client: %v", err),
 			})
@@ -1802,7 +2713,7 @@ func (s *shim) handlePushFile(data json.RawMessage) {
 
 		f, err := os.Open(d.FilePath)
 		if err != nil {
-			s.sendEvent("tsnet:pushFileResult", pushFileResultData{
+			s.sendEventID(id, "tsnet:pushFileResult", pushFileResultData{
 				Success: false,
 				Error:   fmt.Sprintf("failed to open file: %v", err),
 			})
@@ -1812,7 +2723,7 @@ func (s *shim) handlePushFile(data json.RawMessage) {
 
 		fi, err := f.Stat()
 		if err != nil {
-			s.sendEvent("tsnet:pushFileResult", pushFileResultData{
+			s.sendEventID(id, "tsnet:pushFileResult", pushFileResultData{
 				Success: false,
 				Error:   fmt.Sprintf("failed to stat file: %v", err),
 			})
@@ -1824,23 +2735,25 @@ func (s *shim) handlePushFile(data json.RawMessage) {
 
 		err = lc.PushFile(ctx, tailcfg.StableNodeID(d.TargetNodeID), fi.Size(), d.FileName, f)
 		if err != nil {
-			s.sendEvent("tsnet:pushFileResult", pushFileResultData{
+			taildropLog.Warnf("push %s (%d bytes) to %s failed: %v", d.FileName, fi.Size(), d.TargetNodeID, err)
+			s.sendEventID(id, "tsnet:pushFileResult", pushFileResultData{
 				Success: false,
 				Error:   fmt.Sprintf("push file failed: %v", err),
 			})
 			return
 		}
 
-		s.sendEvent("tsnet:pushFileResult", pushFileResultData{
+		taildropLog.Debugf("pushed %s (%d bytes) to %s", d.FileName, fi.Size(), d.TargetNodeID)
+		s.sendEventID(id, "tsnet:pushFileResult", pushFileResultData{
 			Success: true,
 		})
 	}()
 }
 
-func (s *shim) handleWaitingFiles() {
+func (s *shim) handleWaitingFiles(id string) {
 	srv := s.getServer()
 	if srv == nil {
-		s.sendError("NOT_RUNNING", "node not running")
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
 		return
 	}
 
@@ -1849,13 +2762,13 @@ func (s *shim) handleWaitingFiles() {
 
 		lc, err := srv.LocalClient()
 		if err != nil {
-			s.sendError("WAITING_FILES_ERROR", fmt.Sprintf("failed to get local client: %v", err))
+			s.sendErrorID(id, "WAITING_FILES_ERROR", fmt.Sprintf("failed to get local client: %v", err))
 			return
 		}
 
 		files, err := lc.WaitingFiles(s.lifecycleCtx())
 		if err != nil {
-			s.sendError("WAITING_FILES_ERROR", fmt.Sprintf("waiting files failed: %v", err))
+			s.sendErrorID(id, "WAITING_FILES_ERROR", fmt.Sprintf("waiting files failed: %v", err))
 			return
 		}
 
@@ -1870,22 +2783,22 @@ func (s *shim) handleWaitingFiles() {
 			infos = []waitingFileInfo{} // ensure non-null JSON array
 		}
 
-		s.sendEvent("tsnet:waitingFilesResult", waitingFilesResultData{
+		s.sendEventID(id, "tsnet:waitingFilesResult", waitingFilesResultData{
 			Files: infos,
 		})
 	}()
 }
 
-func (s *shim) handleGetWaitingFile(data json.RawMessage) {
+func (s *shim) handleGetWaitingFile(id string, data json.RawMessage) {
 	var d getWaitingFileData
 	if err := json.Unmarshal(data, &d); err != nil {
-		s.sendError("GET_WAITING_FILE_ERROR", fmt.Sprintf("invalid getWaitingFile data: %v", err))
+		s.sendErrorID(id, "GET_WAITING_FILE_ERROR", fmt.Sprintf("invalid getWaitingFile data: %v", err))
 		return
 	}
 
 	srv := s.getServer()
 	if srv == nil {
-		s.sendError("NOT_RUNNING", "node not running")
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
 		return
 	}
 
@@ -1893,7 +2806,8 @@ func (s *shim) handleGetWaitingFile(data json.RawMessage) {
 		defer s.recoverPanic("handleGetWaitingFile")
 
 		fail := func(msg string) {
-			s.sendEvent("tsnet:getWaitingFileResult", getWaitingFileResultData{
+			taildropLog.Warnf("get waiting file %s: %s", d.FileName, msg)
+			s.sendEventID(id, "tsnet:getWaitingFileResult", getWaitingFileResultData{
 				Success:  false,
 				FileName: d.FileName,
 				SavePath: d.SavePath,
@@ -1943,7 +2857,8 @@ func (s *shim) handleGetWaitingFile(data json.RawMessage) {
 			return
 		}
 
-		s.sendEvent("tsnet:getWaitingFileResult", getWaitingFileResultData{
+		taildropLog.Debugf("saved waiting file %s (%d bytes) to %s", d.FileName, size, d.SavePath)
+		s.sendEventID(id, "tsnet:getWaitingFileResult", getWaitingFileResultData{
 			Success:  true,
 			FileName: d.FileName,
 			SavePath: d.SavePath,
@@ -1951,16 +2866,16 @@ func (s *shim) handleGetWaitingFile(data json.RawMessage) {
 	}()
 }
 
-func (s *shim) handleDeleteWaitingFile(data json.RawMessage) {
+func (s *shim) handleDeleteWaitingFile(id string, data json.RawMessage) {
 	var d deleteWaitingFileData
 	if err := json.Unmarshal(data, &d); err != nil {
-		s.sendError("DELETE_WAITING_FILE_ERROR", fmt.Sprintf("invalid deleteWaitingFile data: %v", err))
+		s.sendErrorID(id, "DELETE_WAITING_FILE_ERROR", fmt.Sprintf("invalid deleteWaitingFile data: %v", err))
 		return
 	}
 
 	srv := s.getServer()
 	if srv == nil {
-		s.sendError("NOT_RUNNING", "node not running")
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
 		return
 	}
 
@@ -1969,7 +2884,7 @@ func (s *shim) handleDeleteWaitingFile(data json.RawMessage) {
 
 		lc, err := srv.LocalClient()
 		if err != nil {
-			s.sendEvent("tsnet:deleteWaitingFileResult", deleteWaitingFileResultData{
+			s.sendEventID(id, "tsnet:deleteWaitingFileResult", deleteWaitingFileResultData{
 				Success:  false,
 				FileName: d.FileName,
 				Error:    fmt.Sprintf("failed to get local client: %v", err),
@@ -1979,7 +2894,8 @@ func (s *shim) handleDeleteWaitingFile(data json.RawMessage) {
 
 		err = lc.DeleteWaitingFile(s.lifecycleCtx(), d.FileName)
 		if err != nil {
-			s.sendEvent("tsnet:deleteWaitingFileResult", deleteWaitingFileResultData{
+			taildropLog.Warnf("delete waiting file %s failed: %v", d.FileName, err)
+			s.sendEventID(id, "tsnet:deleteWaitingFileResult", deleteWaitingFileResultData{
 				Success:  false,
 				FileName: d.FileName,
 				Error:    fmt.Sprintf("delete waiting file failed: %v", err),
@@ -1987,23 +2903,27 @@ func (s *shim) handleDeleteWaitingFile(data json.RawMessage) {
 			return
 		}
 
-		s.sendEvent("tsnet:deleteWaitingFileResult", deleteWaitingFileResultData{
+		s.sendEventID(id, "tsnet:deleteWaitingFileResult", deleteWaitingFileResultData{
 			Success:  true,
 			FileName: d.FileName,
 		})
 	}()
 }
 
-func (s *shim) handleProxyAdd(raw json.RawMessage) {
+func (s *shim) handleProxyAdd(id string, raw json.RawMessage) {
 	srv := s.getServer()
 	if srv == nil {
-		s.sendError("NOT_RUNNING", "node not running")
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
 		return
 	}
 
 	var data proxyAddData
 	if err := json.Unmarshal(raw, &data); err != nil {
-		s.sendError("INVALID_COMMAND", "invalid proxy:add data: "+err.Error())
+		s.sendErrorID(id, "INVALID_COMMAND", "invalid proxy:add data: "+err.Error())
+		return
+	}
+	if s.draining.Load() {
+		s.sendEventID(id, "proxy:error", proxyErrorEventData{ID: data.ID, Code: "DRAINING", Message: "node is draining; not accepting new proxies"})
 		return
 	}
 
@@ -2028,7 +2948,7 @@ func (s *shim) handleProxyAdd(raw json.RawMessage) {
 	}
 
 	fail := func(code, msg string) {
-		s.sendEvent("proxy:error", proxyErrorEventData{ID: data.ID, Code: code, Message: msg})
+		s.sendEventID(id, "proxy:error", proxyErrorEventData{ID: data.ID, Code: code, Message: msg})
 	}
 
 	lc, err := srv.LocalClient()
@@ -2106,13 +3026,13 @@ func (s *shim) handleProxyAdd(raw json.RawMessage) {
 	s.proxyMu.Lock()
 	if _, exists := s.proxies[data.ID]; exists {
 		s.proxyMu.Unlock()
-		s.sendEvent("proxy:error", proxyErrorEventData{ID: data.ID, Code: "PROXY_EXISTS", Message: "proxy with this ID already exists"})
+		s.sendEventID(id, "proxy:error", proxyErrorEventData{ID: data.ID, Code: "PROXY_EXISTS", Message: "proxy with this ID already exists"})
 		return
 	}
 	for _, entry := range s.proxies {
 		if entry != nil && entry.listenPort == data.ListenPort {
 			s.proxyMu.Unlock()
-			s.sendEvent("proxy:error", proxyErrorEventData{ID: data.ID, Code: "PORT_IN_USE", Message: fmt.Sprintf("port %d already used by proxy %s", data.ListenPort, entry.id)})
+			s.sendEventID(id, "proxy:error", proxyErrorEventData{ID: data.ID, Code: "PORT_IN_USE", Message: fmt.Sprintf("port %d already used by proxy %s", data.ListenPort, entry.id)})
 			return
 		}
 	}
@@ -2129,7 +3049,7 @@ func (s *shim) handleProxyAdd(raw json.RawMessage) {
 		s.proxyMu.Lock()
 		delete(s.proxies, data.ID)
 		s.proxyMu.Unlock()
-		s.sendEvent("proxy:error", proxyErrorEventData{ID: data.ID, Code: "PORT_IN_USE", Message: fmt.Sprintf("port %d already used by a dynamic listener", data.ListenPort)})
+		s.sendEventID(id, "proxy:error", proxyErrorEventData{ID: data.ID, Code: "PORT_IN_USE", Message: fmt.Sprintf("port %d already used by a dynamic listener", data.ListenPort)})
 		return
 	}
 	s.dynamicListenerMu.Unlock()
@@ -2147,6 +3067,9 @@ func (s *shim) handleProxyAdd(raw json.RawMessage) {
 	}
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.proxyRequests.Add(1)
+		defer s.proxyRequests.Add(-1)
+
 		// Identity first (§9.2): resolve who is calling from the WireGuard
 		// tunnel, strip anything they claimed in our header namespace, gate,
 		// then inject the verified values for the backend.
@@ -2217,7 +3140,7 @@ func (s *shim) handleProxyAdd(raw json.RawMessage) {
 			s.proxyMu.Lock()
 			delete(s.proxies, data.ID)
 			s.proxyMu.Unlock()
-			s.sendEvent("proxy:error", proxyErrorEventData{ID: data.ID, Code: "LISTEN_ERROR", Message: err.Error()})
+			s.sendEventID(id, "proxy:error", proxyErrorEventData{ID: data.ID, Code: "LISTEN_ERROR", Message: err.Error()})
 			return
 		}
 
@@ -2227,7 +3150,7 @@ func (s *shim) handleProxyAdd(raw json.RawMessage) {
 			s.proxyMu.Lock()
 			delete(s.proxies, data.ID)
 			s.proxyMu.Unlock()
-			s.sendEvent("proxy:error", proxyErrorEventData{ID: data.ID, Code: "NOT_READY", Message: "node not fully started, DNS name not available"})
+			s.sendEventID(id, "proxy:error", proxyErrorEventData{ID: data.ID, Code: "NOT_READY", Message: "node not fully started, DNS name not available"})
 			return
 		}
 
@@ -2256,15 +3179,15 @@ func (s *shim) handleProxyAdd(raw json.RawMessage) {
 			id: data.ID, name: data.Name, listenPort: data.ListenPort,
 			targetHost: data.TargetHost, targetPort: data.TargetPort,
 			targetScheme: data.TargetScheme, targetURL: entryTargetURL, tlsOn: tlsOn,
-			listener: ln, server: httpSrv, cancel: cancel,
+			listener: ln, server: httpSrv, cancel: cancel, spec: raw,
 		}
 		s.proxyMu.Unlock()
 
 		proxyURL := publicURL(tlsOn, s.getDNSName(), data.ListenPort)
-		s.sendEvent("proxy:added", proxyAddedEventData{ID: data.ID, ListenPort: data.ListenPort, URL: proxyURL})
+		s.sendEventID(id, "proxy:added", proxyAddedEventData{ID: data.ID, ListenPort: data.ListenPort, URL: proxyURL})
 
 		if err := httpSrv.Serve(ln); err != nil && err != http.ErrServerClosed {
-			s.sendEvent("proxy:error", proxyErrorEventData{ID: data.ID, Code: "SERVE_ERROR", Message: err.Error()})
+			s.sendEventID(id, "proxy:error", proxyErrorEventData{ID: data.ID, Code: "SERVE_ERROR", Message: err.Error()})
 		}
 	}()
 }
@@ -2355,10 +3278,10 @@ func (s *shim) handleProxyWebSocket(w http.ResponseWriter, r *http.Request, entr
 	clientConn.Close()
 }
 
-func (s *shim) handleProxyRemove(raw json.RawMessage) {
+func (s *shim) handleProxyRemove(id string, raw json.RawMessage) {
 	var data proxyRemoveData
 	if err := json.Unmarshal(raw, &data); err != nil {
-		s.sendError("INVALID_COMMAND", "invalid proxy:remove data: "+err.Error())
+		s.sendErrorID(id, "INVALID_COMMAND", "invalid proxy:remove data: "+err.Error())
 		return
 	}
 
@@ -2366,7 +3289,7 @@ func (s *shim) handleProxyRemove(raw json.RawMessage) {
 	entry, exists := s.proxies[data.ID]
 	if !exists || entry == nil {
 		s.proxyMu.Unlock()
-		s.sendEvent("proxy:error", proxyErrorEventData{ID: data.ID, Code: "NOT_FOUND", Message: "proxy not found"})
+		s.sendEventID(id, "proxy:error", proxyErrorEventData{ID: data.ID, Code: "NOT_FOUND", Message: "proxy not found"})
 		return
 	}
 	delete(s.proxies, data.ID)
@@ -2377,11 +3300,11 @@ func (s *shim) handleProxyRemove(raw json.RawMessage) {
 	go func() {
 		defer s.recoverPanic("handleProxyRemove")
 		entry.shutdown(5 * time.Second)
-		s.sendEvent("proxy:removed", proxyRemovedEventData{ID: data.ID})
+		s.sendEventID(id, "proxy:removed", proxyRemovedEventData{ID: data.ID})
 	}()
 }
 
-func (s *shim) handleProxyList() {
+func (s *shim) handleProxyList(id string) {
 	s.proxyMu.Lock()
 	proxies := make([]proxyInfoData, 0, len(s.proxies))
 	for _, entry := range s.proxies {
@@ -2398,49 +3321,73 @@ func (s *shim) handleProxyList() {
 	}
 	s.proxyMu.Unlock()
 
-	s.sendEvent("proxy:list", proxyListEventData{Proxies: proxies})
+	s.sendEventID(id, "proxy:list", proxyListEventData{Proxies: proxies})
 }
 
 // bridgeToRust connects to Rust's local bridge port, sends the binary header,
-// then does bidirectional io.Copy.
-func (s *shim) bridgeToRust(tsnetConn net.Conn, port uint16, direction byte, requestID, remoteAddr, remoteDNS string) {
+// waits for the core's ack if bridgeAck is on, calls accepted (if non-nil),
+// then does bidirectional io.Copy. A non-nil error means the stream never
+// reached the core (both conns are already closed); handleDial reports it on
+// the dial's bridge:dialResult.
+func (s *shim) bridgeToRust(tsnetConn net.Conn, m bridgeMeta, accepted func()) error {
 	defer s.recoverPanic("bridgeToRust")
+	s.bridgeConns.Add(1)
+	defer s.bridgeConns.Add(-1)
 
 	token, bridgePort := s.bridgeParams()
+	m.connID = s.nextConnID.Add(1)
+	version := s.bridgeHeaderVersion()
+
+	var localConn net.Conn
+	if mux := s.bridgeMux(); mux != nil {
+		// The header travels as the stream's OPEN frame.
+		var hdr bytes.Buffer
+		if err := m.writeHeader(&hdr, token, version); err != nil {
+			bridgeLog.Errorf("header write failed: %v", err)
+			tsnetConn.Close()
+			return fmt.Errorf("header write failed: %v", err)
+		}
+		st, err := mux.open(hdr.Bytes())
+		if err != nil {
+			bridgeLog.Errorf("bridge stream open failed: %v", err)
+			tsnetConn.Close()
+			return fmt.Errorf("bridge stream open failed: %v", err)
+		}
+		localConn = st
+	} else {
+		var err error
+		localConn, err = s.dialCore(bridgePort)
+		if err != nil {
+			bridgeLog.Errorf("bridge connect failed: %v", err)
+			tsnetConn.Close()
+			return fmt.Errorf("bridge connect failed: %v", err)
+		}
 
-	localConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", bridgePort))
-	if err != nil {
-		log.Printf("bridge connect failed: %v", err)
-		tsnetConn.Close()
-		// BUG-8: Report failure if this was an outgoing dial
-		if direction == dirOutgoing && requestID != "" {
-			s.sendEvent("bridge:dialResult", dialResultData{
-				RequestID: requestID,
-				Success:   false,
-				Error:     fmt.Sprintf("bridge connect failed: %v", err),
-			})
+		// Write binary header
+		if err := m.writeHeader(localConn, token, version); err != nil {
+			bridgeLog.Errorf("header write failed: %v", err)
+			localConn.Close()
+			tsnetConn.Close()
+			return fmt.Errorf("header write failed: %v", err)
 		}
-		return
 	}
 
-	// Write binary header
-	if err := writeHeader(localConn, token, direction, port, requestID, remoteAddr, remoteDNS); err != nil {
-		log.Printf("header write failed: %v", err)
-		localConn.Close()
-		tsnetConn.Close()
-		// BUG-8: Report failure if this was an outgoing dial
-		if direction == dirOutgoing && requestID != "" {
-			s.sendEvent("bridge:dialResult", dialResultData{
-				RequestID: requestID,
-				Success:   false,
-				Error:     fmt.Sprintf("header write failed: %v", err),
-			})
+	if s.bridgeAckEnabled() {
+		if err := awaitBridgeAck(localConn); err != nil {
+			bridgeLog.Warnf("bridge to :%d not accepted: %v", m.port, err)
+			localConn.Close()
+			tsnetConn.Close()
+			return err
 		}
-		return
+	}
+	if accepted != nil {
+		accepted()
 	}
 
 	// Bidirectional copy with close-all pattern
-	bridgeCopy(tsnetConn, localConn, s.idleTimeoutOrDefault())
+	bc := s.registerBridge(m, tsnetConn, localConn)
+	s.finishBridge(bc, bridgeCopy(bc.counted(), localConn, s.idleTimeoutOrDefault()))
+	return nil
 }
 
 // writeHeader writes the bridge binary header per RFC 003.
@@ -2510,8 +3457,9 @@ func writeHeader(w io.Writer, token []byte, direction byte, port uint16, request
 }
 
 // bridgeCopy does bidirectional io.Copy with the close-all pattern.
-// When either copy finishes, both connections are closed.
-func bridgeCopy(tsnetConn, localConn net.Conn, idleTimeout time.Duration) {
+// When either copy finishes, both connections are closed. It returns why the
+// copy ended: nil for EOF both ways, else the first direction's error.
+func bridgeCopy(tsnetConn, localConn net.Conn, idleTimeout time.Duration) error {
 	var once sync.Once
 	closeAll := func() {
 		once.Do(func() {
@@ -2537,26 +3485,29 @@ func bridgeCopy(tsnetConn, localConn net.Conn, idleTimeout time.Duration) {
 	// two goroutines + two fds until process exit. On EOF we half-close the
 	// write half of the destination, preserving any in-flight data in the
 	// reverse direction (e.g. a trailing ACK) rather than closing both.
+	var errs [2]error
 	go func() {
 		defer wg.Done()
-		idleCopy(localConn, tsnetConn, idleTimeout)
+		errs[0] = idleCopy(localConn, tsnetConn, idleTimeout)
 		closeWrite(localConn)
 	}()
 
 	go func() {
 		defer wg.Done()
-		idleCopy(tsnetConn, localConn, idleTimeout)
+		errs[1] = idleCopy(tsnetConn, localConn, idleTimeout)
 		closeWrite(tsnetConn)
 	}()
 
 	wg.Wait()
 	// Both directions complete -> close everything
+	return cmp.Or(errs[0], errs[1])
 }
 
 // idleCopy is io.Copy with an idle timeout applied to each direction: if no
 // bytes flow for `timeout`, the read deadline fires and the copy returns, so an
 // idle-but-open bridged/relayed connection can't pin a goroutine + fds forever.
-func idleCopy(dst, src net.Conn, timeout time.Duration) {
+// It returns nil at EOF, else the read or write error that stopped it.
+func idleCopy(dst, src net.Conn, timeout time.Duration) error {
 	buf := make([]byte, 32*1024)
 	for {
 		_ = src.SetReadDeadline(time.Now().Add(timeout))
@@ -2564,11 +3515,14 @@ func idleCopy(dst, src net.Conn, timeout time.Duration) {
 		if n > 0 {
 			_ = dst.SetWriteDeadline(time.Now().Add(timeout))
 			if _, werr := dst.Write(buf[:n]); werr != nil {
-				return
+				return werr
 			}
 		}
+		if rerr == io.EOF {
+			return nil
+		}
 		if rerr != nil {
-			return
+			return rerr
 		}
 	}
 }
@@ -2618,10 +3572,14 @@ func (s *shim) whoisIdentity(lc *tailscale.LocalClient, remoteAddr string) peerI
 	defer cancel()
 	whois, err := lc.WhoIs(ctx, remoteAddr)
 	if err != nil {
-		log.Printf("whoisIdentity: WhoIs(%s) failed: %v", remoteAddr, err)
+		bridgeLog.Warnf("whoisIdentity: WhoIs(%s) failed: %v", remoteAddr, err)
 		return peerIdentityData{}
 	}
+	return identityFromWhoIs(whois)
+}
 
+// identityFromWhoIs extracts the identity fields from a WhoIs answer.
+func identityFromWhoIs(whois *apitype.WhoIsResponse) peerIdentityData {
 	identity := peerIdentityData{}
 	if whois.Node != nil {
 		identity.DNSName = strings.TrimSuffix(whois.Node.Name, ".")
@@ -2635,17 +3593,6 @@ func (s *shim) whoisIdentity(lc *tailscale.LocalClient, remoteAddr string) peerI
 	return identity
 }
 
-// resolvePeerIdentity maps a remote address to a PeerIdentity JSON string via WhoIs.
-// The JSON is placed into the bridge header's remoteDNS field so Rust can
-// extract rich identity info about the connecting peer.
-func (s *shim) resolvePeerIdentity(lc *tailscale.LocalClient, remoteAddr string) string {
-	identity := s.whoisIdentity(lc, remoteAddr)
-	if identity == (peerIdentityData{}) {
-		return ""
-	}
-	return marshalPeerIdentity(identity)
-}
-
 // proxyWhois is whoisIdentity behind a short TTL cache, for the proxy request
 // path: keep-alive connections re-present the same RemoteAddr per request,
 // and a WhoIs RPC per request would serialize handlers on a 3s budget.
@@ -2877,14 +3824,14 @@ func marshalPeerIdentity(identity peerIdentityData) string {
 		drop(&identity)
 		data, err := json.Marshal(identity)
 		if err != nil {
-			log.Printf("marshalPeerIdentity: marshal failed: %v", err)
+			bridgeLog.Errorf("marshalPeerIdentity: marshal failed: %v", err)
 			return ""
 		}
 		if len(data) <= maxRemoteDNSNameLen {
 			return string(data)
 		}
 	}
-	log.Printf("marshalPeerIdentity: identity exceeds %d bytes even after dropping optional fields; omitting", maxRemoteDNSNameLen)
+	bridgeLog.Warnf("marshalPeerIdentity: identity exceeds %d bytes even after dropping optional fields; omitting", maxRemoteDNSNameLen)
 	return ""
 }
 
@@ -2895,18 +3842,18 @@ func marshalPeerIdentity(identity peerIdentityData) string {
 // so this is a no-op once a cert exists. Deduped per domain because every TLS
 // listener on the node shares one cert (RFC 023 §7, D13).
 //
-// Failures are logged only, never sent as a tsnet:error event: ErrorEventData
-// carries no correlation id (just code+message), and the Rust request loops that
-// await listen/proxy confirmations treat ANY sidecar Error as their own in-flight
-// failure (provider.rs listen_tcp / proxy_add), so an unsolicited warning racing
-// a concurrent listen would turn a successful listen into a spurious error.
+// Failures are logged only, never sent as a tsnet:error event: a warm answers
+// no command, so the error would carry no correlation id, and Rust request
+// loops that predate command ids treat ANY uncorrelated sidecar Error as their
+// own in-flight failure (provider.rs listen_tcp / proxy_add) — an unsolicited
+// warning racing a concurrent listen would turn a success into an error.
 func (s *shim) prewarmCert(ctx context.Context, srv *tsnet.Server) {
 	defer s.recoverPanic("prewarmCert")
 
 	// CertDomains returns nil until the node is Running; a later listen retries.
 	domains := srv.CertDomains()
 	if len(domains) == 0 {
-		log.Printf("cert pre-warm skipped: no cert domains yet (is HTTPS enabled for your tailnet?)")
+		proxyLog.Warnf("cert pre-warm skipped: no cert domains yet (is HTTPS enabled for your tailnet?)")
 		return
 	}
 	domain := domains[0]
@@ -2928,7 +3875,7 @@ func (s *shim) prewarmCert(ctx context.Context, srv *tsnet.Server) {
 
 	lc, err := srv.LocalClient()
 	if err != nil {
-		log.Printf("cert pre-warm for %s skipped: %v", domain, err)
+		proxyLog.Warnf("cert pre-warm for %s skipped: %v", domain, err)
 		return
 	}
 
@@ -2937,77 +3884,415 @@ func (s *shim) prewarmCert(ctx context.Context, srv *tsnet.Server) {
 	warmCtx, cancel := context.WithTimeout(ctx, 120*time.Second)
 	defer cancel()
 	if _, _, err := lc.CertPair(warmCtx, domain); err != nil {
-		log.Printf("cert pre-warm for %s failed: %v (is HTTPS enabled for your tailnet?)", domain, err)
+		proxyLog.Warnf("cert pre-warm for %s failed: %v (is HTTPS enabled for your tailnet?)", domain, err)
 		return
 	}
-	debugf("cert pre-warm for %s complete", domain)
+	proxyLog.Debugf("cert pre-warm for %s complete", domain)
 }
 
-// monitorState polls Tailscale status every 60 seconds and emits events for
-// state changes, upcoming key expiry, and health warnings.
-func (s *shim) monitorState(ctx context.Context, lc *tailscale.LocalClient) {
-	ticker := time.NewTicker(60 * time.Second)
-	defer ticker.Stop()
+// ── Backend state machine ─────────────────────────────────────────────────
+//
+// watchState follows the backend over the IPN bus for the life of the node.
+// It replaces the old 500ms startup poll and 60s monitor poll: every
+// backend-state transition (NeedsLogin → Starting → Running → Stopped …) is
+// reported as tsnet:stateChange the moment the bus carries it, the first
+// Running completes tsnet:start, and key-expiry and health warnings come
+// from the same stream.
+
+// stateWatchMask asks for the current state, prefs, health and status up
+// front so a (re)subscribe starts from a full picture.
+const stateWatchMask = ipn.NotifyInitialState | ipn.NotifyInitialPrefs | ipn.NotifyInitialHealthState | ipn.NotifyInitialStatus
+
+// keyExpiryWarning is how long before node-key expiry tsnet:keyExpiring fires.
+const keyExpiryWarning = 24 * time.Hour
+
+// announceRetryMin and announceRetryMax bound the backoff between retries of
+// the status fetch that completes tsnet:start, when it fails once the
+// backend is Running.
+const (
+	announceRetryMin = time.Second
+	announceRetryMax = 30 * time.Second
+)
 
-	lastState := "Running"
+// ipnBus is a subscription to IPN notifications (*tailscale.IPNBusWatcher).
+type ipnBus interface {
+	Next() (ipn.Notify, error)
+	Close() error
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
+// stateSource is the part of the LocalClient the state machine reads; tests
+// substitute a fake bus.
+type stateSource interface {
+	watch(ctx context.Context) (ipnBus, error)
+	status(ctx context.Context) (*ipnstate.Status, error)
+}
+
+type localStateSource struct{ lc *tailscale.LocalClient }
+
+func (l localStateSource) watch(ctx context.Context) (ipnBus, error) {
+	w, err := l.lc.WatchIPNBus(ctx, stateWatchMask)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (l localStateSource) status(ctx context.Context) (*ipnstate.Status, error) {
+	return l.lc.StatusWithoutPeers(ctx)
+}
+
+// backendState is what watchState remembers between notifications.
+type backendState struct {
+	state     string
+	started   bool      // tsnet:started sent
+	authURL   string    // last AuthURL reported during startup
+	keyExpiry time.Time // zero when the key doesn't expire
+	keyWarned time.Time // expiry tsnet:keyExpiring last fired for
+	health    string    // joined warnings last reported
+	prefs     *prefsData
+}
+
+// watchState consumes the IPN bus until ctx ends, resubscribing with backoff
+// if the watcher fails. id correlates the events that belong to tsnet:start
+// (everything up to tsnet:started); later ones are uncorrelated.
+func (s *shim) watchState(ctx context.Context, id, hostname string, src stateSource) {
+	st := &backendState{}
+	var expiry, announce *time.Timer
+	defer func() {
+		if expiry != nil {
+			expiry.Stop()
+		}
+		if announce != nil {
+			announce.Stop()
+		}
+	}()
+	// A failed announce is retried on a timer rather than waiting for some
+	// other notify to come along.
+	announceDelay := announceRetryMin
+	retryAnnounce := func() {
+		if announce == nil && !st.started && st.state == ipn.Running.String() {
+			announce = time.NewTimer(announceDelay)
+			announceDelay = min(2*announceDelay, announceRetryMax)
 		}
+	}
 
-		status, err := lc.StatusWithoutPeers(ctx)
+	backoff := time.Second
+	failures := 0
+	for ctx.Err() == nil {
+		bus, err := src.watch(ctx)
 		if err != nil {
 			if ctx.Err() != nil {
 				return
 			}
-			log.Printf("monitorState: status check failed: %v", err)
+			sidecarLog.Warnf("watchState: WatchIPNBus failed: %v", err)
+			// A backend that won't even take a subscription is gone; hand
+			// the node to the supervisor.
+			if failures++; st.started && failures >= recoverAfterWatchFailures {
+				go s.recoverNode(ctx, fmt.Errorf("IPN bus unavailable: %v", err))
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
 			continue
 		}
+		backoff = time.Second
+		failures = 0
 
-		// Emit tsnet:stateChange if backend state changed
-		if status.BackendState != lastState {
-			s.sendEvent("tsnet:stateChange", stateChangeData{
-				State: status.BackendState,
-			})
-			lastState = status.BackendState
-		}
+		// Pump the blocking Next() into channels so the select below can
+		// also service the key-expiry timer and cancellation.
+		notes := make(chan ipn.Notify)
+		errc := make(chan error, 1)
+		go func() {
+			for {
+				n, err := bus.Next()
+				if err != nil {
+					errc <- err
+					return
+				}
+				select {
+				case notes <- n:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
 
-		// Emit tsnet:keyExpiring if our own key expires within 24 hours
-		if status.Self != nil && status.Self.KeyExpiry != nil {
-			expiresAt := *status.Self.KeyExpiry
-			remaining := time.Until(expiresAt)
-			if remaining > 0 && remaining < 24*time.Hour {
-				s.sendEvent("tsnet:keyExpiring", keyExpiringData{
-					ExpiresAt: expiresAt.UTC().Format(time.RFC3339),
-					ExpiresIn: int64(remaining.Seconds()),
-				})
+	inner:
+		for {
+			var expiryC, announceC <-chan time.Time
+			if expiry != nil {
+				expiryC = expiry.C
+			}
+			if announce != nil {
+				announceC = announce.C
+			}
+			select {
+			case <-ctx.Done():
+				bus.Close()
+				return
+			case n := <-notes:
+				if s.applyNotify(ctx, id, hostname, src, st, n) {
+					if expiry != nil {
+						expiry.Stop()
+						expiry = nil
+					}
+					if wait := s.checkKeyExpiry(st); wait > 0 {
+						expiry = time.NewTimer(wait)
+					}
+				}
+				retryAnnounce()
+			case <-expiryC:
+				expiry = nil
+				s.checkKeyExpiry(st)
+			case <-announceC:
+				announce = nil
+				if !st.started && st.state == ipn.Running.String() {
+					st.started = s.announceStarted(ctx, id, hostname, src)
+				}
+				retryAnnounce()
+			case err := <-errc:
+				bus.Close()
+				if ctx.Err() != nil {
+					return
+				}
+				sidecarLog.Warnf("watchState: WatchIPNBus error: %v", err)
+				break inner // resubscribe
 			}
 		}
+	}
+}
 
-		// Emit tsnet:healthWarning if there are health issues
-		if len(status.Health) > 0 {
-			s.sendEvent("tsnet:healthWarning", healthWarningData{
-				Warnings: status.Health,
-			})
+// applyNotify folds one notification into st, emitting whatever it changes.
+// It reports whether the node-key expiry changed.
+func (s *shim) applyNotify(ctx context.Context, id, hostname string, src stateSource, st *backendState, n ipn.Notify) (expiryChanged bool) {
+	evID := id
+	if st.started {
+		evID = ""
+	}
+
+	// ErrMessage is for the user: a control-side problem (an expired key, a
+	// rejected login) that a restart wouldn't fix. Only a backend that stops
+	// answering on the bus is handed to the supervisor.
+	if n.ErrMessage != nil {
+		tsnetLog.Warnf("backend error: %s", *n.ErrMessage)
+		s.sendStatus("", "error", hostname, s.getDNSName(), "", *n.ErrMessage)
+	}
+
+	if n.State != nil && n.State.String() != st.state {
+		prev := st.state
+		st.state = n.State.String()
+		s.sendEventID(evID, "tsnet:stateChange", stateChangeData{State: st.state, Previous: prev})
+		// G10: needsApproval only on entering the state.
+		if *n.State == ipn.NeedsMachineAuth {
+			s.sendEventID(evID, "tsnet:needsApproval", nil)
 		}
 	}
+
+	// After startup, tsnet:login/tsnet:reauth report their own AuthURLs.
+	if !st.started && n.BrowseToURL != nil && *n.BrowseToURL != "" && *n.BrowseToURL != st.authURL {
+		st.authURL = *n.BrowseToURL
+		s.sendEventID(id, "tsnet:authRequired", authRequiredData{AuthURL: st.authURL})
+	}
+
+	if n.Health != nil {
+		warnings := make([]string, 0, len(n.Health.Warnings))
+		for _, w := range n.Health.Warnings {
+			warnings = append(warnings, w.Text)
+		}
+		sort.Strings(warnings)
+		if joined := strings.Join(warnings, "\n"); joined != st.health {
+			st.health = joined
+			s.sendEvent("tsnet:healthWarning", healthWarningData{Warnings: warnings})
+		}
+	}
+
+	// The first prefs seen are the baseline; tsnet:prefsChanged reports
+	// edits from here on, whoever made them.
+	if n.Prefs != nil && n.Prefs.Valid() {
+		p := prefsDataFrom(n.Prefs.AsStruct())
+		if st.prefs != nil && !reflect.DeepEqual(p, *st.prefs) {
+			s.sendEvent("tsnet:prefsChanged", p)
+			// statusData.exitNode follows an exit node change however it
+			// came: tsnet:editPrefs, or "auto" settling on a node.
+			if st.started && p.ExitNodeID != st.prefs.ExitNodeID {
+				s.reannounceRunning(ctx, src)
+			}
+		}
+		st.prefs = &p
+	}
+
+	// A rename (tsnet:setHostname, or an admin in the console) arrives as a
+	// SelfChange once control applies it.
+	if st.started && n.SelfChange != nil && n.SelfChange.Name != "" {
+		s.refreshDNSName("", strings.TrimSuffix(n.SelfChange.Name, "."))
+	}
+
+	var expiry time.Time
+	switch {
+	case n.SelfChange != nil:
+		expiry = n.SelfChange.KeyExpiry
+	case n.InitialStatus != nil && n.InitialStatus.Self != nil && n.InitialStatus.Self.KeyExpiry != nil:
+		expiry = *n.InitialStatus.Self.KeyExpiry
+	default:
+		expiry = st.keyExpiry
+	}
+	if !expiry.Equal(st.keyExpiry) {
+		st.keyExpiry = expiry
+		expiryChanged = true
+	}
+
+	if !st.started && st.state == ipn.Running.String() {
+		st.started = s.announceStarted(ctx, id, hostname, src)
+	}
+	return expiryChanged
+}
+
+// announceStarted completes tsnet:start once the backend first reaches
+// Running. The bus doesn't carry addresses, so it reads them from status.
+func (s *shim) announceStarted(ctx context.Context, id, hostname string, src stateSource) bool {
+	status, err := src.status(ctx)
+	if err != nil || status.Self == nil {
+		sidecarLog.Warnf("watchState: status after Running failed: %v", err)
+		return false
+	}
+	st := runningStatus(hostname, status)
+	s.setDNSName(st.DNSName)
+
+	s.sendEventID(id, "tsnet:status", st)
+	s.sendEventID(id, "tsnet:started", st)
+	if restore := s.serveConfigPending.Swap(false); restore || s.queued() {
+		go s.finishStart(ctx, id, restore)
+	}
+	return true
+}
+
+// reannounceRunning re-emits the running status, uncorrelated, after a
+// change the core didn't ask for.
+func (s *shim) reannounceRunning(ctx context.Context, src stateSource) {
+	status, err := src.status(ctx)
+	if err != nil || status.Self == nil {
+		sidecarLog.Warnf("watchState: status for re-announce failed: %v", err)
+		return
+	}
+	s.sendEvent("tsnet:status", runningStatus(status.Self.HostName, status))
+}
+
+// runningStatus builds the "running" statusData from a backend status.
+// status.Self must be non-nil.
+func runningStatus(hostname string, status *ipnstate.Status) statusData {
+	st := statusData{
+		State:           "running",
+		Hostname:        hostname,
+		DNSName:         strings.TrimSuffix(status.Self.DNSName, "."),
+		NodeID:          string(status.Self.ID),
+		ProtocolVersion: sidecarProtocolVersion,
+	}
+	if len(status.TailscaleIPs) > 0 {
+		st.TailscaleIP = status.TailscaleIPs[0].String()
+	}
+	if status.ExitNodeStatus != nil {
+		st.ExitNode = string(status.ExitNodeStatus.ID)
+	}
+	return st
+}
+
+// checkKeyExpiry emits tsnet:keyExpiring once per expiry when the node key
+// is inside the warning window, and otherwise returns how long until it will
+// be (0 when there is nothing to wait for).
+func (s *shim) checkKeyExpiry(st *backendState) time.Duration {
+	if st.keyExpiry.IsZero() || st.keyExpiry.Equal(st.keyWarned) {
+		return 0
+	}
+	remaining := time.Until(st.keyExpiry)
+	if remaining <= 0 {
+		return 0
+	}
+	if remaining > keyExpiryWarning {
+		return remaining - keyExpiryWarning
+	}
+	st.keyWarned = st.keyExpiry
+	s.sendEvent("tsnet:keyExpiring", keyExpiringData{
+		ExpiresAt: st.keyExpiry.UTC().Format(time.RFC3339),
+		ExpiresIn: int64(remaining.Seconds()),
+	})
+	return 0
 }
 
-// sendEvent writes a JSON event to stdout.
+// sendEvent writes an unsolicited (uncorrelated) JSON event to stdout.
 func (s *shim) sendEvent(eventType string, data interface{}) {
+	s.sendEventID("", eventType, data)
+}
+
+// sendEventID writes a JSON event to stdout, echoing the originating command's
+// correlation id (omitted from the wire when empty).
+//
+// With a control socket, a reply to a socket client's command goes to that
+// client only; uncorrelated events are broadcast to every attached client as
+// well as stdout. A state event (see stateEvents) from a client's command is
+// also mirrored, uncorrelated, to stdout and the other clients.
+func (s *shim) sendEventID(id, eventType string, data interface{}) {
+	if n, orig, ok := untagAddID(id); ok {
+		s.adds.report(n, eventType, data)
+		id = orig
+	}
+	ev := event{Event: eventType, ID: id, Node: s.node, Data: data}
+	if s.control != nil {
+		if n, orig, ok := untagControlID(id); ok {
+			ev.ID = orig
+			s.control.sendTo(n, ev)
+			if !stateEvents[eventType] {
+				return
+			}
+			ev.ID = ""
+			s.control.broadcast(ev, n)
+		} else if id == "" {
+			s.control.broadcast(ev, 0)
+		}
+	}
+
+	if s.events != nil {
+		s.events.push(ev, false, nil)
+		return
+	}
+	s.writeEvent(ev)
+}
+
+// writeEvent encodes one event to stdout synchronously.
+func (s *sidecar) writeEvent(ev event) {
 	s.writeMu.Lock()
 	defer s.writeMu.Unlock()
-	if err := s.writer.Encode(event{Event: eventType, Data: data}); err != nil {
-		log.Printf("sendEvent(%s) encode failed: %v", eventType, err)
+	s.encodeLocked(ev)
+}
+
+// encodeLocked records a live event for replay and writes it to stdout. The
+// event queue has already stamped its seq; one written without the queue is
+// stamped here. Replayed copies keep their original seq and are not recorded
+// again. Caller holds writeMu.
+func (s *sidecar) encodeLocked(ev event) {
+	if !ev.Replay {
+		if ev.Seq == 0 {
+			ev.Seq = s.seq + 1
+		}
+		s.seq = ev.Seq
+		if s.ring == nil {
+			s.ring = newEventRing(eventRingCap)
+		}
+		s.ring.add(ev)
+	}
+	if err := s.writer.Encode(ev); err != nil {
+		sidecarLog.Errorf("sendEvent(%s) encode failed: %v", ev.Event, err)
 	}
 }
 
 // sendStatus is a convenience for sending tsnet:status events.
-func (s *shim) sendStatus(state, hostname, dnsName, tailscaleIP, errMsg string) {
-	s.sendEvent("tsnet:status", statusData{
+func (s *shim) sendStatus(id, state, hostname, dnsName, tailscaleIP, errMsg string) {
+	s.sendEventID(id, "tsnet:status", statusData{
 		State:           state,
 		Hostname:        hostname,
 		DNSName:         dnsName,
@@ -3017,7 +4302,3952 @@ func (s *shim) sendStatus(state, hostname, dnsName, tailscaleIP, errMsg string)
 	})
 }
 
-// sendError sends a tsnet:error event.
+// sendError sends an uncorrelated tsnet:error event, for failures that cannot
+// be tied to a command (oversize or unparseable input).
 func (s *shim) sendError(code, message string) {
-	s.sendEvent("tsnet:error", errorData{Code: code, Message: message})
+	s.sendErrorID("", code, message)
+}
+
+// sendErrorID sends a tsnet:error event carrying the command's correlation id.
+func (s *shim) sendErrorID(id, code, message string) {
+	s.sendEventID(id, "tsnet:error", errorData{Code: code, Message: message})
+}
+
+// ── Control socket: multi-client command channel ─────────────────────────
+//
+// When TRUFFLE_CONTROL_SOCKET names a path, the sidecar also serves the
+// command/event protocol on that Unix socket, so a CLI or debugging tool can
+// attach to the node the app started. Each client authenticates with the
+// session token from tsnet:start and gets its own event stream: replies to
+// its own commands plus every uncorrelated (broadcast) event.
+
+const (
+	// controlSocketEnv names the Unix socket path for the control channel.
+	controlSocketEnv = "TRUFFLE_CONTROL_SOCKET"
+	// maxControlClients caps concurrently attached socket clients.
+	maxControlClients = 8
+	// controlAuthTimeout bounds how long a new client may take to send its
+	// sidecar:auth line before it is dropped.
+	controlAuthTimeout = 10 * time.Second
+	// controlWriteTimeout drops a client that stops reading instead of
+	// stalling whichever goroutine is emitting to it.
+	controlWriteTimeout = 5 * time.Second
+)
+
+// controlAuthData is the payload for the sidecar:auth command, which must be
+// the first line a control-socket client sends.
+type controlAuthData struct {
+	SessionToken string `json:"sessionToken"`
+}
+
+// tagControlID prefixes a socket client's command id with the client number
+// so the events it produces route back to that client only. A NUL-led id is
+// never chosen by the core, so tagged ids cannot collide with stdin ids.
+func tagControlID(n uint64, id string) string {
+	return "\x00" + strconv.FormatUint(n, 10) + "\x00" + id
+}
+
+// untagControlID reverses tagControlID; ok is false for an untagged id.
+func untagControlID(id string) (n uint64, orig string, ok bool) {
+	if !strings.HasPrefix(id, "\x00") {
+		return 0, "", false
+	}
+	rest := id[1:]
+	i := strings.IndexByte(rest, 0)
+	if i < 0 {
+		return 0, "", false
+	}
+	n, err := strconv.ParseUint(rest[:i], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return n, rest[i+1:], true
+}
+
+// stateEvents change the node state the core tracks: lifecycle, serving and
+// peers. When a socket client's command produces one, the core still has to
+// see it, and must not lose it if that client detaches.
+var stateEvents = map[string]bool{
+	"tsnet:started":          true,
+	"tsnet:stopped":          true,
+	"tsnet:status":           true,
+	"tsnet:stateChange":      true,
+	"tsnet:authRequired":     true,
+	"tsnet:authResult":       true,
+	"tsnet:listening":        true,
+	"tsnet:unlistened":       true,
+	"tsnet:listeningPacket":  true,
+	"tsnet:unlistenedPacket": true,
+	"proxy:added":            true,
+	"proxy:removed":          true,
+	"proxy:error":            true,
+	"config:applied":         true,
+	"tsnet:peerChanged":      true,
+	"tsnet:watchPeersError":  true,
+	"tsnet:prefsChanged":     true,
+	"tsnet:hostnameSet":      true,
+	"tsnet:tagsSet":          true,
+	"tsnet:exitNodeSet":      true,
+	"tsnet:draining":         true,
+	"tsnet:drained":          true,
+	"tsnet:recovering":       true,
+	"tsnet:recovered":        true,
+	"bridge:closed":          true,
+}
+
+// checkSessionToken reports whether hexToken matches the token armed by
+// tsnet:start on any node. Nothing authenticates before the first start.
+func (sc *sidecar) checkSessionToken(hexToken string) bool {
+	got, err := hex.DecodeString(hexToken)
+	if err != nil {
+		return false
+	}
+	ok := false
+	for _, n := range sc.allNodes() {
+		token, _ := n.bridgeParams()
+		// No early exit: the time taken must not reveal which node matched.
+		if len(token) > 0 && subtle.ConstantTimeCompare(got, token) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// controlClient is one authenticated control-socket connection.
+type controlClient struct {
+	n    uint64
+	conn net.Conn
+	mu   sync.Mutex   // serializes writes to conn and enc swaps
+	enc  eventEncoder // conn in the client's negotiated framing
+
+	cborIn atomic.Bool // client switched its commands to CBOR framing
+}
+
+func (c *controlClient) send(ev event) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+	return c.enc.Encode(ev)
+}
+
+// controlServer accepts and tracks control-socket clients.
+type controlServer struct {
+	s    *shim
+	ln   net.Listener
+	path string
+
+	mu      sync.Mutex
+	clients map[uint64]*controlClient
+	nextN   uint64
+}
+
+// startControlServer binds the control socket owner-only (created under
+// umask 077, then 0600) and starts accepting clients.
+func startControlServer(s *shim, path string) (*controlServer, error) {
+	// A crashed sidecar leaves its socket file behind and the bind would fail.
+	// Only ever remove a socket — never a regular file at a misconfigured path.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := listenUnixPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("chmod control socket: %w", err)
+	}
+	cs := &controlServer{s: s, ln: ln, path: path, clients: make(map[uint64]*controlClient)}
+	go cs.acceptLoop()
+	return cs, nil
+}
+
+// close stops accepting, disconnects every client, and removes the socket.
+func (cs *controlServer) close() {
+	cs.ln.Close()
+	cs.mu.Lock()
+	for n, c := range cs.clients {
+		c.conn.Close()
+		delete(cs.clients, n)
+	}
+	cs.mu.Unlock()
+	os.Remove(cs.path)
+}
+
+func (cs *controlServer) acceptLoop() {
+	defer cs.s.recoverPanic("controlServer.acceptLoop")
+	for {
+		conn, err := cs.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			sidecarLog.Errorf("control socket accept error: %v", err)
+			time.Sleep(100 * time.Millisecond) // don't spin on a persistent error
+			continue
+		}
+		go cs.serveClient(conn)
+	}
+}
+
+// register admits an authenticated client, enforcing maxControlClients.
+func (cs *controlServer) register(c *controlClient) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.clients) >= maxControlClients {
+		return false
+	}
+	cs.nextN++
+	c.n = cs.nextN
+	cs.clients[c.n] = c
+	return true
+}
+
+func (cs *controlServer) unregister(n uint64) {
+	cs.mu.Lock()
+	delete(cs.clients, n)
+	cs.mu.Unlock()
+}
+
+// client returns attached client n, or nil.
+func (cs *controlServer) client(n uint64) *controlClient {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.clients[n]
+}
+
+// sendTo delivers a reply to one client. A client that has gone away just
+// loses the event; a failed write closes it so its read loop unregisters it.
+func (cs *controlServer) sendTo(n uint64, ev event) {
+	c := cs.client(n)
+	if c == nil {
+		return
+	}
+	if err := c.send(ev); err != nil {
+		sidecarLog.Debugf("control client %d write failed, dropping: %v", n, err)
+		c.conn.Close()
+	}
+}
+
+// broadcast delivers an uncorrelated event to every attached client but
+// except (0 for none).
+func (cs *controlServer) broadcast(ev event, except uint64) {
+	cs.mu.Lock()
+	clients := make([]*controlClient, 0, len(cs.clients))
+	for n, c := range cs.clients {
+		if n != except {
+			clients = append(clients, c)
+		}
+	}
+	cs.mu.Unlock()
+	for _, c := range clients {
+		if err := c.send(ev); err != nil {
+			sidecarLog.Debugf("control client %d write failed, dropping: %v", c.n, err)
+			c.conn.Close()
+		}
+	}
+}
+
+// serveClient authenticates one connection, then feeds its commands through
+// the shared dispatch with ids tagged for reply routing.
+func (cs *controlServer) serveClient(conn net.Conn) {
+	defer cs.s.recoverPanic("controlServer.serveClient")
+	defer conn.Close()
+
+	c := &controlClient{conn: conn, enc: json.NewEncoder(conn)}
+	reader := bufio.NewReader(conn)
+	reject := func(id, code, msg string) {
+		_ = c.send(event{Event: "tsnet:error", ID: id, Data: errorData{Code: code, Message: msg}})
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(controlAuthTimeout))
+	line, tooLong, err := readCommandLine(reader, maxCommandBytes)
+	if err != nil {
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	var auth command
+	if tooLong || json.Unmarshal([]byte(line), &auth) != nil || auth.Command != "sidecar:auth" {
+		reject("", "AUTH_REQUIRED", "first command must be sidecar:auth")
+		return
+	}
+	var ad controlAuthData
+	if err := json.Unmarshal(auth.Data, &ad); err != nil || !cs.s.checkSessionToken(ad.SessionToken) {
+		reject(auth.ID, "AUTH_FAILED", "invalid session token (or node not started)")
+		return
+	}
+	if !cs.register(c) {
+		reject(auth.ID, "TOO_MANY_CLIENTS", fmt.Sprintf("control socket already has %d clients", maxControlClients))
+		return
+	}
+	defer cs.unregister(c.n)
+	_ = c.send(event{Event: "sidecar:authenticated", ID: auth.ID})
+	sidecarLog.Debugf("control client %d attached", c.n)
+
+	for {
+		cmd, problem, err := readCommand(reader, c.cborIn.Load())
+		if err != nil {
+			sidecarLog.Debugf("control client %d detached: %v", c.n, err)
+			return
+		}
+		if problem != nil {
+			reject("", problem.Code, problem.Message)
+			continue
+		}
+		cmd.ID = tagControlID(c.n, cmd.ID)
+		cs.s.dispatch(cmd)
+	}
+}
+
+// ── Command/event framing ─────────────────────────────────────────────────
+//
+// JSON lines is the default framing. sidecar:hello {framing:"cbor"} switches a
+// channel to length-prefixed CBOR: each frame is a big-endian u32 byte count
+// followed by one CBOR-encoded command or event. CBOR reuses the command/event
+// structs and their json tags (fxamacker/cbor falls back to them), so the two
+// encodings cannot drift apart.
+
+// eventEncoder writes one event frame in a channel's framing. *json.Encoder
+// (JSON lines) and cborFrameEncoder both satisfy it.
+type eventEncoder interface {
+	Encode(v interface{}) error
+}
+
+// newEventEncoder wraps w in the given framing.
+func newEventEncoder(w io.Writer, cborFraming bool) eventEncoder {
+	if cborFraming {
+		return cborFrameEncoder{w: w}
+	}
+	return json.NewEncoder(w)
+}
+
+// cborFrameEncoder writes length-prefixed CBOR frames.
+type cborFrameEncoder struct {
+	w io.Writer
+}
+
+func (e cborFrameEncoder) Encode(v interface{}) error {
+	payload, err := cbor.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// One Write per frame, so a frame is never interleaved with another
+	// writer's bytes even on an unbuffered fd.
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+	_, err = e.w.Write(frame)
+	return err
+}
+
+// readCommandFrame reads one length-prefixed CBOR frame, bounding memory like
+// readCommandLine: an over-size frame is drained (keeping the stream in sync)
+// and reported as tooLong.
+func readCommandFrame(r *bufio.Reader, max int) (payload []byte, tooLong bool, err error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, false, err
+	}
+	n := int64(binary.BigEndian.Uint32(hdr[:]))
+	if n > int64(max) {
+		if _, err := io.CopyN(io.Discard, r, n); err != nil {
+			return nil, false, noEOF(err)
+		}
+		return nil, true, nil
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, false, noEOF(err)
+	}
+	return payload, false, nil
+}
+
+// noEOF turns a clean EOF inside a frame into ErrUnexpectedEOF, so a parent
+// that dies mid-frame is logged as a read error rather than a clean close.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// cborCommand is the CBOR wire shape of command: identical keys, but data is
+// a native CBOR value rather than embedded JSON text.
+type cborCommand struct {
+	ID      string      `cbor:"id,omitempty"`
+	Node    string      `cbor:"node,omitempty"`
+	Command string      `cbor:"command"`
+	Data    interface{} `cbor:"data,omitempty"`
+}
+
+// cborDecMode decodes untyped CBOR maps with string keys, so command data can
+// be transcoded to the JSON every handler already parses.
+var cborDecMode, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+
+// UnmarshalCBOR decodes a CBOR command, transcoding data to JSON so handlers
+// stay framing-agnostic.
+func (c *command) UnmarshalCBOR(b []byte) error {
+	var w cborCommand
+	if err := cborDecMode.Unmarshal(b, &w); err != nil {
+		return err
+	}
+	c.ID, c.Node, c.Command, c.Data = w.ID, w.Node, w.Command, nil
+	if w.Data != nil {
+		data, err := json.Marshal(w.Data)
+		if err != nil {
+			return fmt.Errorf("command data: %w", err)
+		}
+		c.Data = data
+	}
+	return nil
+}
+
+// MarshalCBOR encodes a command with its JSON data as a native CBOR value.
+func (c command) MarshalCBOR() ([]byte, error) {
+	w := cborCommand{ID: c.ID, Node: c.Node, Command: c.Command}
+	if len(c.Data) > 0 {
+		if err := json.Unmarshal(c.Data, &w.Data); err != nil {
+			return nil, fmt.Errorf("command data: %w", err)
+		}
+	}
+	return cbor.Marshal(w)
+}
+
+// channelFraming reports the framing of the channel a command id arrived on.
+func (s *sidecar) channelFraming(id string) string {
+	in := s.stdinCBOR.Load()
+	if n, _, ok := untagControlID(id); ok && s.control != nil {
+		c := s.control.client(n)
+		in = c != nil && c.cborIn.Load()
+	}
+	if in {
+		return framingCBOR
+	}
+	return framingJSON
+}
+
+// switchFraming writes the hello reply in the channel's current framing and
+// switches the channel in the same critical section, so no other event can
+// slip out between the reply and the switch in the wrong framing. Commands
+// are switched too: the reader picks the new framing up for its next read,
+// since dispatch runs synchronously in the read loop.
+func (s *sidecar) switchFraming(id string, toCBOR bool, reply helloData) error {
+	if n, orig, ok := untagControlID(id); ok && s.control != nil {
+		c := s.control.client(n)
+		if c == nil {
+			return nil // client already gone
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		_ = c.conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+		if err := c.enc.Encode(event{Event: "sidecar:hello", ID: orig, Data: reply}); err != nil {
+			c.conn.Close()
+			return nil
+		}
+		c.enc = newEventEncoder(c.conn, toCBOR)
+		c.cborIn.Store(toCBOR)
+		return nil
+	}
+
+	if s.stdout == nil {
+		return fmt.Errorf("this channel cannot switch framing")
+	}
+	hello := event{Event: "sidecar:hello", ID: id, Data: reply}
+	if s.events != nil {
+		// The writer swaps encoders right after writing the reply, so events
+		// queued ahead of it keep the old framing and later ones get the new.
+		s.stdinCBOR.Store(toCBOR)
+		s.events.push(hello, true, func() { s.writer = newEventEncoder(s.stdout, toCBOR) })
+		return nil
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.encodeLocked(hello)
+	s.writer = newEventEncoder(s.stdout, toCBOR)
+	s.stdinCBOR.Store(toCBOR)
+	return nil
+}
+
+// ── Event writer: bounded queue with coalescing ───────────────────────────
+//
+// sendEvent used to encode to stdout under writeMu, so a parent that stopped
+// reading stalled every emitting goroutine (dial results, proxy errors, peer
+// watchers). Emitters now enqueue without blocking; one writer goroutine
+// drains in FIFO order. High-churn state events are coalesced while queued
+// (latest peerChanged per peer, latest healthWarning), and when the queue is
+// full new events of those kinds are shed and reported by an events:dropped
+// counter. Only uncorrelated ones are ever shed: a reply to a command, or
+// any event that can't be coalesced, is queued past the cap, since the core
+// may be waiting on it and nothing later stands in for it.
+
+const (
+	// eventQueueCap bounds queued (unwritten) events.
+	eventQueueCap = 4096
+	// eventFlushTimeout bounds the exit-time flush, so a parent that never
+	// reads again can't hang the sidecar on shutdown.
+	eventFlushTimeout = 2 * time.Second
+)
+
+// eventsDroppedData is the payload for events:dropped events.
+type eventsDroppedData struct {
+	// Count is the number of events shed since the previous events:dropped.
+	Count uint64 `json:"count"`
+	// The shed events had seqs in FromSeq..ToSeq inclusive; seqs in that
+	// range that did reach stdout were delivered.
+	FromSeq uint64 `json:"fromSeq"`
+	ToSeq   uint64 `json:"toSeq"`
+}
+
+// sheddable reports whether a full queue may drop ev, whose coalesce key is
+// key.
+func sheddable(ev event, key string) bool {
+	return ev.ID == "" && key != ""
+}
+
+// queuedEvent is one pending stdout write. Pinned items (framing switches,
+// replays) are never shed or coalesced; after, when set, runs under writeMu
+// right after the event is written.
+type queuedEvent struct {
+	ev     event
+	key    string
+	pinned bool
+	after  func()
+}
+
+// eventQueue is the bounded FIFO between emitters and runEventWriter.
+type eventQueue struct {
+	cap int
+
+	mu      sync.Mutex
+	items   []*queuedEvent
+	pending map[string]*queuedEvent // coalesce key -> still-queued item
+	seq     uint64                  // last seq stamped, shed events included
+	dropped eventsDroppedData       // shed since the last take
+	closed  bool
+
+	wake chan struct{} // 1-buffered: "items available"
+	done chan struct{} // closed when the writer has drained after close
+}
+
+func newEventQueue(capacity int) *eventQueue {
+	return &eventQueue{
+		cap:     capacity,
+		pending: make(map[string]*queuedEvent),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// coalesceKey names the slot an event may overwrite while still queued; ""
+// means the event is always delivered in full. Keys include the event id so
+// two watchers' streams never merge.
+func coalesceKey(ev event) string {
+	switch ev.Event {
+	case "tsnet:peerChanged":
+		if pc, ok := ev.Data.(peerChangedData); ok {
+			return ev.Event + "\x00" + ev.Node + "\x00" + ev.ID + "\x00" + pc.PeerID
+		}
+	case "tsnet:healthWarning":
+		return ev.Event + "\x00" + ev.Node + "\x00" + ev.ID
+	}
+	return ""
+}
+
+// mergeCoalesced returns the event that replaces a still-queued one. The newer
+// event wins, except that a queued "joined" absorbs a later "updated" (with
+// the fresh peer data) so the core never sees an update for a peer it was
+// never told joined.
+func mergeCoalesced(queued, next event) event {
+	prev, ok1 := queued.Data.(peerChangedData)
+	cur, ok2 := next.Data.(peerChangedData)
+	if ok1 && ok2 && prev.ChangeType == "joined" && cur.ChangeType == "updated" {
+		cur.ChangeType = "joined"
+		next.Data = cur
+	}
+	return next
+}
+
+// push enqueues ev without blocking. It reports false when the event was shed
+// because the queue is full (or closed). Only sheddable events are shed; the
+// rest may take the queue past its cap.
+//
+// A live event is stamped with its seq here, so a shed one leaves a gap in
+// stdout's seqs and events:dropped can say where. An event coalesced into a
+// queued one takes over that one's seq.
+func (q *eventQueue) push(ev event, pinned bool, after func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	key := ""
+	if !pinned {
+		key = coalesceKey(ev)
+	}
+	if key != "" {
+		if it, ok := q.pending[key]; ok {
+			seq := it.ev.Seq
+			it.ev = mergeCoalesced(it.ev, ev)
+			it.ev.Seq = seq
+			return true
+		}
+	}
+	if !ev.Replay {
+		q.seq++
+		ev.Seq = q.seq
+	}
+	if !pinned && len(q.items) >= q.cap && sheddable(ev, key) {
+		if q.dropped.Count == 0 {
+			q.dropped.FromSeq = ev.Seq
+		}
+		q.dropped.Count++
+		q.dropped.ToSeq = ev.Seq
+		return false
+	}
+	it := &queuedEvent{ev: ev, key: key, pinned: pinned, after: after}
+	q.items = append(q.items, it)
+	if key != "" {
+		q.pending[key] = it
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// take removes everything queued plus the shed count. Taken items leave the
+// coalesce index, so later events can't rewrite an event mid-write. If
+// anything was shed, the batch ends with an events:dropped saying so,
+// stamped here so its seq stays in order with the rest.
+func (q *eventQueue) take() (items []*queuedEvent, dropped uint64, closed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items, q.items = q.items, nil
+	for k := range q.pending {
+		delete(q.pending, k)
+	}
+	if d := q.dropped; d.Count > 0 {
+		q.seq++
+		items = append(items, &queuedEvent{ev: event{Event: "events:dropped", Seq: q.seq, Data: d}, pinned: true})
+		dropped = d.Count
+	}
+	q.dropped = eventsDroppedData{}
+	return items, dropped, q.closed
+}
+
+// close stops accepting events and waits up to timeout for the writer to
+// flush what is already queued.
+func (q *eventQueue) close(timeout time.Duration) {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	select {
+	case <-q.done:
+	case <-time.After(timeout):
+		sidecarLog.Warnf("event writer: flush timed out after %v; exiting with events queued", timeout)
+	}
+}
+
+// runEventWriter is the single stdout writer. It drains the queue in order
+// (take closes a batch with events:dropped if anything was shed) and exits
+// once the queue is closed and empty.
+func (s *sidecar) runEventWriter() {
+	q := s.events
+	defer close(q.done)
+	for range q.wake {
+		items, dropped, closed := q.take()
+		for _, it := range items {
+			s.writeMu.Lock()
+			s.encodeLocked(it.ev)
+			if it.after != nil {
+				it.after()
+			}
+			s.writeMu.Unlock()
+		}
+		if dropped > 0 {
+			sidecarLog.Warnf("event writer: dropped %d events (stdout reader too slow)", dropped)
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// ── Event sequence numbers and replay ─────────────────────────────────────
+//
+// Every stdout event is stamped with a seq as it is queued and, once
+// written, kept in a bounded ring. An event shed by a full queue uses up its
+// seq without being written or kept; events:dropped reports the range. A core that restarted its reader (or lost output) sends
+// events:replay {sinceSeq} and gets the retained events after sinceSeq
+// re-emitted with their original seq and replay:true, followed by an
+// events:replayed summary that reports a gap when some were already evicted.
+
+// eventRingCap bounds the replay buffer.
+const eventRingCap = 1024
+
+// eventsReplayData is the payload for events:replay commands.
+type eventsReplayData struct {
+	SinceSeq uint64 `json:"sinceSeq"`
+}
+
+// eventsReplayedData is the payload for events:replayed events, emitted after
+// the re-emitted events.
+type eventsReplayedData struct {
+	SinceSeq uint64 `json:"sinceSeq"`
+	Count    int    `json:"count"`   // events re-emitted
+	LastSeq  uint64 `json:"lastSeq"` // newest seq written when the replay ran
+	// Gap is set when events after sinceSeq had already been evicted; the
+	// lost range is MissedFrom..MissedTo inclusive.
+	Gap        bool   `json:"gap,omitempty"`
+	MissedFrom uint64 `json:"missedFrom,omitempty"`
+	MissedTo   uint64 `json:"missedTo,omitempty"`
+}
+
+// eventRing keeps the last cap written events in seq order.
+type eventRing struct {
+	buf   []event
+	start int // index of the oldest event
+	n     int
+}
+
+func newEventRing(capacity int) *eventRing {
+	return &eventRing{buf: make([]event, capacity)}
+}
+
+func (r *eventRing) add(ev event) {
+	if len(r.buf) == 0 {
+		return
+	}
+	if r.n < len(r.buf) {
+		r.buf[(r.start+r.n)%len(r.buf)] = ev
+		r.n++
+		return
+	}
+	r.buf[r.start] = ev
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+// since returns retained events with seq > seq, oldest first, plus the
+// oldest retained seq (0 when empty).
+func (r *eventRing) since(seq uint64) (evs []event, oldest uint64) {
+	if r == nil || r.n == 0 {
+		return nil, 0
+	}
+	oldest = r.buf[r.start].Seq
+	for i := 0; i < r.n; i++ {
+		ev := r.buf[(r.start+i)%len(r.buf)]
+		if ev.Seq > seq {
+			evs = append(evs, ev)
+		}
+	}
+	return evs, oldest
+}
+
+// handleEventsReplay re-emits retained stdout events after sinceSeq. The ring
+// covers the stdout channel only; control-socket clients are refused.
+func (s *shim) handleEventsReplay(id string, data json.RawMessage) {
+	var d eventsReplayData
+	if err := json.Unmarshal(data, &d); err != nil {
+		s.sendErrorID(id, "REPLAY_ERROR", fmt.Sprintf("invalid replay data: %v", err))
+		return
+	}
+	if _, _, ok := untagControlID(id); ok {
+		s.sendErrorID(id, "REPLAY_UNSUPPORTED", "events:replay covers the stdout channel only")
+		return
+	}
+
+	s.writeMu.Lock()
+	evs, oldest := s.ring.since(d.SinceSeq)
+	last := s.seq
+	s.writeMu.Unlock()
+
+	res := eventsReplayedData{SinceSeq: d.SinceSeq, Count: len(evs), LastSeq: last}
+	if last > d.SinceSeq && (oldest == 0 || oldest > d.SinceSeq+1) {
+		res.Gap = true
+		res.MissedFrom = d.SinceSeq + 1
+		res.MissedTo = last
+		if oldest != 0 {
+			res.MissedTo = oldest - 1
+		}
+	}
+
+	// Pinned, so the replay is neither shed nor coalesced with live events.
+	for _, ev := range evs {
+		ev.Replay = true
+		s.emitPinned(ev)
+	}
+	s.emitPinned(event{Event: "events:replayed", ID: id, Data: res})
+}
+
+// emitPinned writes a stdout event that must not be shed or coalesced.
+func (s *sidecar) emitPinned(ev event) {
+	if s.events != nil {
+		s.events.push(ev, true, nil)
+		return
+	}
+	s.writeEvent(ev)
+}
+
+// ── Drain ───────────────────────────────────────────────────────────────────
+//
+// tsnet:drain winds the node down without cutting anyone off: dynamic
+// listeners close and proxies stop accepting, while bridged streams and
+// in-flight proxy requests get until the deadline to finish. The node stays
+// up; the parent follows with tsnet:stop.
+
+const (
+	// defaultDrainTimeout applies when tsnet:drain omits timeoutSecs.
+	defaultDrainTimeout = 30 * time.Second
+	// drainPollInterval is how often the drain re-checks the in-flight count,
+	// so it finishes promptly once the last connection closes.
+	drainPollInterval = 100 * time.Millisecond
+	// drainProgressInterval paces tsnet:draining progress events.
+	drainProgressInterval = time.Second
+)
+
+// drainData is the payload for tsnet:drain.
+type drainData struct {
+	// TimeoutSecs bounds the drain; nil or <=0 uses defaultDrainTimeout.
+	TimeoutSecs *int `json:"timeoutSecs,omitempty"`
+}
+
+// drainingData is the payload for tsnet:draining progress events, emitted
+// when the drain begins and about once a second after.
+type drainingData struct {
+	Remaining int64 `json:"remaining"` // bridges + requests
+	Bridges   int64 `json:"bridges"`
+	Requests  int64 `json:"requests"`
+	SecsLeft  int   `json:"secsLeft"`
+}
+
+// drainedData is the payload for tsnet:drained. Reason is "idle" (everything
+// finished), "timeout" (Remaining connections outlived the deadline) or
+// "stopped" (tsnet:stop interrupted the drain).
+type drainedData struct {
+	Remaining int64  `json:"remaining"`
+	Bridges   int64  `json:"bridges"`
+	Requests  int64  `json:"requests"`
+	Reason    string `json:"reason"`
+}
+
+// resolveDrainTimeout converts the optional timeoutSecs knob into a duration.
+func resolveDrainTimeout(secs *int) time.Duration {
+	if secs != nil && *secs > 0 {
+		return time.Duration(*secs) * time.Second
+	}
+	return defaultDrainTimeout
+}
+
+func (s *shim) handleDrain(id string, data json.RawMessage) {
+	var d drainData
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &d); err != nil {
+			s.sendErrorID(id, "DRAIN_ERROR", fmt.Sprintf("invalid drain data: %v", err))
+			return
+		}
+	}
+	if s.getServer() == nil {
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
+		return
+	}
+	s.drain(id, resolveDrainTimeout(d.TimeoutSecs))
+}
+
+// drain stops intake synchronously (so a listen, relay, proxy:add or dial
+// dispatched after the drain is refused) and tracks the in-flight count in the background.
+// The returned channel closes once tsnet:drained is sent; it is nil, and
+// DRAIN_ERROR is reported, if a drain was already in progress.
+func (s *shim) drain(id string, timeout time.Duration) <-chan struct{} {
+	done := s.startDrain(id, timeout)
+	if done == nil {
+		s.sendErrorID(id, "DRAIN_ERROR", "drain already in progress")
+	}
+	return done
+}
+
+// startDrain is drain without the error: it returns nil quietly when a drain
+// is already in progress.
+func (s *shim) startDrain(id string, timeout time.Duration) <-chan struct{} {
+	if !s.draining.CompareAndSwap(false, true) {
+		return nil
+	}
+	lifeCtx := s.lifecycleCtx()
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(lifeCtx, deadline)
+
+	// Dropping a listener from the map before closing it makes its accept
+	// loop exit quietly, as on tsnet:unlisten. Accepted conns keep running.
+	s.dynamicListenerMu.Lock()
+	listeners := s.dynamicListeners
+	s.dynamicListeners = make(map[uint16]net.Listener)
+	s.dynamicListenerMu.Unlock()
+	for port, ln := range listeners {
+		if err := ln.Close(); err != nil {
+			bridgeLog.Warnf("drain: close listener :%d error: %v", port, err)
+		}
+		s.sendEventID(id, "tsnet:unlistened", unlistenedData{Port: port})
+	}
+
+	// Proxies stay registered (tsnet:stop still reaches them) but Shutdown
+	// closes their listeners and idle keep-alives at once, then waits for
+	// active requests. Hijacked WebSockets are counted in proxyRequests.
+	s.proxyMu.Lock()
+	entries := make([]*proxyEntry, 0, len(s.proxies))
+	for _, entry := range s.proxies {
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	s.proxyMu.Unlock()
+	for _, entry := range entries {
+		go entry.server.Shutdown(ctx)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer s.recoverPanic("drain")
+		defer close(done)
+		defer cancel()
+
+		progress := func() drainingData {
+			b, r := s.bridgeConns.Load(), s.proxyRequests.Load()
+			return drainingData{
+				Remaining: b + r, Bridges: b, Requests: r,
+				SecsLeft: int(time.Until(deadline).Round(time.Second) / time.Second),
+			}
+		}
+		p := progress()
+		s.sendEventID(id, "tsnet:draining", p)
+		lastProgress := time.Now()
+
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+		reason := "idle"
+		for p.Remaining > 0 {
+			select {
+			case <-ctx.Done():
+				reason = "timeout"
+				if lifeCtx.Err() != nil {
+					reason = "stopped"
+				}
+			case <-ticker.C:
+			}
+			p = progress()
+			if reason != "idle" {
+				break
+			}
+			if p.Remaining > 0 && time.Since(lastProgress) >= drainProgressInterval {
+				s.sendEventID(id, "tsnet:draining", p)
+				lastProgress = time.Now()
+			}
+		}
+
+		// Tear down the drained proxies still registered (stop may have
+		// beaten us to it). Past the deadline this cancels what is left.
+		if reason != "stopped" {
+			for _, entry := range entries {
+				s.proxyMu.Lock()
+				owned := s.proxies[entry.id] == entry
+				if owned {
+					delete(s.proxies, entry.id)
+				}
+				s.proxyMu.Unlock()
+				if owned {
+					entry.shutdown(time.Second)
+					s.sendEventID(id, "proxy:removed", proxyRemovedEventData{ID: entry.id})
+				}
+			}
+		}
+
+		sidecarLog.Debugf("drain finished (%s) with %d connections remaining", reason, p.Remaining)
+		s.sendEventID(id, "tsnet:drained", drainedData{
+			Remaining: p.Remaining, Bridges: p.Bridges, Requests: p.Requests, Reason: reason,
+		})
+	}()
+	return done
+}
+
+// ── State stores ────────────────────────────────────────────────────────────
+//
+// tsnet:start's stateStore picks where the node key and prefs live:
+//
+//	file      tsnet's default FileStore at <stateDir>/tailscaled.state
+//	mem       in memory only; requires ephemeral (tsnet refuses otherwise)
+//	encrypted a FileStore at <stateDir>/tailscaled.state.enc whose values are
+//	          sealed with AES-256-GCM under a key the core supplies (from the
+//	          OS keychain); the sidecar never writes the key to disk
+//
+// Switching an existing node to encrypted migrates its plaintext state file
+// on first start and then deletes it, so the node keeps its identity.
+
+const (
+	stateStoreFile      = "file"
+	stateStoreMem       = "mem"
+	stateStoreEncrypted = "encrypted"
+
+	plainStateFile     = "tailscaled.state"
+	encryptedStateFile = "tailscaled.state.enc"
+
+	// sealedStateVersion prefixes every sealed value, so the format can
+	// change without guessing.
+	sealedStateVersion = 1
+)
+
+// stateStoreData is the stateStore option of tsnet:start. nil means file.
+type stateStoreData struct {
+	Mode string `json:"mode"`
+	// Key is the hex-encoded 32-byte AES key for mode "encrypted".
+	Key string `json:"key,omitempty"`
+}
+
+// stateMigratedData is the payload for tsnet:stateMigrated.
+type stateMigratedData struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Keys int    `json:"keys"`
+}
+
+// encryptedStore seals each value of an inner ipn.StateStore. The state key
+// is bound in as additional data, so sealed values can't be swapped between
+// keys on disk.
+type encryptedStore struct {
+	inner ipn.StateStore
+	aead  cipher.AEAD
+}
+
+func newEncryptedStore(inner ipn.StateStore, key []byte) (*encryptedStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedStore{inner: inner, aead: aead}, nil
+}
+
+// ReadState implements ipn.StateStore.
+func (e *encryptedStore) ReadState(id ipn.StateKey) ([]byte, error) {
+	sealed, err := e.inner.ReadState(id)
+	if err != nil {
+		return nil, err
+	}
+	return e.open(id, sealed)
+}
+
+// WriteState implements ipn.StateStore. A nil bs deletes, as for any store.
+func (e *encryptedStore) WriteState(id ipn.StateKey, bs []byte) error {
+	if bs == nil {
+		return e.inner.WriteState(id, nil)
+	}
+	nonce := make([]byte, e.aead.NonceSize(), 1+e.aead.NonceSize()+len(bs)+e.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := append([]byte{sealedStateVersion}, nonce...)
+	sealed = e.aead.Seal(sealed, nonce, bs, []byte(id))
+	return e.inner.WriteState(id, sealed)
+}
+
+func (e *encryptedStore) open(id ipn.StateKey, sealed []byte) ([]byte, error) {
+	ns := e.aead.NonceSize()
+	if len(sealed) < 1+ns || sealed[0] != sealedStateVersion {
+		return nil, fmt.Errorf("state %q: not a sealed value", id)
+	}
+	plain, err := e.aead.Open(nil, sealed[1:1+ns], sealed[1+ns:], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("state %q: decrypt failed (wrong key?)", id)
+	}
+	return plain, nil
+}
+
+// openStateStore builds the tsnet.Server.Store for opt. A nil store means
+// tsnet's own FileStore (mode file). migrated counts keys moved out of a
+// plaintext state file.
+func openStateStore(opt *stateStoreData, stateDir string, ephemeral bool) (st ipn.StateStore, migrated int, err error) {
+	mode := stateStoreFile
+	if opt != nil && opt.Mode != "" {
+		mode = opt.Mode
+	}
+	switch mode {
+	case stateStoreFile:
+		if _, err := os.Stat(filepath.Join(stateDir, encryptedStateFile)); err == nil && stateDir != "" {
+			sidecarLog.Warnf("stateStore file ignores the encrypted state in %s", stateDir)
+		}
+		return nil, 0, nil
+	case stateStoreMem:
+		if !ephemeral {
+			return nil, 0, errors.New(`stateStore "mem" requires ephemeral: a non-ephemeral node would lose its key on exit`)
+		}
+		return new(mem.Store), 0, nil
+	case stateStoreEncrypted:
+	default:
+		return nil, 0, fmt.Errorf("unknown stateStore mode %q (want file, mem or encrypted)", mode)
+	}
+
+	key, err := hex.DecodeString(opt.Key)
+	if err != nil || len(key) != 32 {
+		return nil, 0, errors.New(`stateStore "encrypted" needs key: 64 hex chars (32 bytes)`)
+	}
+	if stateDir == "" {
+		return nil, 0, errors.New(`stateStore "encrypted" needs an explicit stateDir`)
+	}
+	encPath := filepath.Join(stateDir, encryptedStateFile)
+	plainPath := filepath.Join(stateDir, plainStateFile)
+	_, statErr := os.Stat(encPath)
+	fresh := errors.Is(statErr, os.ErrNotExist)
+
+	inner, err := store.NewFileStore(tsnetLog.Debugf, encPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	enc, err := newEncryptedStore(inner, key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Fail the start here on a wrong key, rather than letting tsnet come up
+	// as a brand-new node and orphan the old identity.
+	if fs, ok := inner.(*store.FileStore); ok {
+		for id, sealed := range fs.All() {
+			if _, err := enc.open(id, sealed); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	if _, err := os.Stat(plainPath); err == nil {
+		if !fresh {
+			sidecarLog.Warnf("plaintext %s left beside %s; using the encrypted store", plainPath, encPath)
+			return enc, 0, nil
+		}
+		if migrated, err = migratePlainState(plainPath, enc); err != nil {
+			os.Remove(encPath) // retry the whole migration next start
+			return nil, 0, fmt.Errorf("migrating %s: %w", plainPath, err)
+		}
+	}
+	return enc, migrated, nil
+}
+
+// migratePlainState copies every key of the plaintext FileStore at path into
+// dst, then deletes the plaintext file: it holds the node's private key.
+func migratePlainState(path string, dst ipn.StateStore) (int, error) {
+	src, err := store.NewFileStore(tsnetLog.Debugf, path)
+	if err != nil {
+		return 0, err
+	}
+	fs, ok := src.(*store.FileStore)
+	if !ok {
+		return 0, fmt.Errorf("unexpected store type %T", src)
+	}
+	n := 0
+	for id, bs := range fs.All() {
+		if err := dst.WriteState(id, bs); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if err := os.Remove(path); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// ── Login / logout ──────────────────────────────────────────────────────────
+//
+// tsnet:login, tsnet:logout and tsnet:reauth drive the node's control-plane
+// identity after start. Each watches the IPN bus while it acts, echoing its
+// id on the tsnet:authRequired it causes, and ends with one tsnet:authResult.
+// The transitions themselves are reported by watchState.
+
+const (
+	// loginTimeout bounds tsnet:login and tsnet:reauth, which wait on a
+	// human finishing the flow in a browser.
+	loginTimeout = 10 * time.Minute
+	// logoutTimeout bounds tsnet:logout.
+	logoutTimeout = 30 * time.Second
+)
+
+// authResultData is the payload for tsnet:authResult.
+type authResultData struct {
+	Action  string `json:"action"` // "login" | "logout" | "reauth"
+	Success bool   `json:"success"`
+	State   string `json:"state,omitempty"` // backend state at the end
+	Error   string `json:"error,omitempty"`
+}
+
+func (s *shim) handleLogin(id string)  { s.runAuthAction(id, "login") }
+func (s *shim) handleLogout(id string) { s.runAuthAction(id, "logout") }
+func (s *shim) handleReauth(id string) { s.runAuthAction(id, "reauth") }
+
+func (s *shim) runAuthAction(id, action string) {
+	srv := s.getServer()
+	if srv == nil {
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
+		return
+	}
+	// Logout deletes the profile, so login restores the prefs tsnet set at
+	// start, with any tsnet:setHostname/tsnet:setTags edits since.
+	hostname, tags := s.nameAndTags()
+	controlURL := srv.ControlURL
+
+	go func() {
+		defer s.recoverPanic("runAuthAction")
+
+		state := ""
+		result := func(err error) {
+			r := authResultData{Action: action, Success: err == nil, State: state}
+			if err != nil {
+				r.Error = err.Error()
+			}
+			s.sendEventID(id, "tsnet:authResult", r)
+		}
+
+		lc, err := srv.LocalClient()
+		if err != nil {
+			result(fmt.Errorf("failed to get local client: %v", err))
+			return
+		}
+		timeout := loginTimeout
+		if action == "logout" {
+			timeout = logoutTimeout
+		}
+		ctx, cancel := context.WithTimeout(s.lifecycleCtx(), timeout)
+		defer cancel()
+
+		// Subscribe before acting so no transition is missed; the initial
+		// notify carries the state we start from.
+		w, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialState)
+		if err != nil {
+			result(fmt.Errorf("WatchIPNBus: %v", err))
+			return
+		}
+		defer w.Close()
+		n, err := w.Next()
+		if err != nil {
+			result(fmt.Errorf("WatchIPNBus: %v", err))
+			return
+		}
+		if n.State != nil {
+			state = n.State.String()
+		}
+
+		switch action {
+		case "login":
+			if state == ipn.Running.String() {
+				result(errors.New("already logged in (use tsnet:reauth)"))
+				return
+			}
+			// Start replaces the whole prefs set, so build on the current
+			// profile's: after a key expiry they still carry shields, routes,
+			// exit node and SSH; after a logout they are a new profile's.
+			prefs, err := lc.GetPrefs(ctx)
+			if err != nil {
+				result(fmt.Errorf("get prefs: %v", err))
+				return
+			}
+			prefs.Hostname = hostname
+			prefs.WantRunning = true // without it the login would end in Stopped
+			prefs.ControlURL = controlURL
+			prefs.AdvertiseTags = tags
+			if err := lc.Start(ctx, ipn.Options{UpdatePrefs: prefs}); err != nil {
+				result(fmt.Errorf("start backend: %v", err))
+				return
+			}
+			err = lc.StartLoginInteractive(ctx)
+		case "reauth":
+			if state != ipn.Running.String() {
+				result(fmt.Errorf("not logged in (state %s; use tsnet:login)", state))
+				return
+			}
+			err = lc.StartLoginInteractive(ctx)
+		case "logout":
+			err = lc.Logout(ctx)
+			if err == nil && state == ipn.NeedsLogin.String() {
+				// Already logged out, or the key expired: no state change
+				// is coming to wait for.
+				s.setDNSName("")
+				result(nil)
+				return
+			}
+		}
+		if err != nil {
+			result(err)
+			return
+		}
+
+		for {
+			n, err := w.Next()
+			if err != nil {
+				if ctx.Err() != nil {
+					err = fmt.Errorf("%s did not finish within %v", action, timeout)
+				}
+				result(err)
+				return
+			}
+			if n.State != nil {
+				state = n.State.String()
+			}
+			if n.BrowseToURL != nil && *n.BrowseToURL != "" {
+				s.sendEventID(id, "tsnet:authRequired", authRequiredData{AuthURL: *n.BrowseToURL})
+			}
+
+			switch {
+			case action == "logout" && state == ipn.NeedsLogin.String():
+				s.setDNSName("")
+				result(nil)
+				return
+			case action == "login" && state == ipn.Running.String(),
+				action == "reauth" && n.LoginFinished != nil:
+				s.announceRunning(ctx, id, lc)
+				result(nil)
+				return
+			}
+		}
+	}()
+}
+
+// announceRunning refreshes dnsName and re-emits the running status the core
+// saw at start, after a login (a new node key can mean a new name) or an
+// exit-node change.
+func (s *shim) announceRunning(ctx context.Context, id string, lc *tailscale.LocalClient) {
+	status, err := lc.StatusWithoutPeers(ctx)
+	if err != nil || status.Self == nil {
+		return
+	}
+	st := runningStatus(status.Self.HostName, status)
+	s.setDNSName(st.DNSName)
+	s.sendEventID(id, "tsnet:status", st)
+}
+
+// ── Hostname and tags ───────────────────────────────────────────────────────
+//
+// tsnet:setHostname and tsnet:setTags edit the running node's prefs in place,
+// so listeners, relays and proxies survive. Control applies the change on the
+// next map update; when the MagicDNS name moves, refreshDNSName re-announces
+// every running proxy under its new URL. Tags are requested, not granted: a
+// tailnet whose ACLs only hand out tags at login needs a tsnet:reauth too.
+
+// prefsEditTimeout bounds the LocalClient EditPrefs call.
+const prefsEditTimeout = 10 * time.Second
+
+// setHostnameData is the payload for tsnet:setHostname commands.
+type setHostnameData struct {
+	Hostname string `json:"hostname"`
+}
+
+// setTagsData is the payload for tsnet:setTags commands. An empty list
+// clears the advertised tags.
+type setTagsData struct {
+	Tags []string `json:"tags"`
+}
+
+// hostnameSetData is the payload for tsnet:hostnameSet.
+type hostnameSetData struct {
+	Hostname string `json:"hostname"`
+	DNSName  string `json:"dnsName"` // may still be the old name until control applies the rename
+}
+
+// tagsSetData is the payload for tsnet:tagsSet.
+type tagsSetData struct {
+	Tags    []string `json:"tags"`
+	DNSName string   `json:"dnsName"`
+}
+
+func (s *shim) handleSetHostname(id string, data json.RawMessage) {
+	var d setHostnameData
+	if err := json.Unmarshal(data, &d); err != nil {
+		s.sendErrorID(id, "SET_HOSTNAME_ERROR", fmt.Sprintf("invalid data: %v", err))
+		return
+	}
+	if err := dnsname.ValidHostname(d.Hostname); err != nil {
+		s.sendErrorID(id, "SET_HOSTNAME_ERROR", err.Error())
+		return
+	}
+	srv := s.getServer()
+	if srv == nil {
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
+		return
+	}
+	s.editPrefs(id, srv, "SET_HOSTNAME_ERROR", &ipn.MaskedPrefs{
+		Prefs:       ipn.Prefs{Hostname: d.Hostname},
+		HostnameSet: true,
+	}, func(dnsName string) {
+		// A later tsnet:login or restart keeps the new name.
+		s.updateStartSpec(func(sd *startData) { sd.Hostname = d.Hostname })
+		s.sendEventID(id, "tsnet:hostnameSet", hostnameSetData{Hostname: d.Hostname, DNSName: dnsName})
+	})
+}
+
+func (s *shim) handleSetTags(id string, data json.RawMessage) {
+	var d setTagsData
+	if err := json.Unmarshal(data, &d); err != nil {
+		s.sendErrorID(id, "SET_TAGS_ERROR", fmt.Sprintf("invalid data: %v", err))
+		return
+	}
+	for _, tag := range d.Tags {
+		if err := tailcfg.CheckTag(tag); err != nil {
+			s.sendErrorID(id, "SET_TAGS_ERROR", err.Error())
+			return
+		}
+	}
+	srv := s.getServer()
+	if srv == nil {
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
+		return
+	}
+	if d.Tags == nil {
+		d.Tags = []string{}
+	}
+
+	s.editPrefs(id, srv, "SET_TAGS_ERROR", &ipn.MaskedPrefs{
+		Prefs:            ipn.Prefs{AdvertiseTags: d.Tags},
+		AdvertiseTagsSet: true,
+	}, func(dnsName string) {
+		s.updateStartSpec(func(sd *startData) { sd.Tags = d.Tags })
+		s.sendEventID(id, "tsnet:tagsSet", tagsSetData{Tags: d.Tags, DNSName: dnsName})
+	})
+}
+
+// editPrefs applies mp off the dispatch loop, refreshes dnsName from status
+// in case control already renamed the node, and calls done with the current
+// name. done only runs once the edit has succeeded.
+func (s *shim) editPrefs(id string, srv *tsnet.Server, code string, mp *ipn.MaskedPrefs, done func(dnsName string)) {
+	go func() {
+		defer s.recoverPanic("editPrefs")
+		lc, err := srv.LocalClient()
+		if err != nil {
+			s.sendErrorID(id, code, fmt.Sprintf("failed to get local client: %v", err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(s.lifecycleCtx(), prefsEditTimeout)
+		defer cancel()
+		if _, err := lc.EditPrefs(ctx, mp); err != nil {
+			s.sendErrorID(id, code, err.Error())
+			return
+		}
+		if status, err := lc.StatusWithoutPeers(ctx); err == nil && status.Self != nil {
+			s.refreshDNSName(id, strings.TrimSuffix(status.Self.DNSName, "."))
+		}
+		done(s.getDNSName())
+	}()
+}
+
+// refreshDNSName records a new MagicDNS name and re-emits proxy:added for
+// every running proxy so the core picks up the new URLs. A no-op when the
+// name is unchanged or empty.
+func (s *shim) refreshDNSName(id, dnsName string) {
+	if dnsName == "" || dnsName == s.getDNSName() {
+		return
+	}
+	tsnetLog.Infof("dnsName changed to %s", dnsName)
+	s.setDNSName(dnsName)
+
+	s.proxyMu.Lock()
+	var added []proxyAddedEventData
+	tlsOn := false
+	for _, entry := range s.proxies {
+		if entry == nil {
+			continue // still being set up; its own proxy:added reads the new name
+		}
+		tlsOn = tlsOn || entry.tlsOn
+		added = append(added, proxyAddedEventData{
+			ID: entry.id, ListenPort: entry.listenPort,
+			URL: publicURL(entry.tlsOn, dnsName, entry.listenPort),
+		})
+	}
+	s.proxyMu.Unlock()
+
+	// The cert is per-name, so a TLS proxy needs one for the new name too.
+	if srv := s.getServer(); srv != nil && tlsOn {
+		go s.prewarmCert(s.lifecycleCtx(), srv)
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i].ID < added[j].ID })
+	for _, a := range added {
+		s.sendEventID(id, "proxy:added", a)
+	}
+}
+
+// ── Prefs ───────────────────────────────────────────────────────────────────
+//
+// tsnet:getPrefs and tsnet:editPrefs expose the typed subset of ipn.Prefs an
+// app needs to make a node a subnet router or exit-node client. Both reply
+// with tsnet:prefs; watchState separately emits tsnet:prefsChanged whenever
+// that subset changes, whether by this command, another command or a logout.
+
+// prefsData is the payload for tsnet:prefs and tsnet:prefsChanged.
+type prefsData struct {
+	ShieldsUp       bool     `json:"shieldsUp"`
+	AcceptRoutes    bool     `json:"acceptRoutes"`
+	AdvertiseRoutes []string `json:"advertiseRoutes"` // CIDRs, including exit-node routes
+	ExitNodeID      string   `json:"exitNodeId"`      // "" when no exit node is in use
+	RunSSH          bool     `json:"runSSH"`
+}
+
+// editPrefsData is the payload for tsnet:editPrefs commands. Only the fields
+// present are changed.
+type editPrefsData struct {
+	ShieldsUp       *bool     `json:"shieldsUp,omitempty"`
+	AcceptRoutes    *bool     `json:"acceptRoutes,omitempty"`
+	AdvertiseRoutes *[]string `json:"advertiseRoutes,omitempty"`
+	ExitNodeID      *string   `json:"exitNodeId,omitempty"`
+	RunSSH          *bool     `json:"runSSH,omitempty"`
+}
+
+func prefsDataFrom(p *ipn.Prefs) prefsData {
+	routes := make([]string, 0, len(p.AdvertiseRoutes))
+	for _, r := range p.AdvertiseRoutes {
+		routes = append(routes, r.String())
+	}
+	return prefsData{
+		ShieldsUp:       p.ShieldsUp,
+		AcceptRoutes:    p.RouteAll,
+		AdvertiseRoutes: routes,
+		ExitNodeID:      string(p.ExitNodeID),
+		RunSSH:          p.RunSSH,
+	}
+}
+
+// maskedPrefs validates d and turns it into an EditPrefs request.
+func (d editPrefsData) maskedPrefs() (*ipn.MaskedPrefs, error) {
+	mp := &ipn.MaskedPrefs{}
+	if d.ShieldsUp != nil {
+		mp.ShieldsUp, mp.ShieldsUpSet = *d.ShieldsUp, true
+	}
+	if d.AcceptRoutes != nil {
+		mp.RouteAll, mp.RouteAllSet = *d.AcceptRoutes, true
+	}
+	if d.AdvertiseRoutes != nil {
+		routes := make([]netip.Prefix, 0, len(*d.AdvertiseRoutes))
+		for _, r := range *d.AdvertiseRoutes {
+			p, err := netip.ParsePrefix(r)
+			if err != nil {
+				return nil, fmt.Errorf("advertiseRoutes: %v", err)
+			}
+			if p != p.Masked() {
+				return nil, fmt.Errorf("advertiseRoutes: %s has host bits set (use %s)", p, p.Masked())
+			}
+			routes = append(routes, p)
+		}
+		mp.AdvertiseRoutes, mp.AdvertiseRoutesSet = routes, true
+	}
+	if d.ExitNodeID != nil {
+		// Clear any IP-selected or automatic exit node so the ID is the only
+		// selector (AutoExitNode would otherwise take precedence).
+		mp.ExitNodeID, mp.ExitNodeIDSet = tailcfg.StableNodeID(*d.ExitNodeID), true
+		mp.ExitNodeIPSet = true
+		mp.AutoExitNodeSet = true
+	}
+	if d.RunSSH != nil {
+		mp.RunSSH, mp.RunSSHSet = *d.RunSSH, true
+	}
+	return mp, nil
+}
+
+func (s *shim) handleGetPrefs(id string) {
+	srv := s.getServer()
+	if srv == nil {
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
+		return
+	}
+	go func() {
+		defer s.recoverPanic("handleGetPrefs")
+		lc, err := srv.LocalClient()
+		if err != nil {
+			s.sendErrorID(id, "PREFS_ERROR", fmt.Sprintf("failed to get local client: %v", err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(s.lifecycleCtx(), prefsEditTimeout)
+		defer cancel()
+		p, err := lc.GetPrefs(ctx)
+		if err != nil {
+			s.sendErrorID(id, "PREFS_ERROR", err.Error())
+			return
+		}
+		s.sendEventID(id, "tsnet:prefs", prefsDataFrom(p))
+	}()
+}
+
+func (s *shim) handleEditPrefs(id string, data json.RawMessage) {
+	var d editPrefsData
+	if err := json.Unmarshal(data, &d); err != nil {
+		s.sendErrorID(id, "EDIT_PREFS_ERROR", fmt.Sprintf("invalid data: %v", err))
+		return
+	}
+	mp, err := d.maskedPrefs()
+	if err != nil {
+		s.sendErrorID(id, "EDIT_PREFS_ERROR", err.Error())
+		return
+	}
+	srv := s.getServer()
+	if srv == nil {
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
+		return
+	}
+	go func() {
+		defer s.recoverPanic("handleEditPrefs")
+		lc, err := srv.LocalClient()
+		if err != nil {
+			s.sendErrorID(id, "EDIT_PREFS_ERROR", fmt.Sprintf("failed to get local client: %v", err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(s.lifecycleCtx(), prefsEditTimeout)
+		defer cancel()
+		p, err := lc.EditPrefs(ctx, mp)
+		if err != nil {
+			s.sendErrorID(id, "EDIT_PREFS_ERROR", err.Error())
+			return
+		}
+		s.sendEventID(id, "tsnet:prefs", prefsDataFrom(p))
+	}()
+}
+
+// ── Exit nodes ──────────────────────────────────────────────────────────────
+//
+// tsnet:exitNodes lists the peers control has approved as exit nodes and
+// tsnet:setExitNode routes the node's tailnet-bound internet traffic through
+// one of them, lets the backend pick ("auto"), or turns it off ("none"). The
+// exit node in use is reported as exitNode on "running" statuses.
+
+const (
+	exitNodeAuto = "auto"
+	exitNodeNone = "none"
+)
+
+// exitNodeInfo describes one exit-capable peer in tsnet:exitNodes.
+type exitNodeInfo struct {
+	ID           string   `json:"id"` // stable node ID, as tsnet:setExitNode takes it
+	Hostname     string   `json:"hostname"`
+	DNSName      string   `json:"dnsName"`
+	TailscaleIPs []string `json:"tailscaleIPs"`
+	Online       bool     `json:"online"`
+	Active       bool     `json:"active"` // currently routing this node's traffic
+}
+
+// exitNodesData is the payload for tsnet:exitNodes events.
+type exitNodesData struct {
+	Nodes []exitNodeInfo `json:"nodes"`
+}
+
+// setExitNodeData is the payload for tsnet:setExitNode commands.
+type setExitNodeData struct {
+	NodeID string `json:"nodeId"` // stable node ID, "auto" or "none"
+}
+
+// exitNodeSetData is the payload for tsnet:exitNodeSet.
+type exitNodeSetData struct {
+	NodeID string `json:"nodeId"` // as requested
+	Auto   bool   `json:"auto"`
+}
+
+// exitNodeOptions lists the peers in status offering an approved exit route,
+// sorted by hostname.
+func exitNodeOptions(status *ipnstate.Status) []exitNodeInfo {
+	nodes := []exitNodeInfo{}
+	for _, peer := range status.Peer {
+		if !peer.ExitNodeOption {
+			continue
+		}
+		var ips []string
+		for _, ip := range peer.TailscaleIPs {
+			ips = append(ips, ip.String())
+		}
+		nodes = append(nodes, exitNodeInfo{
+			ID:           string(peer.ID),
+			Hostname:     peer.HostName,
+			DNSName:      strings.TrimSuffix(peer.DNSName, "."),
+			TailscaleIPs: ips,
+			Online:       peer.Online,
+			Active:       peer.ExitNode,
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Hostname < nodes[j].Hostname })
+	return nodes
+}
+
+func (s *shim) handleExitNodes(id string) {
+	srv := s.getServer()
+	if srv == nil {
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
+		return
+	}
+	go func() {
+		defer s.recoverPanic("handleExitNodes")
+		lc, err := srv.LocalClient()
+		if err != nil {
+			s.sendErrorID(id, "EXIT_NODE_ERROR", fmt.Sprintf("failed to get local client: %v", err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(s.lifecycleCtx(), prefsEditTimeout)
+		defer cancel()
+		status, err := lc.Status(ctx)
+		if err != nil {
+			s.sendErrorID(id, "EXIT_NODE_ERROR", err.Error())
+			return
+		}
+		s.sendEventID(id, "tsnet:exitNodes", exitNodesData{Nodes: exitNodeOptions(status)})
+	}()
+}
+
+func (s *shim) handleSetExitNode(id string, data json.RawMessage) {
+	var d setExitNodeData
+	if err := json.Unmarshal(data, &d); err != nil {
+		s.sendErrorID(id, "EXIT_NODE_ERROR", fmt.Sprintf("invalid data: %v", err))
+		return
+	}
+	if d.NodeID == "" {
+		s.sendErrorID(id, "EXIT_NODE_ERROR", `nodeId is required (a node ID, "auto" or "none")`)
+		return
+	}
+	srv := s.getServer()
+	if srv == nil {
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
+		return
+	}
+
+	// Every mode writes all three selectors so exactly one is in effect.
+	mp := &ipn.MaskedPrefs{ExitNodeIDSet: true, ExitNodeIPSet: true, AutoExitNodeSet: true}
+	switch d.NodeID {
+	case exitNodeNone:
+	case exitNodeAuto:
+		mp.AutoExitNode = ipn.AnyExitNode
+	default:
+		mp.ExitNodeID = tailcfg.StableNodeID(d.NodeID)
+	}
+
+	go func() {
+		defer s.recoverPanic("handleSetExitNode")
+		lc, err := srv.LocalClient()
+		if err != nil {
+			s.sendErrorID(id, "EXIT_NODE_ERROR", fmt.Sprintf("failed to get local client: %v", err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(s.lifecycleCtx(), prefsEditTimeout)
+		defer cancel()
+
+		// Catch a typo or a peer that isn't (or is no longer) an exit node
+		// here; the backend would accept the ID and silently blackhole.
+		if d.NodeID != exitNodeNone && d.NodeID != exitNodeAuto {
+			status, err := lc.Status(ctx)
+			if err != nil {
+				s.sendErrorID(id, "EXIT_NODE_ERROR", err.Error())
+				return
+			}
+			if !slices.ContainsFunc(exitNodeOptions(status), func(n exitNodeInfo) bool { return n.ID == d.NodeID }) {
+				s.sendErrorID(id, "EXIT_NODE_ERROR", fmt.Sprintf("%s is not an available exit node", d.NodeID))
+				return
+			}
+		}
+
+		if _, err := lc.EditPrefs(ctx, mp); err != nil {
+			s.sendErrorID(id, "EXIT_NODE_ERROR", err.Error())
+			return
+		}
+		s.sendEventID(id, "tsnet:exitNodeSet", exitNodeSetData{NodeID: d.NodeID, Auto: d.NodeID == exitNodeAuto})
+		s.announceRunning(ctx, id, lc)
+	}()
+}
+
+// ── Heartbeat ───────────────────────────────────────────────────────────────
+//
+// stdin EOF only catches a parent that died. A parent that is alive but
+// wedged keeps the node online with its listeners open, so tsnet:start can
+// arm a watchdog: the parent sends sidecar:heartbeat every heartbeatSecs,
+// and once heartbeatMissLimit intervals pass without one the sidecar drains
+// and stops the node. In the other direction the watchdog emits
+// sidecar:heartbeat every interval, so the core can spot a hung sidecar.
+
+// heartbeatMissLimit is how many consecutive parent heartbeats may be missed
+// before the watchdog gives up on the parent.
+const heartbeatMissLimit = 3
+
+// heartbeatData is the payload for the sidecar's own sidecar:heartbeat.
+type heartbeatData struct {
+	Missed int `json:"missed"` // parent heartbeats missed so far
+}
+
+// heartbeatLostData is the payload for tsnet:heartbeatLost.
+type heartbeatLostData struct {
+	Missed      int `json:"missed"`
+	LastSecsAgo int `json:"lastSecsAgo"`
+}
+
+// handleHeartbeat records a parent heartbeat. It is process-wide, so one
+// heartbeat keeps every node's watchdog fed; it sends no reply.
+func (s *shim) handleHeartbeat() {
+	s.lastHeartbeat.Store(time.Now().UnixNano())
+}
+
+// watchHeartbeat runs until ctx (the node's lifecycle) ends. The watchdog's
+// own start counts as a heartbeat so the parent has a full grace period.
+func (s *shim) watchHeartbeat(ctx context.Context, interval time.Duration) {
+	defer s.recoverPanic("watchHeartbeat")
+	armed := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		last := armed
+		if t := time.Unix(0, s.lastHeartbeat.Load()); t.After(last) {
+			last = t
+		}
+		missed := int(time.Since(last) / interval)
+		s.sendEvent("sidecar:heartbeat", heartbeatData{Missed: missed})
+		if missed < heartbeatMissLimit {
+			continue
+		}
+
+		sidecarLog.Warnf("no parent heartbeat for %v; draining and stopping node %q", time.Since(last).Round(time.Second), s.node)
+		s.sendEvent("tsnet:heartbeatLost", heartbeatLostData{Missed: missed, LastSecsAgo: int(time.Since(last) / time.Second)})
+		// A drain the parent already started is cut short: nobody is left
+		// to send the tsnet:stop it was waiting for.
+		if done := s.startDrain("", defaultDrainTimeout); done != nil {
+			<-done
+		}
+		// Stop through the dispatcher's lock like a tsnet:stop would, unless
+		// the parent stopped (or restarted) the node while it drained.
+		s.dispatchMu.Lock()
+		if ctx.Err() == nil {
+			s.handleStop("")
+		}
+		s.dispatchMu.Unlock()
+		return
+	}
+}
+
+// ── Supervisor ──────────────────────────────────────────────────────────────
+//
+// A tsnet:start whose srv.Start() fails, or a running node whose backend
+// stops answering on the IPN bus, is handed to the supervisor instead of
+// being left dead. It tears the server down, keeps the lifecycle settings
+// (session token, bridge port, idle timeout, heartbeat), and restarts from
+// the same tsnet:start with capped exponential backoff, emitting
+// tsnet:recovering before each attempt. Once the node is back it re-creates
+// the dynamic listeners, UDP relays and proxies it had and emits
+// tsnet:recovered. tsnet:stop cancels a recovery in progress.
+//
+// Replayed listeners keep their ports, so Rust's registrations still match.
+// A replayed UDP relay gets a new local port, announced by its
+// tsnet:listeningPacket. Peer watches are not replayed.
+
+const (
+	// recoverBackoffMin and recoverBackoffMax bound the delay between
+	// restart attempts; it doubles after each failure.
+	recoverBackoffMin = time.Second
+	recoverBackoffMax = time.Minute
+	// recoverStartTimeout bounds how long one attempt waits for the backend
+	// to settle after srv.Start().
+	recoverStartTimeout = 2 * time.Minute
+	// recoverAfterWatchFailures is how many consecutive IPN bus subscribe
+	// failures count as a dead backend.
+	recoverAfterWatchFailures = 3
+)
+
+// recoveringData is the payload for tsnet:recovering.
+type recoveringData struct {
+	Attempt     int    `json:"attempt"` // 1 for the first restart attempt
+	Error       string `json:"error"`   // why the previous run or attempt failed
+	RetryInSecs int    `json:"retryInSecs"`
+}
+
+// recoveredData is the payload for tsnet:recovered.
+type recoveredData struct {
+	Attempts  int    `json:"attempts"`
+	State     string `json:"state"`     // Running, or NeedsLogin/NeedsMachineAuth
+	Listeners int    `json:"listeners"` // serving again; failed re-adds report their own errors
+	Relays    int    `json:"relays"`
+	Proxies   int    `json:"proxies"`
+}
+
+// servingSpec is what a node was serving, as the commands that created it.
+type servingSpec struct {
+	listeners []listenData
+	relays    []uint16
+	proxies   []json.RawMessage
+}
+
+// servingSpec snapshots the node's dynamic listeners, UDP relays and
+// proxies, in port/ID order.
+func (s *shim) servingSpec() servingSpec {
+	var spec servingSpec
+	s.dynamicListenerMu.Lock()
+	for port := range s.dynamicListeners {
+		spec.listeners = append(spec.listeners, listenData{Port: port, TLS: s.listenTLS[port]})
+	}
+	s.dynamicListenerMu.Unlock()
+	sort.Slice(spec.listeners, func(i, j int) bool { return spec.listeners[i].Port < spec.listeners[j].Port })
+
+	s.udpRelayMu.Lock()
+	for port := range s.udpRelays {
+		spec.relays = append(spec.relays, port)
+	}
+	s.udpRelayMu.Unlock()
+	slices.Sort(spec.relays)
+
+	s.proxyMu.Lock()
+	ids := make([]string, 0, len(s.proxies))
+	for id, entry := range s.proxies {
+		if entry != nil && entry.spec != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		spec.proxies = append(spec.proxies, s.proxies[id].spec)
+	}
+	s.proxyMu.Unlock()
+	return spec
+}
+
+// recoverNode hands a failed running node to the supervisor. ctx is the
+// lifecycle the failure was seen in; if it has ended (stopped, or already
+// recovering) there is nothing to do.
+func (s *shim) recoverNode(ctx context.Context, cause error) {
+	defer s.recoverPanic("recoverNode")
+	s.dispatchMu.Lock()
+	defer s.dispatchMu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	s.serverMu.RLock()
+	spec, store, token, port := s.startSpec, s.startStore, s.sessionToken, s.bridgePort
+	s.serverMu.RUnlock()
+	srv := s.getServer()
+	if spec == nil || srv == nil {
+		return
+	}
+
+	tsnetLog.Warnf("node %q failed (%v); restarting", s.node, cause)
+	d := *spec // tsnet:setHostname/tsnet:setTags edits included
+	serving := s.servingSpec()
+	s.teardown(false)
+	s.recovering.Store(true)
+	go s.supervise(s.armLifecycle(token, port), "", d, store, serving, cause, 0)
+}
+
+// supervise restarts the node until it comes back or ctx ends. delay is the
+// wait before the first attempt. id correlates the events when recovering a
+// failed tsnet:start.
+func (s *shim) supervise(ctx context.Context, id string, d startData, store ipn.StateStore, spec servingSpec, cause error, delay time.Duration) {
+	defer s.recoverPanic("supervise")
+	for attempt := 1; ; attempt++ {
+		s.sendEventID(id, "tsnet:recovering", recoveringData{
+			Attempt: attempt, Error: cause.Error(), RetryInSecs: int(delay / time.Second),
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		srv := newTsnetServer(d, store)
+		err := srv.Start()
+		var state ipn.State
+		if err == nil {
+			state, err = awaitSettled(ctx, srv)
+		}
+		if err == nil {
+			if !s.resume(ctx, id, d, srv, spec, attempt, state) {
+				srv.Close() // stopped while the attempt ran
+			}
+			return
+		}
+		srv.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		tsnetLog.Warnf("restart attempt %d for node %q failed: %v", attempt, s.node, err)
+		cause = err
+		delay = min(max(2*delay, recoverBackoffMin), recoverBackoffMax)
+	}
+}
+
+// awaitSettled waits for a freshly started backend to reach Running, or a
+// state only a human can move it on from. NeedsLogin counts only once an
+// AuthURL is out: tsnet passes through it on every start while it logs in
+// with the stored key.
+func awaitSettled(ctx context.Context, srv *tsnet.Server) (ipn.State, error) {
+	lc, err := srv.LocalClient()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, recoverStartTimeout)
+	defer cancel()
+	w, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialState)
+	if err != nil {
+		return 0, err
+	}
+	defer w.Close()
+	var state ipn.State
+	for {
+		n, err := w.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, fmt.Errorf("backend not running after %v", recoverStartTimeout)
+			}
+			return 0, err
+		}
+		// The state decides; an ErrMessage alone is no reason to give up
+		// on the attempt (see applyNotify).
+		if n.ErrMessage != nil {
+			tsnetLog.Warnf("backend error during restart: %s", *n.ErrMessage)
+		}
+		if n.State != nil {
+			state = *n.State
+		}
+		switch {
+		case state == ipn.Running, state == ipn.NeedsMachineAuth:
+			return state, nil
+		case state == ipn.NeedsLogin && n.BrowseToURL != nil && *n.BrowseToURL != "":
+			return state, nil
+		}
+	}
+}
+
+// resume publishes a restarted server, re-arms the lifecycle goroutines, and
+// replays spec once the node is Running. It reports false if the node was
+// stopped in the meantime. The replayed adds are awaited with dispatchMu
+// released, like a serve config apply's.
+func (s *shim) resume(ctx context.Context, id string, d startData, srv *tsnet.Server, spec servingSpec, attempts int, state ipn.State) bool {
+	// Serving state only comes back on a Running node; one that needs a
+	// login reports it through tsnet:authRequired and the core re-adds.
+	var listeners, relays, proxies []func(context.Context) error
+	resumed := func() bool {
+		s.dispatchMu.Lock()
+		defer s.dispatchMu.Unlock()
+		if ctx.Err() != nil {
+			return false
+		}
+		lc, err := srv.LocalClient()
+		if err != nil {
+			return false
+		}
+		s.setServer(srv)
+		s.recovering.Store(false)
+
+		// proxy:add needs dnsName, which watchState would only set later.
+		if status, err := lc.StatusWithoutPeers(ctx); err == nil && status.Self != nil {
+			s.setDNSName(strings.TrimSuffix(status.Self.DNSName, "."))
+		}
+		if d.HeartbeatSecs > 0 {
+			go s.watchHeartbeat(ctx, time.Duration(d.HeartbeatSecs)*time.Second)
+		}
+		go func() {
+			defer s.recoverPanic("watchState")
+			s.watchState(ctx, id, d.Hostname, localStateSource{lc})
+		}()
+
+		if state != ipn.Running {
+			return true
+		}
+		for _, l := range spec.listeners {
+			tid, wait := s.trackAdd("")
+			s.handleListen(tid, mustMarshal(l))
+			listeners = append(listeners, wait)
+		}
+		for _, port := range spec.relays {
+			tid, wait := s.trackAdd("")
+			s.handleListenPacket(tid, mustMarshal(listenPacketData{Port: port}))
+			relays = append(relays, wait)
+		}
+		for _, raw := range spec.proxies {
+			tid, wait := s.trackAdd("")
+			s.handleProxyAdd(tid, raw)
+			proxies = append(proxies, wait)
+		}
+		return true
+	}()
+	if !resumed {
+		return false
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, addOutcomeTimeout)
+	defer cancel()
+	r := recoveredData{Attempts: attempts, State: state.String()}
+	r.Listeners = countRestored(wctx, listeners)
+	r.Relays = countRestored(wctx, relays)
+	r.Proxies = countRestored(wctx, proxies)
+	if ctx.Err() != nil {
+		return true // stopped while the replay finished; teardown closed srv
+	}
+	tsnetLog.Infof("node %q recovered after %d attempt(s)", s.node, attempts)
+	s.sendEventID(id, "tsnet:recovered", r)
+	return true
+}
+
+// countRestored waits for each re-add and counts those now serving; the
+// failures have already reported their own errors.
+func countRestored(ctx context.Context, waits []func(context.Context) error) int {
+	n := 0
+	for _, wait := range waits {
+		if wait(ctx) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// mustMarshal encodes a command payload the sidecar builds itself.
+func mustMarshal(v any) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// ── Add outcomes ────────────────────────────────────────────────────────────
+//
+// tsnet:listen, tsnet:listenPacket and proxy:add finish asynchronously and
+// report only through events. When the sidecar issues them itself — a
+// recovery replaying what the node served, config:apply — it needs to know
+// how each one turned out. trackAdd tags the command's id; sendEventID spots
+// the first outcome event under a tagged id, hands it to the waiter, and
+// routes the event under the original id as usual.
+
+// addOutcomeTimeout bounds the wait for a batch of adds' outcomes, in case a
+// handler dies without reporting one.
+const addOutcomeTimeout = 30 * time.Second
+
+// addTracker holds the waiters for tracked adds without an outcome yet.
+type addTracker struct {
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]chan error
+}
+
+// trackAdd returns the id to issue an add under in place of id, and a func
+// that waits, until ctx ends, for the add's outcome: nil once it is serving,
+// else the error it reported.
+func (s *shim) trackAdd(id string) (string, func(context.Context) error) {
+	t := &s.adds
+	ch := make(chan error, 1)
+	t.mu.Lock()
+	t.next++
+	n := t.next
+	if t.pending == nil {
+		t.pending = make(map[uint64]chan error)
+	}
+	t.pending[n] = ch
+	t.mu.Unlock()
+
+	wait := func(ctx context.Context) error {
+		select {
+		case err := <-ch:
+			return err
+		case <-ctx.Done():
+			t.mu.Lock()
+			delete(t.pending, n)
+			t.mu.Unlock()
+			return errors.New("no result")
+		}
+	}
+	return tagAddID(n, id), wait
+}
+
+// report passes a tracked add's event to its waiter if it is the add's
+// outcome. Later events under the same id (a proxy's SERVE_ERROR, say) find
+// no waiter.
+func (t *addTracker) report(n uint64, eventType string, data interface{}) {
+	var err error
+	switch eventType {
+	case "tsnet:listening", "tsnet:listeningPacket", "proxy:added":
+	case "tsnet:error":
+		d, _ := data.(errorData)
+		err = fmt.Errorf("%s: %s", d.Code, d.Message)
+	case "proxy:error":
+		d, _ := data.(proxyErrorEventData)
+		err = fmt.Errorf("%s: %s", d.Code, d.Message)
+	default:
+		return
+	}
+	t.mu.Lock()
+	ch := t.pending[n]
+	delete(t.pending, n)
+	t.mu.Unlock()
+	if ch != nil {
+		ch <- err
+	}
+}
+
+// tagAddID marks id as tracked add n. Like tagControlID's NUL, the leading
+// SOH never starts an id the core chooses.
+func tagAddID(n uint64, id string) string {
+	return "\x01" + strconv.FormatUint(n, 10) + "\x01" + id
+}
+
+// untagAddID reverses tagAddID; ok is false for an untracked id.
+func untagAddID(id string) (n uint64, orig string, ok bool) {
+	if !strings.HasPrefix(id, "\x01") {
+		return 0, "", false
+	}
+	rest := id[1:]
+	i := strings.IndexByte(rest, 1)
+	if i < 0 {
+		return 0, "", false
+	}
+	n, err := strconv.ParseUint(rest[:i], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return n, rest[i+1:], true
+}
+
+// ── Serve config ────────────────────────────────────────────────────────────
+//
+// A node's dynamic listeners, UDP relays and proxies can be described
+// declaratively in truffle-serve.json in its stateDir, so the core doesn't
+// have to replay every tsnet:listen / tsnet:listenPacket / proxy:add after a
+// restart. The file is optional: when present, tsnet:start restores it once
+// the node first reaches Running, correlated with the start's id.
+//
+// config:apply takes the same document, diffs it against what the node is
+// serving now, and applies only the difference: unchanged entries are left
+// alone (open connections survive), changed ones are removed and re-added.
+// Each change is carried out by the ordinary command handler and reports
+// through its usual events (tsnet:listening, proxy:added, proxy:error, ...)
+// under the apply's id. Once every add has finished, config:applied
+// summarises the diff and lists the entries that failed, and what the node
+// now serves out of the document is written back to the file, so the next
+// start restores it. Applies run one at a time, but other commands aren't
+// held up while an apply's adds finish.
+//
+// A recovery replays what the node was serving, not the file.
+
+// serveConfigFile is the serve config's file name inside the stateDir.
+const serveConfigFile = "truffle-serve.json"
+
+// serveConfig is the serve config document, and the payload for config:apply.
+// Entries use the payloads of the commands that create them.
+type serveConfig struct {
+	Listeners []listenData       `json:"listeners,omitempty"`
+	Relays    []listenPacketData `json:"relays,omitempty"`
+	Proxies   []json.RawMessage  `json:"proxies,omitempty"`
+}
+
+// configAppliedData is the payload for config:applied events.
+type configAppliedData struct {
+	Added     int                 `json:"added"`
+	Removed   int                 `json:"removed"`
+	Changed   int                 `json:"changed"`
+	Unchanged int                 `json:"unchanged"`
+	Failed    []configFailureData `json:"failed,omitempty"` // adds and changes that didn't take
+	Persisted bool                `json:"persisted"`        // written to the stateDir's serve config file
+}
+
+// configFailureData is one serve config entry config:apply could not add.
+type configFailureData struct {
+	Kind  string `json:"kind"`           // listener, relay or proxy
+	Port  uint16 `json:"port,omitempty"` // listener or relay port
+	ID    string `json:"id,omitempty"`   // proxy ID
+	Error string `json:"error"`
+}
+
+// validate checks the document is self-consistent: ports set and unique per
+// kind, proxies well-formed with unique IDs and listen ports. It doesn't
+// check against the running node; the handlers report those conflicts.
+func (c *serveConfig) validate() error {
+	seen := make(map[uint16]bool)
+	for _, l := range c.Listeners {
+		if l.Port == 0 {
+			return errors.New("listener port must be set")
+		}
+		if seen[l.Port] {
+			return fmt.Errorf("duplicate listener port %d", l.Port)
+		}
+		seen[l.Port] = true
+	}
+	clear(seen)
+	for _, r := range c.Relays {
+		if r.Port == 0 {
+			return errors.New("relay port must be set")
+		}
+		if seen[r.Port] {
+			return fmt.Errorf("duplicate relay port %d", r.Port)
+		}
+		seen[r.Port] = true
+	}
+	clear(seen)
+	ids := make(map[string]bool)
+	for i, raw := range c.Proxies {
+		var p proxyAddData
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return fmt.Errorf("proxy %d: %v", i, err)
+		}
+		if p.ID == "" {
+			return fmt.Errorf("proxy %d: id must be set", i)
+		}
+		if ids[p.ID] {
+			return fmt.Errorf("duplicate proxy id %q", p.ID)
+		}
+		if seen[p.ListenPort] {
+			return fmt.Errorf("proxy %q: duplicate listen port %d", p.ID, p.ListenPort)
+		}
+		ids[p.ID], seen[p.ListenPort] = true, true
+	}
+	return nil
+}
+
+// without returns c less the failed entries.
+func (c serveConfig) without(failed []configFailureData) serveConfig {
+	if len(failed) == 0 {
+		return c
+	}
+	ports := map[string]map[uint16]bool{"listener": {}, "relay": {}}
+	ids := make(map[string]bool)
+	for _, f := range failed {
+		if f.Kind == "proxy" {
+			ids[f.ID] = true
+		} else {
+			ports[f.Kind][f.Port] = true
+		}
+	}
+	var out serveConfig
+	for _, l := range c.Listeners {
+		if !ports["listener"][l.Port] {
+			out.Listeners = append(out.Listeners, l)
+		}
+	}
+	for _, r := range c.Relays {
+		if !ports["relay"][r.Port] {
+			out.Relays = append(out.Relays, r)
+		}
+	}
+	for _, raw := range c.Proxies {
+		var p proxyAddData
+		json.Unmarshal(raw, &p) // validated
+		if !ids[p.ID] {
+			out.Proxies = append(out.Proxies, raw)
+		}
+	}
+	return out
+}
+
+// serveDiff is the work to turn one serving state into another. A changed
+// entry appears in both its remove and its add list.
+type serveDiff struct {
+	unlisten    []uint16
+	listen      []listenData
+	unrelay     []uint16
+	relay       []uint16
+	removeProxy []string
+	addProxy    []json.RawMessage
+	counts      configAppliedData
+}
+
+// diffServeConfig works out how to get from current to a validated desired
+// config. Listeners differ by port and TLS, relays by port, and proxies by
+// ID and their proxy:add payload.
+func diffServeConfig(current servingSpec, desired serveConfig) serveDiff {
+	var d serveDiff
+
+	have := make(map[uint16]listenData, len(current.listeners))
+	for _, l := range current.listeners {
+		have[l.Port] = l
+	}
+	for _, l := range desired.Listeners {
+		old, ok := have[l.Port]
+		delete(have, l.Port)
+		switch {
+		case !ok:
+			d.counts.Added++
+		case old == l:
+			d.counts.Unchanged++
+			continue
+		default:
+			d.counts.Changed++
+			d.unlisten = append(d.unlisten, l.Port)
+		}
+		d.listen = append(d.listen, l)
+	}
+	for _, l := range current.listeners {
+		if _, gone := have[l.Port]; gone {
+			d.counts.Removed++
+			d.unlisten = append(d.unlisten, l.Port)
+		}
+	}
+
+	relays := make(map[uint16]bool, len(current.relays))
+	for _, port := range current.relays {
+		relays[port] = true
+	}
+	for _, r := range desired.Relays {
+		if relays[r.Port] {
+			delete(relays, r.Port)
+			d.counts.Unchanged++
+			continue
+		}
+		d.counts.Added++
+		d.relay = append(d.relay, r.Port)
+	}
+	for _, port := range current.relays {
+		if relays[port] {
+			d.counts.Removed++
+			d.unrelay = append(d.unrelay, port)
+		}
+	}
+
+	proxies := make(map[string]proxyAddData, len(current.proxies))
+	var order []string
+	for _, raw := range current.proxies {
+		var p proxyAddData
+		if json.Unmarshal(raw, &p) == nil {
+			proxies[p.ID] = p
+			order = append(order, p.ID)
+		}
+	}
+	for _, raw := range desired.Proxies {
+		var p proxyAddData
+		json.Unmarshal(raw, &p) // validated
+		old, ok := proxies[p.ID]
+		delete(proxies, p.ID)
+		switch {
+		case !ok:
+			d.counts.Added++
+		case reflect.DeepEqual(old, p):
+			d.counts.Unchanged++
+			continue
+		default:
+			d.counts.Changed++
+			d.removeProxy = append(d.removeProxy, p.ID)
+		}
+		d.addProxy = append(d.addProxy, raw)
+	}
+	for _, id := range order {
+		if _, gone := proxies[id]; gone {
+			d.counts.Removed++
+			d.removeProxy = append(d.removeProxy, id)
+		}
+	}
+	return d
+}
+
+func (s *shim) handleConfigApply(id string, data json.RawMessage) {
+	var c serveConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		s.sendErrorID(id, "CONFIG_ERROR", fmt.Sprintf("invalid config:apply data: %v", err))
+		return
+	}
+	if err := c.validate(); err != nil {
+		s.sendErrorID(id, "CONFIG_ERROR", err.Error())
+		return
+	}
+	if s.getServer() == nil {
+		s.sendErrorID(id, "NOT_RUNNING", "node not running")
+		return
+	}
+	if s.draining.Load() {
+		s.sendErrorID(id, "DRAINING", "node is draining; not accepting new listeners")
+		return
+	}
+	ctx := s.lifecycleCtx()
+	go func() {
+		defer s.recoverPanic("handleConfigApply")
+		s.runServeApply(ctx, func() *serveApply {
+			// An earlier apply may have been running while the node
+			// stopped or began draining.
+			if ctx.Err() != nil || s.getServer() == nil {
+				s.sendErrorID(id, "NOT_RUNNING", "node not running")
+				return nil
+			}
+			if s.draining.Load() {
+				s.sendErrorID(id, "DRAINING", "node is draining; not accepting new listeners")
+				return nil
+			}
+			return s.applyServeConfig(id, c, true)
+		})
+	}()
+}
+
+// serveApply is a serve config apply whose adds are in flight.
+type serveApply struct {
+	id      string
+	c       serveConfig
+	persist bool
+	counts  configAppliedData
+	adds    []pendingAdd
+}
+
+// pendingAdd is one tracked add of a serveApply.
+type pendingAdd struct {
+	fail configFailureData // reported if wait fails
+	wait func(context.Context) error
+}
+
+// runServeApply runs an apply under configMu: begin, with dispatchMu held,
+// issues the changes and returns the apply (nil if there is nothing to wait
+// for); its adds are then awaited with dispatchMu released, so heartbeats,
+// tsnet:stop and other commands go on being handled. ctx is the node's
+// lifecycle.
+func (s *shim) runServeApply(ctx context.Context, begin func() *serveApply) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	a := func() *serveApply {
+		s.dispatchMu.Lock()
+		defer s.dispatchMu.Unlock()
+		return begin()
+	}()
+	if a != nil {
+		s.finishServeApply(ctx, a)
+	}
+}
+
+// applyServeConfig reconciles the node's serving state with c, and returns
+// the apply for finishServeApply to complete. The caller holds configMu and
+// dispatchMu.
+func (s *shim) applyServeConfig(id string, c serveConfig, persist bool) *serveApply {
+	d := diffServeConfig(s.servingSpec(), c)
+
+	for _, port := range d.unlisten {
+		s.handleUnlisten(id, mustMarshal(unlistenData{Port: port}))
+	}
+	for _, port := range d.unrelay {
+		s.handleUnlistenPacket(id, mustMarshal(listenPacketData{Port: port}))
+	}
+	// A changed proxy is re-added on the same listen port, so the old one
+	// has to be fully shut down first.
+	var wg sync.WaitGroup
+	s.proxyMu.Lock()
+	for _, pid := range d.removeProxy {
+		entry := s.proxies[pid]
+		delete(s.proxies, pid)
+		if entry == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.recoverPanic("applyServeConfig")
+			entry.shutdown(5 * time.Second)
+			s.sendEventID(id, "proxy:removed", proxyRemovedEventData{ID: pid})
+		}()
+	}
+	s.proxyMu.Unlock()
+	wg.Wait()
+
+	a := &serveApply{id: id, c: c, persist: persist, counts: d.counts}
+	for _, l := range d.listen {
+		tid, wait := s.trackAdd(id)
+		s.handleListen(tid, mustMarshal(l))
+		a.adds = append(a.adds, pendingAdd{configFailureData{Kind: "listener", Port: l.Port}, wait})
+	}
+	for _, port := range d.relay {
+		tid, wait := s.trackAdd(id)
+		s.handleListenPacket(tid, mustMarshal(listenPacketData{Port: port}))
+		a.adds = append(a.adds, pendingAdd{configFailureData{Kind: "relay", Port: port}, wait})
+	}
+	for _, raw := range d.addProxy {
+		var p proxyAddData
+		json.Unmarshal(raw, &p) // validated
+		tid, wait := s.trackAdd(id)
+		s.handleProxyAdd(tid, raw)
+		a.adds = append(a.adds, pendingAdd{configFailureData{Kind: "proxy", ID: p.ID}, wait})
+	}
+	return a
+}
+
+// finishServeApply waits, within one addOutcomeTimeout, for a's adds, then
+// writes the part of its config the node now serves to the serve config
+// file if a.persist is set, and reports config:applied. A node stopped
+// meanwhile (ctx ended) fails the outstanding adds and persists nothing.
+func (s *shim) finishServeApply(ctx context.Context, a *serveApply) {
+	wctx, cancel := context.WithTimeout(ctx, addOutcomeTimeout)
+	defer cancel()
+	for _, add := range a.adds {
+		if err := add.wait(wctx); err != nil {
+			add.fail.Error = err.Error()
+			a.counts.Failed = append(a.counts.Failed, add.fail)
+		}
+	}
+	c := a.c.without(a.counts.Failed)
+
+	if a.persist && ctx.Err() == nil {
+		s.serverMu.RLock()
+		dir := s.stateDir
+		s.serverMu.RUnlock()
+		if dir != "" {
+			if err := writeServeConfig(dir, c); err != nil {
+				sidecarLog.Warnf("persist serve config: %v", err)
+			} else {
+				a.counts.Persisted = true
+			}
+		}
+	}
+	s.sendEventID(a.id, "config:applied", a.counts)
+}
+
+// restoreServeConfig applies the stateDir's serve config file, if any, to a
+// node that has just started, returning the apply to finish (nil if there's
+// none). id is the tsnet:start's. The caller holds configMu and dispatchMu.
+func (s *shim) restoreServeConfig(id string) *serveApply {
+	s.serverMu.RLock()
+	dir := s.stateDir
+	s.serverMu.RUnlock()
+	c, err := readServeConfig(dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		s.sendErrorID(id, "CONFIG_ERROR", err.Error())
+		return nil
+	}
+	tsnetLog.Infof("restoring serve config for node %q", s.node)
+	return s.applyServeConfig(id, c, false)
+}
+
+// readServeConfig loads and validates the serve config file in dir.
+func readServeConfig(dir string) (serveConfig, error) {
+	var c serveConfig
+	b, err := os.ReadFile(filepath.Join(dir, serveConfigFile))
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("%s: %v", serveConfigFile, err)
+	}
+	if err := c.validate(); err != nil {
+		return c, fmt.Errorf("%s: %v", serveConfigFile, err)
+	}
+	return c, nil
+}
+
+// writeServeConfig replaces the serve config file in dir atomically, so a
+// crash mid-write can't leave a torn file for the next start.
+func writeServeConfig(dir string, c serveConfig) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, serveConfigFile+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, serveConfigFile))
+}
+
+// ── Start queue ─────────────────────────────────────────────────────────────
+//
+// Serving commands need a Running node: during startup they fail with
+// NOT_RUNNING (no server yet) or NOT_READY (no dnsName yet), so the core has
+// to hold them until tsnet:started. A tsnet:start with queueUntilRunning
+// makes the sidecar hold them instead. Each queued command is acknowledged
+// with tsnet:queued and runs, in arrival order and with its own id, right
+// after the node first reaches Running (after the serve config is restored).
+// If the start fails or the node is stopped first, every queued command gets
+// a tsnet:error with code QUEUE_ABORTED.
+//
+// Only the first start is queued for; once Running, commands run directly.
+
+// maxQueuedCommands bounds the start queue; further commands get QUEUE_FULL.
+const maxQueuedCommands = 256
+
+// queueableCommands are the serving commands a start queue holds back.
+var queueableCommands = map[string]bool{
+	"tsnet:listen":         true,
+	"tsnet:unlisten":       true,
+	"tsnet:listenPacket":   true,
+	"tsnet:unlistenPacket": true,
+	"proxy:add":            true,
+	"proxy:remove":         true,
+	"config:apply":         true,
+}
+
+// queuedData is the payload for tsnet:queued events.
+type queuedData struct {
+	Command  string `json:"command"`
+	Position int    `json:"position"` // 1-based place in the queue
+}
+
+// enqueue holds cmd back if s is starting with a start queue, and reports
+// whether it did.
+func (s *shim) enqueue(cmd command) bool {
+	if !queueableCommands[cmd.Command] {
+		return false
+	}
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if !s.queueing {
+		return false
+	}
+	if len(s.queue) >= maxQueuedCommands {
+		s.sendErrorID(cmd.ID, "QUEUE_FULL", fmt.Sprintf("start queue holds at most %d commands", maxQueuedCommands))
+		return true
+	}
+	s.queue = append(s.queue, cmd)
+	s.sendEventID(cmd.ID, "tsnet:queued", queuedData{Command: cmd.Command, Position: len(s.queue)})
+	return true
+}
+
+// queued reports whether a start queue is active.
+func (s *shim) queued() bool {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	return s.queueing
+}
+
+// takeQueue ends the start queue and returns what it held.
+func (s *shim) takeQueue() []command {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	q := s.queue
+	s.queueing, s.queue = false, nil
+	return q
+}
+
+// abortQueue ends the start queue, failing every command it held.
+func (s *shim) abortQueue(reason string) {
+	for _, cmd := range s.takeQueue() {
+		s.sendErrorID(cmd.ID, "QUEUE_ABORTED", fmt.Sprintf("queued %s not run: %s", cmd.Command, reason))
+	}
+}
+
+// finishStart runs the work deferred until a started node is Running:
+// restoring the serve config file (if restore) and then the start queue. The
+// restore's adds are awaited afterwards, with dispatchMu released.
+func (s *shim) finishStart(ctx context.Context, id string, restore bool) {
+	defer s.recoverPanic("finishStart")
+	s.runServeApply(ctx, func() *serveApply {
+		if ctx.Err() != nil {
+			return nil
+		}
+		var a *serveApply
+		if restore {
+			a = s.restoreServeConfig(id)
+		}
+		for _, cmd := range s.takeQueue() {
+			s.handleCommand(cmd)
+		}
+		return a
+	})
+}
+
+// ── Bridge multiplexing ─────────────────────────────────────────────────────
+//
+// By default every bridged connection dials bridgePort afresh and writes an
+// RFC 003 header, so a connection storm costs an ephemeral port and an fd on
+// both sides per connection. A tsnet:start with bridgeMuxConns instead keeps
+// that many persistent connections to the core and carries each bridged
+// connection as a logical stream on one of them (least-loaded first). The
+// connections are dialled lazily and redialled after a failure.
+//
+// A mux connection opens with a preamble the v1 header parser rejects:
+//
+//	[u32 magic "TRFF"][u8 0x4D 'M'][32-byte session token]
+//
+// and then carries frames in both directions:
+//
+//	[u8 type][u32 stream ID][u32 payload length][payload]
+//
+//	OPEN   (1) sidecar → core: opens a stream; payload is its RFC 003 header
+//	DATA   (2) stream bytes, at most muxMaxFrame per frame
+//	WINDOW (3) u32: the receiver has consumed that many more bytes
+//	FIN    (4) the sender won't write to the stream again (half close)
+//	RESET  (5) abort the stream in both directions; its ID is dead
+//
+// Only the sidecar opens streams; IDs count up from 1 per connection. Each
+// direction of a stream may have at most muxInitialWindow bytes unconsumed:
+// a sender stops at zero window until a WINDOW frame credits it, so one slow
+// stream can't stall the rest of its connection. A receiver credits back
+// once half the window is consumed. A stream is done after FIN both ways, or
+// a RESET either way. A protocol violation drops the whole connection.
+//
+// muxSession implements both ends (the accept side is the core's role), so
+// the protocol can be tested and benchmarked from Go.
+
+const (
+	muxVersion       = 0x4D // 'M': preamble version byte, never a header version
+	muxMaxConns      = 8
+	muxInitialWindow = 256 << 10
+	muxMaxFrame      = 32 << 10 // max DATA payload
+	muxMaxOpen       = 256 << 10
+	muxWriteTimeout  = 30 * time.Second
+
+	muxFrameOpen   = 0x01
+	muxFrameData   = 0x02
+	muxFrameWindow = 0x03
+	muxFrameFin    = 0x04
+	muxFrameReset  = 0x05
+)
+
+var (
+	errMuxClosed = errors.New("mux connection closed")
+	errMuxReset  = errors.New("mux stream reset")
+)
+
+// muxSession is one multiplexed bridge connection.
+type muxSession struct {
+	conn net.Conn
+	wmu  sync.Mutex // serializes frame writes
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error // why the session ended
+
+	accepted chan *muxStream // peer-opened streams; nil unless accepting
+	done     chan struct{}
+	once     sync.Once
+}
+
+// newMuxSession runs the mux protocol over conn, whose preamble has already
+// been exchanged. accept sets the core's role: taking streams the peer
+// opens.
+func newMuxSession(conn net.Conn, accept bool) *muxSession {
+	m := &muxSession{
+		conn:    conn,
+		streams: make(map[uint32]*muxStream),
+		done:    make(chan struct{}),
+	}
+	if accept {
+		m.accepted = make(chan *muxStream, 64)
+	}
+	go m.readLoop()
+	return m
+}
+
+// writeMuxPreamble starts a mux connection.
+func writeMuxPreamble(w io.Writer, token []byte) error {
+	buf := make([]byte, 4+1+32)
+	binary.BigEndian.PutUint32(buf, headerMagic)
+	buf[4] = muxVersion
+	copy(buf[5:], token)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readMuxPreamble checks a mux connection's preamble against token.
+func readMuxPreamble(r io.Reader, token []byte) error {
+	buf := make([]byte, 4+1+32)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(buf) != headerMagic || buf[4] != muxVersion {
+		return errors.New("not a mux preamble")
+	}
+	if subtle.ConstantTimeCompare(buf[5:], token) != 1 {
+		return errors.New("bad session token")
+	}
+	return nil
+}
+
+// open starts a stream whose OPEN frame carries header.
+func (m *muxSession) open(header []byte) (*muxStream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	m.nextID++
+	st := newMuxStream(m, m.nextID, nil)
+	m.streams[st.id] = st
+	m.mu.Unlock()
+	if err := m.writeFrame(muxFrameOpen, st.id, header); err != nil {
+		m.remove(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// accept returns the next stream the peer opened; its header is the OPEN
+// payload.
+func (m *muxSession) accept() (*muxStream, error) {
+	select {
+	case st := <-m.accepted:
+		return st, nil
+	case <-m.done:
+		return nil, m.closeErr()
+	}
+}
+
+// load is the number of live streams.
+func (m *muxSession) load() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.streams)
+}
+
+func (m *muxSession) closed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *muxSession) closeErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// close ends the session and resets every stream on it.
+func (m *muxSession) close(err error) {
+	m.once.Do(func() {
+		m.mu.Lock()
+		m.err = err
+		streams := m.streams
+		m.streams = make(map[uint32]*muxStream)
+		m.mu.Unlock()
+		for _, st := range streams {
+			st.setReset()
+		}
+		m.conn.Close()
+		close(m.done)
+	})
+}
+
+func (m *muxSession) stream(id uint32) *muxStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+func (m *muxSession) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+// writeFrame sends one frame; a failed write ends the session.
+func (m *muxSession) writeFrame(typ byte, id uint32, payload []byte) error {
+	var hdr [9]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], id)
+	binary.BigEndian.PutUint32(hdr[5:], uint32(len(payload)))
+
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	if m.closed() {
+		return m.closeErr()
+	}
+	_ = m.conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+	bufs := net.Buffers{hdr[:], payload}
+	if _, err := bufs.WriteTo(m.conn); err != nil {
+		m.close(fmt.Errorf("mux write: %w", err))
+		return err
+	}
+	return nil
+}
+
+// readLoop demultiplexes incoming frames until the connection fails.
+func (m *muxSession) readLoop() {
+	defer func() {
+		if r := recover(); r != nil {
+			m.close(fmt.Errorf("mux read panic: %v", r))
+		}
+	}()
+	var hdr [9]byte
+	for {
+		if _, err := io.ReadFull(m.conn, hdr[:]); err != nil {
+			m.close(errMuxClosed)
+			return
+		}
+		typ, id, n := hdr[0], binary.BigEndian.Uint32(hdr[1:]), binary.BigEndian.Uint32(hdr[5:])
+		if (typ == muxFrameOpen && n > muxMaxOpen) || (typ != muxFrameOpen && n > muxMaxFrame) {
+			m.close(fmt.Errorf("mux: %d-byte frame of type %d", n, typ))
+			return
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(m.conn, payload); err != nil {
+			m.close(errMuxClosed)
+			return
+		}
+		if err := m.handleFrame(typ, id, payload); err != nil {
+			bridgeLog.Warnf("mux protocol error: %v", err)
+			m.close(err)
+			return
+		}
+	}
+}
+
+func (m *muxSession) handleFrame(typ byte, id uint32, payload []byte) error {
+	if typ == muxFrameOpen {
+		if m.accepted == nil {
+			return errors.New("mux: peer opened a stream")
+		}
+		m.mu.Lock()
+		if _, dup := m.streams[id]; dup || id == 0 {
+			m.mu.Unlock()
+			return fmt.Errorf("mux: bad stream ID %d", id)
+		}
+		st := newMuxStream(m, id, payload)
+		m.streams[id] = st
+		m.mu.Unlock()
+		select {
+		case m.accepted <- st:
+		case <-m.done:
+		}
+		return nil
+	}
+
+	// Frames for a stream that's gone (reset or closed here) are in flight
+	// from before the peer learned of it.
+	st := m.stream(id)
+	if st == nil {
+		return nil
+	}
+	switch typ {
+	case muxFrameData:
+		st.mu.Lock()
+		over := len(st.buf)+st.unacked+len(payload) > muxInitialWindow
+		if !over && !st.finRecv {
+			st.buf = append(st.buf, payload...)
+		}
+		st.mu.Unlock()
+		if over {
+			return fmt.Errorf("mux: stream %d overran its window", id)
+		}
+		st.kick(st.readable)
+	case muxFrameWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("mux: %d-byte WINDOW", len(payload))
+		}
+		st.mu.Lock()
+		st.sendWindow += int(binary.BigEndian.Uint32(payload))
+		st.mu.Unlock()
+		st.kick(st.writable)
+	case muxFrameFin:
+		st.mu.Lock()
+		st.finRecv = true
+		st.mu.Unlock()
+		st.kick(st.readable)
+	case muxFrameReset:
+		m.remove(id)
+		st.setReset()
+	default:
+		return fmt.Errorf("mux: unknown frame type %d", typ)
+	}
+	return nil
+}
+
+// muxStream is one logical connection on a muxSession. It is a net.Conn, so
+// bridgeCopy treats it like a dialled bridge connection; CloseWrite sends
+// FIN. Deadlines bound the waits for data and window.
+type muxStream struct {
+	sess   *muxSession
+	id     uint32
+	header []byte // OPEN payload, on accepted streams
+
+	mu         sync.Mutex
+	buf        []byte // received, not yet read
+	unacked    int    // read but not yet credited back
+	sendWindow int
+	finSent    bool
+	finRecv    bool
+	reset      bool
+	closed     bool
+	rdeadline  time.Time
+	wdeadline  time.Time
+
+	// readable and writable wake a blocked Read or Write; cap 1.
+	readable chan struct{}
+	writable chan struct{}
+}
+
+func newMuxStream(m *muxSession, id uint32, header []byte) *muxStream {
+	return &muxStream{
+		sess: m, id: id, header: header,
+		sendWindow: muxInitialWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+func (st *muxStream) kick(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (st *muxStream) setReset() {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+	st.kick(st.readable)
+	st.kick(st.writable)
+}
+
+// wait blocks until ch is kicked, the deadline passes, or the session ends.
+func (st *muxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.sess.done:
+		return nil // close reset the stream; the caller sees it
+	}
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		case len(st.buf) > 0:
+			n := copy(p, st.buf)
+			st.buf = st.buf[n:]
+			st.unacked += n
+			var credit int
+			if st.unacked >= muxInitialWindow/2 && !st.reset {
+				credit, st.unacked = st.unacked, 0
+			}
+			st.mu.Unlock()
+			if credit > 0 {
+				var b [4]byte
+				binary.BigEndian.PutUint32(b[:], uint32(credit))
+				st.sess.writeFrame(muxFrameWindow, st.id, b[:])
+			}
+			return n, nil
+		case st.reset:
+			st.mu.Unlock()
+			return 0, errMuxReset
+		case st.finRecv:
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.rdeadline
+		st.mu.Unlock()
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		case st.reset:
+			st.mu.Unlock()
+			return written, errMuxReset
+		case st.finSent:
+			st.mu.Unlock()
+			return written, errors.New("mux stream: write after CloseWrite")
+		}
+		n := min(len(p), st.sendWindow, muxMaxFrame)
+		if n == 0 {
+			deadline := st.wdeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		st.sendWindow -= n
+		st.mu.Unlock()
+		if err := st.sess.writeFrame(muxFrameData, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the stream with a FIN.
+func (st *muxStream) CloseWrite() error {
+	st.mu.Lock()
+	if st.finSent || st.reset || st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.mu.Unlock()
+	return st.sess.writeFrame(muxFrameFin, st.id, nil)
+}
+
+// Close frees the stream, resetting it unless both sides already sent FIN.
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	graceful := st.reset || (st.finSent && st.finRecv)
+	st.mu.Unlock()
+	st.kick(st.readable)
+	st.kick(st.writable)
+	st.sess.remove(st.id)
+	if !graceful {
+		st.sess.writeFrame(muxFrameReset, st.id, nil)
+	}
+	return nil
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.sess.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.sess.conn.RemoteAddr() }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.rdeadline = t
+	st.mu.Unlock()
+	st.kick(st.readable) // re-arm a blocked Read's timer
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.wdeadline = t
+	st.mu.Unlock()
+	st.kick(st.writable)
+	return nil
+}
+
+// muxPool holds a node's mux connections to the core.
+type muxPool struct {
+	s *shim
+	// connect dials the core; s.dialCore to the bridge port outside tests.
+	connect func() (net.Conn, error)
+
+	mu       sync.Mutex
+	sessions []*muxSession // nil until first needed
+	dialling []bool        // slot reserved by an open dialling it
+	dialled  chan struct{} // closed and replaced when a dial finishes
+	gen      uint64        // bumped by closeAll, so a dial in flight is dropped
+}
+
+func newMuxPool(s *shim, conns int) *muxPool {
+	p := &muxPool{
+		s:        s,
+		sessions: make([]*muxSession, conns),
+		dialling: make([]bool, conns),
+		dialled:  make(chan struct{}),
+	}
+	p.connect = func() (net.Conn, error) {
+		_, bridgePort := s.bridgeParams()
+		return s.dialCore(bridgePort)
+	}
+	return p
+}
+
+func (s *shim) bridgeMux() *muxPool {
+	s.serverMu.RLock()
+	defer s.serverMu.RUnlock()
+	return s.mux
+}
+
+// open starts a stream on the least-loaded connection. A busy pool with a
+// slot that is empty, or whose connection has failed, dials that slot first.
+// The dial runs outside p.mu with the slot reserved, so other opens keep
+// using the live connections meanwhile.
+func (p *muxPool) open(header []byte) (*muxStream, error) {
+	p.mu.Lock()
+	for {
+		best, free := -1, -1
+		for i, m := range p.sessions {
+			switch {
+			case p.dialling[i]:
+			case m == nil || m.closed():
+				if free < 0 {
+					free = i
+				}
+			case best < 0 || m.load() < p.sessions[best].load():
+				best = i
+			}
+		}
+		if free >= 0 && (best < 0 || p.sessions[best].load() > 0) {
+			return p.dialSlot(free, header)
+		}
+		if best >= 0 {
+			m := p.sessions[best]
+			p.mu.Unlock()
+			return m.open(header)
+		}
+		// Every slot is being dialled: wait for one to finish.
+		dialled := p.dialled
+		p.mu.Unlock()
+		<-dialled
+		p.mu.Lock()
+	}
+}
+
+// dialSlot dials slot i and opens the stream on the new connection. The
+// caller holds p.mu, which is released.
+func (p *muxPool) dialSlot(i int, header []byte) (*muxStream, error) {
+	p.dialling[i] = true
+	gen := p.gen
+	p.mu.Unlock()
+
+	m, err := p.dial()
+
+	p.mu.Lock()
+	p.dialling[i] = false
+	close(p.dialled)
+	p.dialled = make(chan struct{})
+	if err == nil && gen != p.gen {
+		m.close(errMuxClosed)
+		err = errMuxClosed
+	}
+	if err == nil {
+		p.sessions[i] = m
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return m.open(header)
+}
+
+func (p *muxPool) dial() (*muxSession, error) {
+	token, _ := p.s.bridgeParams()
+	conn, err := p.connect()
+	if err != nil {
+		return nil, fmt.Errorf("bridge connect failed: %v", err)
+	}
+	if err := writeMuxPreamble(conn, token); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mux preamble write failed: %v", err)
+	}
+	bridgeLog.Debugf("mux: connected to core %s", conn.RemoteAddr())
+	return newMuxSession(conn, false), nil
+}
+
+// closeAll drops every connection; later opens redial.
+func (p *muxPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gen++
+	for i, m := range p.sessions {
+		if m != nil {
+			m.close(errMuxClosed)
+			p.sessions[i] = nil
+		}
+	}
+}
+
+// ── Bridge socket ───────────────────────────────────────────────────────────
+//
+// Any local process can connect to a loopback TCP bridgePort; only the
+// session token in the header keeps it out. A tsnet:start with bridgeSocket
+// has the bridge dial the core's Unix socket instead, so the filesystem
+// gates who can reach it. The socket must exist at start, and (outside
+// Windows) must not be writable, i.e. connectable, by group or others.
+// Each connection also checks that the process answering runs as our own
+// user, via SO_PEERCRED (LOCAL_PEERCRED on macOS), where the platform has
+// it. The bridge header and framing are the same on either transport.
+
+var errPeerCredUnsupported = errors.New("peer credentials not supported on this platform")
+
+// checkBridgeSocket vets a bridgeSocket path at tsnet:start.
+func checkBridgeSocket(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("bridgeSocket %q must be an absolute path", path)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("bridgeSocket: %v", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("bridgeSocket %q is not a socket", path)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("bridgeSocket %q is writable by group or others (mode %v); restrict it to the owner", path, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// dialCore connects to the core's bridge listener: its Unix socket when
+// tsnet:start named one, else 127.0.0.1:bridgePort.
+func (s *shim) dialCore(bridgePort uint16) (net.Conn, error) {
+	s.serverMu.RLock()
+	path := s.bridgeSocket
+	s.serverMu.RUnlock()
+	if path == "" {
+		return net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", bridgePort), coreDialTimeout)
+	}
+
+	conn, err := net.DialTimeout("unix", path, coreDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := peerUID(conn.(*net.UnixConn))
+	switch {
+	case errors.Is(err, errPeerCredUnsupported):
+	case err != nil:
+		conn.Close()
+		return nil, fmt.Errorf("bridge peer credentials: %v", err)
+	case int64(uid) != int64(os.Getuid()):
+		conn.Close()
+		return nil, fmt.Errorf("bridge socket peer runs as uid %d, not ours (%d)", uid, os.Getuid())
+	}
+	return conn, nil
+}
+
+// ── Bridge header v2 ────────────────────────────────────────────────────────
+//
+// The v1 header has a fixed set of fields, and peer identity rides as JSON
+// in RemoteDNSName under a 4 KiB cap, losing optional fields when it won't
+// fit. Header v2 keeps v1's fixed prefix (with version 2) and follows it with
+// a block of typed fields:
+//
+//	[u32 magic][u8 2][32-byte token][u8 direction][u16 port]
+//	[u32 fields length] fields...
+//	field: [u16 type][u16 length][value]
+//
+// Strings are UTF-8; integers are big-endian. A reader skips field types it
+// doesn't know, so fields can be added without a version bump. A field may
+// repeat only where noted. The core opts in with tsnet:start
+// bridgeHeaderVersion 2 once sidecar:hello lists bridgeHeaderV2; anything
+// else keeps v1, as does an older sidecar that ignores the option.
+//
+// Identity, tags and the path come from a WhoIs (and, for the path, a
+// status) lookup per connection, for both directions. An incoming TLS
+// connection is handshaken before the header goes out so SNI and ALPN are
+// known; one that fails its handshake is dropped.
+
+// Header v2 field types.
+const (
+	hdrFieldRequestID   = 0x0001 // bridge:dial requestId
+	hdrFieldRemoteAddr  = 0x0002
+	hdrFieldTarget      = 0x0003 // outgoing: the dialled name
+	hdrFieldPeerDNSName = 0x0010
+	hdrFieldPeerLogin   = 0x0011
+	hdrFieldPeerName    = 0x0012 // display name
+	hdrFieldPeerPicture = 0x0013
+	hdrFieldPeerNodeID  = 0x0014
+	hdrFieldPeerTag     = 0x0015 // repeated, one per ACL tag
+	hdrFieldTLSSNI      = 0x0020
+	hdrFieldTLSALPN     = 0x0021
+	hdrFieldListenerID  = 0x0030 // u32, from tsnet:listening
+	hdrFieldConnID      = 0x0031 // u64, unique per sidecar process
+	hdrFieldPath        = 0x0032 // u8 pathDirect / pathDERP
+)
+
+// Path types for hdrFieldPath.
+const (
+	pathDirect = 0x01
+	pathDERP   = 0x02
+)
+
+const (
+	// maxHeaderV2Fields bounds a v2 header's field block.
+	maxHeaderV2Fields = 64 << 10
+	// tlsHandshakeTimeout bounds the handshake of an incoming TLS
+	// connection whose SNI/ALPN a v2 header reports.
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// bridgeMeta is what a bridge header says about one connection.
+type bridgeMeta struct {
+	direction  byte
+	port       uint16
+	requestID  string
+	remoteAddr string
+	target     string           // outgoing: the dialled name
+	identity   peerIdentityData // zero when WhoIs found nothing
+
+	// Header v2 only.
+	tags       []string
+	sni, alpn  string
+	listenerID uint32 // 0 for outgoing
+	connID     uint64
+	path       byte // 0 when unknown
+}
+
+func (s *shim) bridgeHeaderVersion() byte {
+	s.serverMu.RLock()
+	defer s.serverMu.RUnlock()
+	return max(s.headerVersion, headerVersion)
+}
+
+// writeHeader writes m as a header of the given version.
+func (m *bridgeMeta) writeHeader(w io.Writer, token []byte, version byte) error {
+	if version >= headerVersion2 {
+		return m.writeHeaderV2(w, token)
+	}
+	// v1 carries either the dialled name or the identity JSON.
+	remoteDNS := m.target
+	if m.direction == dirIncoming && m.identity != (peerIdentityData{}) {
+		remoteDNS = marshalPeerIdentity(m.identity)
+	}
+	return writeHeader(w, token, m.direction, m.port, m.requestID, m.remoteAddr, remoteDNS)
+}
+
+// writeHeaderV2 writes m as a v2 header. Empty fields are left out.
+func (m *bridgeMeta) writeHeaderV2(w io.Writer, token []byte) error {
+	var fields []byte
+	var tooLong error
+	str := func(typ uint16, v string) {
+		if v == "" {
+			return
+		}
+		if len(v) > 0xFFFF {
+			tooLong = fmt.Errorf("bridge header field %#04x is %d bytes", typ, len(v))
+			return
+		}
+		fields = binary.BigEndian.AppendUint16(fields, typ)
+		fields = binary.BigEndian.AppendUint16(fields, uint16(len(v)))
+		fields = append(fields, v...)
+	}
+	str(hdrFieldRequestID, m.requestID)
+	str(hdrFieldRemoteAddr, m.remoteAddr)
+	str(hdrFieldTarget, m.target)
+	str(hdrFieldPeerDNSName, m.identity.DNSName)
+	str(hdrFieldPeerLogin, m.identity.LoginName)
+	str(hdrFieldPeerName, m.identity.DisplayName)
+	str(hdrFieldPeerPicture, m.identity.ProfilePicURL)
+	str(hdrFieldPeerNodeID, m.identity.NodeID)
+	for _, tag := range m.tags {
+		str(hdrFieldPeerTag, tag)
+	}
+	str(hdrFieldTLSSNI, m.sni)
+	str(hdrFieldTLSALPN, m.alpn)
+	if m.listenerID != 0 {
+		fields = binary.BigEndian.AppendUint16(fields, hdrFieldListenerID)
+		fields = binary.BigEndian.AppendUint16(fields, 4)
+		fields = binary.BigEndian.AppendUint32(fields, m.listenerID)
+	}
+	if m.connID != 0 {
+		fields = binary.BigEndian.AppendUint16(fields, hdrFieldConnID)
+		fields = binary.BigEndian.AppendUint16(fields, 8)
+		fields = binary.BigEndian.AppendUint64(fields, m.connID)
+	}
+	if m.path != 0 {
+		fields = binary.BigEndian.AppendUint16(fields, hdrFieldPath)
+		fields = binary.BigEndian.AppendUint16(fields, 1)
+		fields = append(fields, m.path)
+	}
+	if tooLong != nil {
+		return tooLong
+	}
+	if len(fields) > maxHeaderV2Fields {
+		return fmt.Errorf("bridge header fields are %d bytes, over the %d cap", len(fields), maxHeaderV2Fields)
+	}
+
+	buf := make([]byte, 0, 4+1+32+1+2+4+len(fields))
+	buf = binary.BigEndian.AppendUint32(buf, headerMagic)
+	buf = append(buf, headerVersion2)
+	buf = append(buf, token...)
+	buf = append(buf, m.direction)
+	buf = binary.BigEndian.AppendUint16(buf, m.port)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(fields)))
+	buf = append(buf, fields...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// describePeer fills in m's peer details for the connection c. A v1 header
+// only needs an incoming peer's identity; v2 also reports tags, the path
+// and TLS details. The error is a failed TLS handshake.
+func (s *shim) describePeer(lc *tailscale.LocalClient, c net.Conn, m *bridgeMeta) error {
+	v2 := s.bridgeHeaderVersion() >= headerVersion2
+	ctx, cancel := context.WithTimeout(s.lifecycleCtx(), whoisTimeout)
+	defer cancel()
+	whois, err := lc.WhoIs(ctx, c.RemoteAddr().String())
+	if err != nil {
+		bridgeLog.Warnf("describePeer: WhoIs(%s) failed: %v", c.RemoteAddr(), err)
+	} else {
+		m.identity = identityFromWhoIs(whois)
+		if v2 && whois.Node != nil {
+			m.tags = whois.Node.Tags
+			m.path = s.peerPath(whois.Node.Key, func() (*ipnstate.Status, error) { return lc.Status(ctx) })
+		}
+	}
+	if !v2 {
+		return nil
+	}
+	if tc, ok := c.(*tls.Conn); ok {
+		hctx, cancel := context.WithTimeout(s.lifecycleCtx(), tlsHandshakeTimeout)
+		defer cancel()
+		if err := tc.HandshakeContext(hctx); err != nil {
+			return fmt.Errorf("TLS handshake: %v", err)
+		}
+		cs := tc.ConnectionState()
+		m.sni, m.alpn = cs.ServerName, cs.NegotiatedProtocol
+	}
+	return nil
+}
+
+// pathCacheTTL bounds how stale a bridge header's path may be. A path
+// mostly changes once, when a DERP-relayed peer goes direct.
+const pathCacheTTL = 5 * time.Second
+
+// peerPath reports whether traffic to the peer goes direct or via DERP, or
+// 0 if it can't tell. It answers from pathCache, calling status to refresh
+// it when stale.
+func (s *shim) peerPath(nodeKey key.NodePublic, status func() (*ipnstate.Status, error)) byte {
+	now := time.Now()
+	s.pathCacheMu.Lock()
+	if now.Sub(s.pathCacheAt) < pathCacheTTL {
+		path := s.pathCache[nodeKey]
+		s.pathCacheMu.Unlock()
+		return path
+	}
+	s.pathCacheMu.Unlock()
+
+	st, err := status()
+	if err != nil {
+		return 0
+	}
+	paths := make(map[key.NodePublic]byte, len(st.Peer))
+	for k, ps := range st.Peer {
+		switch {
+		case ps.CurAddr != "":
+			paths[k] = pathDirect
+		case ps.Relay != "":
+			paths[k] = pathDERP
+		}
+	}
+
+	s.pathCacheMu.Lock()
+	s.pathCache, s.pathCacheAt = paths, now
+	s.pathCacheMu.Unlock()
+	return paths[nodeKey]
+}
+
+// ── Bridge accept acknowledgement ───────────────────────────────────────────
+//
+// Writing the header only proves the bytes reached a socket, not that the
+// core took the stream: it may have refused the session token or have no
+// listener for the port, and the dialling side never hears of it. With
+// tsnet:start bridgeAck, the core answers every header (or mux OPEN) with a
+// single byte before any stream data:
+//
+//	0x00 accepted
+//	0x01 rejected: bad session token
+//	0x02 rejected: no listener for the port
+//	else rejected for another reason
+//
+// The sidecar waits up to bridgeAckTimeout for it. Only then does bridge:dial
+// report success on bridge:dialResult; a rejection or missing ack reports
+// failure with a code saying which. A rejected incoming connection is
+// closed.
+
+const bridgeAckTimeout = 5 * time.Second
+
+// Core verdicts on a bridge header.
+const (
+	bridgeAckAccepted    = 0x00
+	bridgeAckBadToken    = 0x01
+	bridgeAckUnknownPort = 0x02
+)
+
+// bridgeAckError is a bridge the core didn't accept. code is the
+// bridge:dialResult code.
+type bridgeAckError struct {
+	code string
+	msg  string
+}
+
+func (e *bridgeAckError) Error() string { return e.msg }
+
+func (s *shim) bridgeAckEnabled() bool {
+	s.serverMu.RLock()
+	defer s.serverMu.RUnlock()
+	return s.bridgeAck
+}
+
+// awaitBridgeAck reads the core's verdict on the header just written to c.
+func awaitBridgeAck(c net.Conn) error {
+	_ = c.SetReadDeadline(time.Now().Add(bridgeAckTimeout))
+	var b [1]byte
+	_, err := io.ReadFull(c, b[:])
+	_ = c.SetReadDeadline(time.Time{})
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return &bridgeAckError{"BRIDGE_ACK_TIMEOUT", fmt.Sprintf("core did not acknowledge the bridge within %v", bridgeAckTimeout)}
+	case err != nil:
+		return &bridgeAckError{"BRIDGE_ACK_FAILED", fmt.Sprintf("core closed the bridge before acknowledging: %v", err)}
+	}
+	switch b[0] {
+	case bridgeAckAccepted:
+		return nil
+	case bridgeAckBadToken:
+		return &bridgeAckError{"BRIDGE_REJECTED_TOKEN", "core rejected the bridge: bad session token"}
+	case bridgeAckUnknownPort:
+		return &bridgeAckError{"BRIDGE_REJECTED_PORT", "core rejected the bridge: no listener for the port"}
+	}
+	return &bridgeAckError{"BRIDGE_REJECTED", fmt.Sprintf("core rejected the bridge (verdict %#02x)", b[0])}
+}
+
+// ── Bridged connections ─────────────────────────────────────────────────────
+//
+// Every connection the core accepts is registered under its connId (the same
+// ID header v2 carries) until its copy loop ends. bridge:list reports the
+// live ones with byte counts and idle time, bridge:close tears one down, and
+// bridge:closed reports each one as it goes, with its final counts and why:
+//
+//	eof    both sides finished
+//	idle   reaped after idleTimeout with no traffic
+//	error  a read or write failed (error says what)
+//	closed closed by bridge:close
+//	stop   the node stopped
+//
+// Bytes are counted on the tailnet side: bytesIn came from the peer,
+// bytesOut went to it.
+
+const (
+	closeReasonEOF    = "eof"
+	closeReasonIdle   = "idle"
+	closeReasonError  = "error"
+	closeReasonClosed = "closed"
+	closeReasonStop   = "stop"
+)
+
+// bridgeConnInfo is one entry in a bridge:list event.
+type bridgeConnInfo struct {
+	ConnID     uint64            `json:"connId"`
+	Port       uint16            `json:"port"`
+	Direction  string            `json:"direction"` // "incoming" or "outgoing"
+	RemoteAddr string            `json:"remoteAddr"`
+	RequestID  string            `json:"requestId,omitempty"`
+	Target     string            `json:"target,omitempty"`
+	Peer       *peerIdentityData `json:"peer,omitempty"`
+	AgeSecs    float64           `json:"ageSecs"`
+	BytesIn    int64             `json:"bytesIn"`
+	BytesOut   int64             `json:"bytesOut"`
+	IdleSecs   float64           `json:"idleSecs"`
+}
+
+// bridgeListData is the payload for bridge:list events.
+type bridgeListData struct {
+	Connections []bridgeConnInfo `json:"connections"`
+}
+
+// bridgeCloseData is the payload for bridge:close commands.
+type bridgeCloseData struct {
+	ConnID uint64 `json:"connId"`
+}
+
+// bridgeClosedData is the payload for bridge:closed events.
+type bridgeClosedData struct {
+	ConnID    uint64 `json:"connId"`
+	Port      uint16 `json:"port"`
+	Direction string `json:"direction"`
+	BytesIn   int64  `json:"bytesIn"`
+	BytesOut  int64  `json:"bytesOut"`
+	Reason    string `json:"reason"`
+	Error     string `json:"error,omitempty"`
+}
+
+// bridgeConn is a registered bridged connection.
+type bridgeConn struct {
+	meta      bridgeMeta
+	started   time.Time
+	tsnetConn net.Conn
+	localConn net.Conn
+
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+	lastActive atomic.Int64 // unix nanos
+
+	mu      sync.Mutex
+	reason  string // set when closed from outside the copy loop
+	closeID string // the bridge:close command's id
+}
+
+// counted returns bc's tailnet conn wrapped to count bytes into bc.
+func (bc *bridgeConn) counted() net.Conn {
+	return &countingConn{Conn: bc.tsnetConn, bc: bc}
+}
+
+// forceClose closes both sides of bc for reason. The first reason sticks.
+func (bc *bridgeConn) forceClose(reason, id string) {
+	bc.mu.Lock()
+	if bc.reason == "" {
+		bc.reason, bc.closeID = reason, id
+	}
+	bc.mu.Unlock()
+	bc.tsnetConn.Close()
+	bc.localConn.Close()
+}
+
+func (bc *bridgeConn) info(now time.Time) bridgeConnInfo {
+	m := &bc.meta
+	info := bridgeConnInfo{
+		ConnID:     m.connID,
+		Port:       m.port,
+		Direction:  directionName(m.direction),
+		RemoteAddr: m.remoteAddr,
+		RequestID:  m.requestID,
+		Target:     m.target,
+		AgeSecs:    now.Sub(bc.started).Seconds(),
+		BytesIn:    bc.bytesIn.Load(),
+		BytesOut:   bc.bytesOut.Load(),
+		IdleSecs:   now.Sub(time.Unix(0, bc.lastActive.Load())).Seconds(),
+	}
+	if m.identity != (peerIdentityData{}) {
+		id := m.identity
+		info.Peer = &id
+	}
+	return info
+}
+
+func directionName(d byte) string {
+	if d == dirOutgoing {
+		return "outgoing"
+	}
+	return "incoming"
+}
+
+// countingConn counts the bytes through a bridged tailnet conn.
+type countingConn struct {
+	net.Conn
+	bc *bridgeConn
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.bc.bytesIn.Add(int64(n))
+		c.bc.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.bc.bytesOut.Add(int64(n))
+		c.bc.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// CloseWrite keeps bridgeCopy's half-close working through the wrapper. A
+// conn without half-close is left open, as bridgeCopy leaves it unwrapped;
+// the reverse direction may still have data to deliver.
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// registerBridge adds an accepted connection to the table.
+func (s *shim) registerBridge(m bridgeMeta, tsnetConn, localConn net.Conn) *bridgeConn {
+	now := time.Now()
+	bc := &bridgeConn{meta: m, started: now, tsnetConn: tsnetConn, localConn: localConn}
+	bc.lastActive.Store(now.UnixNano())
+	s.bridgesMu.Lock()
+	s.bridges[m.connID] = bc
+	s.bridgesMu.Unlock()
+	return bc
+}
+
+// finishBridge drops bc from the table and emits bridge:closed. err is what
+// bridgeCopy returned.
+func (s *shim) finishBridge(bc *bridgeConn, err error) {
+	s.bridgesMu.Lock()
+	delete(s.bridges, bc.meta.connID)
+	s.bridgesMu.Unlock()
+
+	bc.mu.Lock()
+	reason, id := bc.reason, bc.closeID
+	bc.mu.Unlock()
+	d := bridgeClosedData{
+		ConnID:    bc.meta.connID,
+		Port:      bc.meta.port,
+		Direction: directionName(bc.meta.direction),
+		BytesIn:   bc.bytesIn.Load(),
+		BytesOut:  bc.bytesOut.Load(),
+		Reason:    reason,
+	}
+	switch {
+	case reason != "":
+	case err == nil:
+		d.Reason = closeReasonEOF
+	case isTimeout(err):
+		d.Reason = closeReasonIdle
+	default:
+		d.Reason = closeReasonError
+		d.Error = err.Error()
+	}
+	bridgeLog.Debugf("bridge %d closed (%s): in=%d out=%d", d.ConnID, d.Reason, d.BytesIn, d.BytesOut)
+	s.sendEventID(id, "bridge:closed", d)
+}
+
+// isTimeout reports a deadline error. gVisor's gonet conns, which tsnet
+// hands out, return their own timeout error rather than wrapping
+// os.ErrDeadlineExceeded.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// closeBridges force-closes every registered connection.
+func (s *shim) closeBridges(reason, id string) {
+	s.bridgesMu.Lock()
+	conns := make([]*bridgeConn, 0, len(s.bridges))
+	for _, bc := range s.bridges {
+		conns = append(conns, bc)
+	}
+	s.bridgesMu.Unlock()
+	for _, bc := range conns {
+		bc.forceClose(reason, id)
+	}
+}
+
+func (s *shim) handleBridgeList(id string) {
+	now := time.Now()
+	s.bridgesMu.Lock()
+	conns := make([]bridgeConnInfo, 0, len(s.bridges))
+	for _, bc := range s.bridges {
+		conns = append(conns, bc.info(now))
+	}
+	s.bridgesMu.Unlock()
+	slices.SortFunc(conns, func(a, b bridgeConnInfo) int { return cmp.Compare(a.ConnID, b.ConnID) })
+	s.sendEventID(id, "bridge:list", bridgeListData{Connections: conns})
+}
+
+func (s *shim) handleBridgeClose(id string, data json.RawMessage) {
+	var d bridgeCloseData
+	if err := json.Unmarshal(data, &d); err != nil {
+		s.sendErrorID(id, "BRIDGE_CLOSE_ERROR", fmt.Sprintf("invalid bridge:close data: %v", err))
+		return
+	}
+	s.bridgesMu.Lock()
+	bc := s.bridges[d.ConnID]
+	s.bridgesMu.Unlock()
+	if bc == nil {
+		s.sendErrorID(id, "BRIDGE_CLOSE_ERROR", fmt.Sprintf("no bridged connection %d", d.ConnID))
+		return
+	}
+	// bridge:closed follows under this id once the copy loop unwinds.
+	bc.forceClose(closeReasonClosed, id)
 }
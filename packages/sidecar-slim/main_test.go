@@ -1,22 +1,49 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"runtime/debug"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"tailscale.com/derp/derpserver"
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/ipn/store"
+	"tailscale.com/net/netns"
+	"tailscale.com/net/stun/stuntest"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/nettype"
 )
 
 // testToken returns a deterministic 32-byte token matching Rust's test_token()
@@ -169,54 +196,200 @@ func TestGoldenMinimalHeader(t *testing.T) {
 	}
 }
 
+// headerV2Field renders one golden v2 field as hex: type and length as
+// written out by the caller, then the value.
+func headerV2Field(typ, length, value string) string {
+	return typ + length + hex.EncodeToString([]byte(value))
+}
+
+// TestGoldenHeaderV2Incoming pins the v2 TLV layout for an incoming TLS
+// connection carrying every field.
+func TestGoldenHeaderV2Incoming(t *testing.T) {
+	m := bridgeMeta{
+		direction:  dirIncoming,
+		port:       443,
+		remoteAddr: "100.64.0.2:12345",
+		identity:   peerIdentityData{DNSName: "peer-host.tailnet.ts.net", LoginName: "alice@example.com", NodeID: "nABC"},
+		tags:       []string{"tag:web"},
+		sni:        "node.tailnet.ts.net",
+		alpn:       "h2",
+		listenerID: 7,
+		connID:     42,
+		path:       pathDirect,
+	}
+	var buf bytes.Buffer
+	if err := m.writeHeader(&buf, testToken(), headerVersion2); err != nil {
+		t.Fatalf("writeHeader failed: %v", err)
+	}
+
+	want := "54524646" + "02" + hex.EncodeToString(testToken()) + "01" + "01bb" +
+		"0000008e" + // fields length = 142
+		headerV2Field("0002", "0010", "100.64.0.2:12345") +
+		headerV2Field("0010", "0018", "peer-host.tailnet.ts.net") +
+		headerV2Field("0011", "0011", "alice@example.com") +
+		headerV2Field("0014", "0004", "nABC") +
+		headerV2Field("0015", "0007", "tag:web") +
+		headerV2Field("0020", "0013", "node.tailnet.ts.net") +
+		headerV2Field("0021", "0002", "h2") +
+		"0030" + "0004" + "00000007" +
+		"0031" + "0008" + "000000000000002a" +
+		"0032" + "0001" + "01"
+	if got := hex.EncodeToString(buf.Bytes()); got != want {
+		t.Errorf("header:\n got %s\nwant %s", got, want)
+	}
+}
+
+// TestGoldenHeaderV2Outgoing pins an outgoing v2 header and its v1 fallback.
+func TestGoldenHeaderV2Outgoing(t *testing.T) {
+	m := bridgeMeta{
+		direction:  dirOutgoing,
+		port:       9417,
+		requestID:  "r1",
+		remoteAddr: "100.64.0.3:9417",
+		target:     "other-host",
+		connID:     1,
+	}
+	var buf bytes.Buffer
+	if err := m.writeHeader(&buf, testToken(), headerVersion2); err != nil {
+		t.Fatalf("writeHeader failed: %v", err)
+	}
+	want := "54524646" + "02" + hex.EncodeToString(testToken()) + "02" + "24c9" +
+		"00000033" + // fields length = 51
+		headerV2Field("0001", "0002", "r1") +
+		headerV2Field("0002", "000f", "100.64.0.3:9417") +
+		headerV2Field("0003", "000a", "other-host") +
+		"0031" + "0008" + "0000000000000001"
+	if got := hex.EncodeToString(buf.Bytes()); got != want {
+		t.Errorf("header:\n got %s\nwant %s", got, want)
+	}
+
+	// v1 drops everything v1 has no field for.
+	var v1, direct bytes.Buffer
+	if err := m.writeHeader(&v1, testToken(), headerVersion); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeHeader(&direct, testToken(), dirOutgoing, 9417, "r1", "100.64.0.3:9417", "other-host"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v1.Bytes(), direct.Bytes()) {
+		t.Errorf("v1 fallback = %x, want %x", v1.Bytes(), direct.Bytes())
+	}
+}
+
+// TestGoldenHeaderV2Minimal pins a v2 header with no fields.
+func TestGoldenHeaderV2Minimal(t *testing.T) {
+	m := bridgeMeta{direction: dirIncoming, port: 443}
+	var buf bytes.Buffer
+	if err := m.writeHeader(&buf, testToken(), headerVersion2); err != nil {
+		t.Fatalf("writeHeader failed: %v", err)
+	}
+	want := "54524646" + "02" + hex.EncodeToString(testToken()) + "01" + "01bb" + "00000000"
+	if got := hex.EncodeToString(buf.Bytes()); got != want {
+		t.Errorf("header:\n got %s\nwant %s", got, want)
+	}
+}
+
+// TestPeerPathCachesStatus checks the v2 path field is answered from one
+// status snapshot for every peer until it goes stale.
+func TestPeerPathCachesStatus(t *testing.T) {
+	s := newSidecar(json.NewEncoder(io.Discard), io.Discard).defaultNode()
+	direct, relayed, idle := key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()
+	fetches := 0
+	status := func() (*ipnstate.Status, error) {
+		fetches++
+		return &ipnstate.Status{Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			direct:  {CurAddr: "198.51.100.7:41641"},
+			relayed: {Relay: "fra"},
+			idle:    {},
+		}}, nil
+	}
+
+	for k, want := range map[key.NodePublic]byte{direct: pathDirect, relayed: pathDERP, idle: 0} {
+		if got := s.peerPath(k, status); got != want {
+			t.Errorf("path = %d, want %d", got, want)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("fetched status %d times, want 1", fetches)
+	}
+
+	s.pathCacheAt = time.Now().Add(-pathCacheTTL)
+	s.peerPath(direct, status)
+	if fetches != 2 {
+		t.Errorf("stale cache not refreshed: %d fetches", fetches)
+	}
+}
+
+// TestHeaderV1FallbackCarriesIdentityJSON checks an incoming v1 header
+// still smuggles identity as JSON, and tsnet:start rejects an unknown
+// header version.
+func TestHeaderV1FallbackCarriesIdentityJSON(t *testing.T) {
+	m := bridgeMeta{
+		direction: dirIncoming, port: 443, remoteAddr: "100.64.0.2:1",
+		identity: peerIdentityData{DNSName: "peer", NodeID: "n1"},
+		tags:     []string{"tag:web"}, connID: 9,
+	}
+	var got, want bytes.Buffer
+	if err := m.writeHeader(&got, testToken(), headerVersion); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeHeader(&want, testToken(), dirIncoming, 443, "", "100.64.0.2:1", `{"dnsName":"peer","nodeId":"n1"}`); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("v1 header = %x, want %x", got.Bytes(), want.Bytes())
+	}
+
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	s.dispatch(command{ID: "start", Command: "tsnet:start", Data: mustJSON(t, startData{
+		Hostname: "v3", BridgePort: 1, SessionToken: hex.EncodeToString(testToken()), BridgeHeaderVersion: 3,
+	})})
+	if ev := out.waitFor(t, "tsnet:error", time.Second, func(e wireEvent) bool { return e.ID == "start" }); !strings.Contains(string(ev.Data), "bridgeHeaderVersion") {
+		t.Errorf("start = %s", ev.Data)
+	}
+}
+
 // newTestShim mirrors main()'s shim construction for unit tests: events are
 // discarded, the per-subsystem maps are initialized, and the lifecycle context
 // is armed from a fresh background context.
 func newTestShim() *shim {
-	ctx, cancel := context.WithCancel(context.Background())
-	return &shim{
-		writer:           json.NewEncoder(io.Discard),
-		dynamicListeners: make(map[uint16]net.Listener),
-		udpRelays:        make(map[uint16]*udpRelay),
-		proxies:          make(map[string]*proxyEntry),
-		ctx:              ctx,
-		cancel:           cancel,
-	}
+	return newSidecar(json.NewEncoder(io.Discard), io.Discard).defaultNode()
 }
 
-// TestMonitorStateExitsAcrossRestart is the goroutine-leak regression: a
+// TestWatchStateExitsAcrossRestart is the goroutine-leak regression: a
 // long-lived goroutine spawned in one lifecycle must terminate on stop and stay
 // terminated across a restart, rather than being kept alive by the restart's
-// re-armed context. It captures the lifecycle ctx pre-stop (as monitorState
+// re-armed context. It captures the lifecycle ctx pre-stop (as watchState
 // does at spawn), stops (cancelling that ctx), then restarts (re-arming a fresh
-// ctx). monitorState run with the captured ctx must observe cancellation and
-// exit. Before the fix — where monitorState re-read s.ctx — the equivalent run
-// would observe the re-armed live context and block on its 60s ticker, timing
-// out here.
-func TestMonitorStateExitsAcrossRestart(t *testing.T) {
+// ctx). watchState run with the captured ctx must observe cancellation and
+// exit. Before the fix — where the monitor re-read s.ctx — the equivalent run
+// would observe the re-armed live context and block on the bus, timing out
+// here.
+func TestWatchStateExitsAcrossRestart(t *testing.T) {
 	s := newTestShim()
 
-	// The lifecycle ctx a monitorState goroutine captures at spawn.
+	// The lifecycle ctx a watchState goroutine captures at spawn.
 	ctx := s.lifecycleCtx()
 
 	// Stop cancels that lifecycle context.
-	s.handleStop()
+	s.handleStop("")
 
 	// A restart re-arms a fresh lifecycle context.
 	s.armLifecycle(testToken(), 9999)
 
-	// lc is nil-safe here: monitorState returns via ctx.Done before its first
-	// 60s tick would touch lc.
+	// The bus never delivers, so only ctx.Done can end the run.
+	src := &fakeStateSource{bus: &fakeBus{notes: make(chan ipn.Notify), errc: make(chan error)}}
 	done := make(chan struct{})
 	go func() {
-		s.monitorState(ctx, nil)
+		s.watchState(ctx, "", "", src)
 		close(done)
 	}()
 
 	select {
 	case <-done:
 	case <-time.After(5 * time.Second):
-		t.Fatal("monitorState from previous lifecycle leaked across restart")
+		t.Fatal("watchState from previous lifecycle leaked across restart")
 	}
 }
 
@@ -242,7 +415,7 @@ func TestRestartLifecycleFieldsSynchronized(t *testing.T) {
 	}()
 
 	for i := 0; i < 1000; i++ {
-		s.handleStop()
+		s.handleStop("")
 		_ = s.armLifecycle(testToken(), 9000)
 	}
 	wg.Wait()
@@ -362,8 +535,8 @@ func TestStatusEventAdvertisesProtocolVersion(t *testing.T) {
 	}
 
 	var buf bytes.Buffer
-	s := &shim{writer: json.NewEncoder(&buf)}
-	s.sendStatus("running", "host", "host.tail.ts.net", "100.64.0.1", "")
+	s := newSidecar(json.NewEncoder(&buf), &buf).defaultNode()
+	s.sendStatus("", "running", "host", "host.tail.ts.net", "100.64.0.1", "")
 
 	// The core matches the camelCase key exactly, as a JSON integer.
 	if !bytes.Contains(buf.Bytes(), []byte(`"protocolVersion":2`)) {
@@ -403,6 +576,120 @@ func TestResolveIdleTimeout(t *testing.T) {
 	}
 }
 
+// wireEvent is the decoded shape of one stdout event line.
+type wireEvent struct {
+	Event string          `json:"event"`
+	ID    string          `json:"id"`
+	Node  string          `json:"node"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// decodeEvents splits the JSON-lines event stream captured in buf.
+func decodeEvents(t *testing.T, buf *bytes.Buffer) []wireEvent {
+	t.Helper()
+	var out []wireEvent
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	for dec.More() {
+		var ev wireEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatalf("decode event stream: %v", err)
+		}
+		out = append(out, ev)
+	}
+	return out
+}
+
+// TestCommandIDEchoedOnErrors verifies the correlation id of a command is
+// echoed on the tsnet:error it produces, for both the dispatch-level
+// UNKNOWN_CMD and a handler-level NOT_RUNNING rejection.
+func TestCommandIDEchoedOnErrors(t *testing.T) {
+	var buf bytes.Buffer
+	s := newTestShim()
+	s.writer = json.NewEncoder(&buf)
+
+	s.dispatch(command{ID: "c1", Command: "tsnet:bogus"})
+	s.dispatch(command{ID: "c2", Command: "tsnet:listen", Data: json.RawMessage(`{"port":9417}`)})
+	s.dispatch(command{ID: "c3", Command: "proxy:add", Data: json.RawMessage(`{"id":"web","listenPort":443}`)})
+
+	evs := decodeEvents(t, &buf)
+	if len(evs) != 3 {
+		t.Fatalf("got %d events, want 3: %s", len(evs), buf.String())
+	}
+	for i, want := range []struct{ id, code string }{
+		{"c1", "UNKNOWN_CMD"},
+		{"c2", "NOT_RUNNING"},
+		{"c3", "NOT_RUNNING"},
+	} {
+		var ed errorData
+		if err := json.Unmarshal(evs[i].Data, &ed); err != nil {
+			t.Fatalf("event %d data: %v", i, err)
+		}
+		if evs[i].Event != "tsnet:error" || evs[i].ID != want.id || ed.Code != want.code {
+			t.Errorf("event %d = %s id=%q code=%q, want tsnet:error id=%q code=%q",
+				i, evs[i].Event, evs[i].ID, ed.Code, want.id, want.code)
+		}
+	}
+}
+
+// TestUncorrelatedEventOmitsID verifies events without a command id keep the
+// pre-correlation wire shape: no "id" key at all.
+func TestUncorrelatedEventOmitsID(t *testing.T) {
+	var buf bytes.Buffer
+	s := newSidecar(json.NewEncoder(&buf), &buf).defaultNode()
+	s.sendError("PARSE_ERROR", "bad")
+	if bytes.Contains(buf.Bytes(), []byte(`"id"`)) {
+		t.Errorf("uncorrelated event carries an id key: %s", strings.TrimSpace(buf.String()))
+	}
+}
+
+// TestHelloBeforeStart verifies sidecar:hello is answered without a running
+// node and reports the protocol version, build version, and command list.
+func TestHelloBeforeStart(t *testing.T) {
+	var buf bytes.Buffer
+	s := newTestShim()
+	s.writer = json.NewEncoder(&buf)
+
+	s.dispatch(command{ID: "h1", Command: "sidecar:hello"})
+
+	evs := decodeEvents(t, &buf)
+	if len(evs) != 1 || evs[0].Event != "sidecar:hello" || evs[0].ID != "h1" {
+		t.Fatalf("got %s, want one sidecar:hello with id h1", buf.String())
+	}
+	var hd helloData
+	if err := json.Unmarshal(evs[0].Data, &hd); err != nil {
+		t.Fatalf("hello data: %v", err)
+	}
+	if hd.ProtocolVersion != sidecarProtocolVersion {
+		t.Errorf("protocolVersion = %d, want %d", hd.ProtocolVersion, sidecarProtocolVersion)
+	}
+	if hd.Version != Version {
+		t.Errorf("version = %q, want %q", hd.Version, Version)
+	}
+	if !equalStringSlices(hd.Commands, supportedCommands) {
+		t.Errorf("commands = %v, want %v", hd.Commands, supportedCommands)
+	}
+	if !equalStringSlices(hd.Features, sidecarFeatures) {
+		t.Errorf("features = %v, want %v", hd.Features, sidecarFeatures)
+	}
+}
+
+// TestSupportedCommandsDispatch keeps supportedCommands in lockstep with the
+// dispatch switch: every advertised command must reach a handler (never
+// UNKNOWN_CMD), so hello can't advertise a command the sidecar rejects.
+func TestSupportedCommandsDispatch(t *testing.T) {
+	for _, name := range supportedCommands {
+		var buf bytes.Buffer
+		s := newTestShim()
+		s.writer = json.NewEncoder(&buf)
+
+		s.dispatch(command{Command: name})
+
+		if bytes.Contains(buf.Bytes(), []byte(`"UNKNOWN_CMD"`)) {
+			t.Errorf("%s is advertised but dispatch rejects it: %s", name, strings.TrimSpace(buf.String()))
+		}
+	}
+}
+
 // TestModulePath guards the go.mod module path against the stale
 // claude-code-on-the-go name reappearing.
 func TestModulePath(t *testing.T) {
@@ -911,3 +1198,2753 @@ func TestBuildReverseProxy(t *testing.T) {
 		}
 	})
 }
+
+// ── Control socket ────────────────────────────────────────────────────────
+
+// dialControl connects to the control socket and returns a line reader.
+func dialControl(t *testing.T, path string) (net.Conn, *json.Decoder) {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial control socket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, json.NewDecoder(conn)
+}
+
+// TestControlSocketAuthAndRouting verifies a socket client must present the
+// session token, that replies to its commands go to it alone (with its own id
+// restored), and that uncorrelated events reach both it and stdout.
+func TestControlSocketAuthAndRouting(t *testing.T) {
+	// Short dir: Unix socket paths are capped near 104 bytes on macOS.
+	dir, err := os.MkdirTemp("", "trf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ctl.sock")
+
+	var stdout bytes.Buffer
+	s := newTestShim()
+	s.writer = json.NewEncoder(&stdout)
+	s.armLifecycle(testToken(), 9999)
+	cs, err := startControlServer(s, path)
+	if err != nil {
+		t.Fatalf("startControlServer: %v", err)
+	}
+	s.control = cs
+	defer cs.close()
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("control socket mode = %v (err %v), want 0600", fi.Mode().Perm(), err)
+	}
+
+	t.Run("wrong token rejected", func(t *testing.T) {
+		conn, dec := dialControl(t, path)
+		io.WriteString(conn, `{"id":"a","command":"sidecar:auth","data":{"sessionToken":"`+strings.Repeat("ff", 32)+`"}}`+"\n")
+		var ev wireEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if ev.Event != "tsnet:error" || !bytes.Contains(ev.Data, []byte("AUTH_FAILED")) {
+			t.Errorf("got %s %s, want AUTH_FAILED", ev.Event, ev.Data)
+		}
+	})
+
+	t.Run("authenticated client gets its replies", func(t *testing.T) {
+		conn, dec := dialControl(t, path)
+		io.WriteString(conn, `{"id":"a","command":"sidecar:auth","data":{"sessionToken":"`+hex.EncodeToString(testToken())+`"}}`+"\n")
+		var ev wireEvent
+		if err := dec.Decode(&ev); err != nil || ev.Event != "sidecar:authenticated" || ev.ID != "a" {
+			t.Fatalf("auth reply = %+v (err %v), want sidecar:authenticated id=a", ev, err)
+		}
+
+		io.WriteString(conn, `{"id":"h","command":"sidecar:hello"}`+"\n")
+		ev = wireEvent{}
+		if err := dec.Decode(&ev); err != nil || ev.Event != "sidecar:hello" || ev.ID != "h" {
+			t.Fatalf("hello reply = %+v (err %v), want sidecar:hello id=h", ev, err)
+		}
+
+		s.sendEvent("tsnet:needsApproval", nil)
+		ev = wireEvent{}
+		if err := dec.Decode(&ev); err != nil || ev.Event != "tsnet:needsApproval" || ev.ID != "" {
+			t.Fatalf("broadcast = %+v (err %v), want uncorrelated tsnet:needsApproval", ev, err)
+		}
+
+		s.writeMu.Lock()
+		out := stdout.String()
+		s.writeMu.Unlock()
+		if strings.Contains(out, "sidecar:hello") {
+			t.Errorf("socket client's reply leaked to stdout: %s", out)
+		}
+		if !strings.Contains(out, "tsnet:needsApproval") {
+			t.Errorf("broadcast event missing from stdout: %s", out)
+		}
+
+		// A state change the client asked for still reaches the core.
+		io.WriteString(conn, `{"id":"st","command":"tsnet:stop"}`+"\n")
+		ev = wireEvent{}
+		if err := dec.Decode(&ev); err != nil || ev.Event != "tsnet:stopped" || ev.ID != "st" {
+			t.Fatalf("stop reply = %+v (err %v), want tsnet:stopped id=st", ev, err)
+		}
+		s.writeMu.Lock()
+		out = stdout.String()
+		s.writeMu.Unlock()
+		if !strings.Contains(out, `{"event":"tsnet:stopped"`) || strings.Contains(out, `"id":"st"`) {
+			t.Errorf("stdout = %s, want an uncorrelated tsnet:stopped", out)
+		}
+	})
+}
+
+// ── Command/event framing ─────────────────────────────────────────────────
+
+// normalizeJSON decodes JSON into generic values for encoding-neutral
+// comparison (numbers become float64 either way).
+func normalizeJSON(t *testing.T, b []byte) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatalf("normalize JSON: %v", err)
+	}
+	return v
+}
+
+// cborToNormalized decodes one CBOR value and normalizes it through JSON.
+func cborToNormalized(t *testing.T, b []byte) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := cborDecMode.Unmarshal(b, &v); err != nil {
+		t.Fatalf("decode CBOR: %v", err)
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("re-encode CBOR value as JSON: %v", err)
+	}
+	return normalizeJSON(t, j)
+}
+
+// TestEventEncodingsRoundTrip verifies the JSON and CBOR framings carry the
+// same values for the same event struct, including omitempty behaviour and
+// nested/pointer payloads.
+func TestEventEncodingsRoundTrip(t *testing.T) {
+	events := []event{
+		{Event: "tsnet:stopped"},
+		{Event: "tsnet:error", ID: "c1", Data: errorData{Code: "NOT_RUNNING", Message: "node not running"}},
+		{Event: "tsnet:status", Data: statusData{State: "running", DNSName: "a.ts.net", ProtocolVersion: sidecarProtocolVersion}},
+		{Event: "tsnet:peers", Data: peersData{Peers: []peerInfo{
+			{ID: "n1", Hostname: "a", DNSName: "a.ts.net", TailscaleIPs: []string{"100.64.0.1"}, Online: true},
+			{ID: "n2", Hostname: "b", Expired: true},
+		}}},
+		{Event: "tsnet:peerChanged", Data: peerChangedData{ChangeType: "updated", PeerID: "n1", Peer: &peerInfo{ID: "n1", Relay: "fra"}}},
+		{Event: "proxy:added", ID: "p", Data: proxyAddedEventData{ID: "web", ListenPort: 443, URL: "https://a.ts.net"}},
+	}
+	for _, ev := range events {
+		var jbuf, cbuf bytes.Buffer
+		if err := newEventEncoder(&jbuf, false).Encode(ev); err != nil {
+			t.Fatalf("%s: JSON encode: %v", ev.Event, err)
+		}
+		if err := newEventEncoder(&cbuf, true).Encode(ev); err != nil {
+			t.Fatalf("%s: CBOR encode: %v", ev.Event, err)
+		}
+		payload, tooLong, err := readCommandFrame(bufio.NewReader(&cbuf), maxCommandBytes)
+		if err != nil || tooLong {
+			t.Fatalf("%s: read CBOR frame: tooLong=%v err=%v", ev.Event, tooLong, err)
+		}
+		if got, want := cborToNormalized(t, payload), normalizeJSON(t, jbuf.Bytes()); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: CBOR decodes to %v, JSON to %v", ev.Event, got, want)
+		}
+	}
+}
+
+// TestCommandEncodingsRoundTrip verifies a command survives CBOR framing with
+// its data transcoded to the same JSON value handlers parse.
+func TestCommandEncodingsRoundTrip(t *testing.T) {
+	in := command{ID: "c7", Node: "work", Command: "proxy:add", Data: json.RawMessage(`{"id":"web","listenPort":443,"tls":false,"allow":["*@example.com"]}`)}
+
+	var buf bytes.Buffer
+	if err := (cborFrameEncoder{w: &buf}).Encode(in); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	out, problem, err := readCommand(bufio.NewReader(&buf), true)
+	if err != nil || problem != nil {
+		t.Fatalf("readCommand: problem=%v err=%v", problem, err)
+	}
+	if out.ID != in.ID || out.Node != in.Node || out.Command != in.Command {
+		t.Errorf("envelope = %q/%q/%q, want %q/%q/%q", out.ID, out.Node, out.Command, in.ID, in.Node, in.Command)
+	}
+	if got, want := normalizeJSON(t, out.Data), normalizeJSON(t, in.Data); !reflect.DeepEqual(got, want) {
+		t.Errorf("data = %s, want %s", out.Data, in.Data)
+	}
+
+	var d proxyAddData
+	if err := json.Unmarshal(out.Data, &d); err != nil || d.ListenPort != 443 || d.Tls == nil || *d.Tls {
+		t.Errorf("handler-side parse = %+v (err %v)", d, err)
+	}
+}
+
+// TestCBORFrameOversizeStaysInSync verifies an over-size CBOR frame is skipped
+// with COMMAND_TOO_LARGE and the following frame still decodes.
+func TestCBORFrameOversizeStaysInSync(t *testing.T) {
+	var buf bytes.Buffer
+	hdr := make([]byte, 4)
+	hdr[0], hdr[1], hdr[2], hdr[3] = 0x00, 0x80, 0x00, 0x01 // maxCommandBytes+1
+	buf.Write(hdr)
+	buf.Write(make([]byte, maxCommandBytes+1))
+	(cborFrameEncoder{w: &buf}).Encode(command{Command: "sidecar:hello"})
+
+	r := bufio.NewReader(&buf)
+	if _, problem, err := readCommand(r, true); err != nil || problem == nil || problem.Code != "COMMAND_TOO_LARGE" {
+		t.Fatalf("oversize frame: problem=%v err=%v, want COMMAND_TOO_LARGE", problem, err)
+	}
+	if cmd, problem, err := readCommand(r, true); err != nil || problem != nil || cmd.Command != "sidecar:hello" {
+		t.Fatalf("next frame = %+v problem=%v err=%v, want sidecar:hello", cmd, problem, err)
+	}
+}
+
+// TestHelloSwitchesToCBOR verifies the negotiation: the hello reply is still a
+// JSON line announcing framing "cbor", and every later event is a CBOR frame.
+func TestHelloSwitchesToCBOR(t *testing.T) {
+	var stdout bytes.Buffer
+	s := newTestShim()
+	s.writer = json.NewEncoder(&stdout)
+	s.stdout = &stdout
+
+	s.dispatch(command{ID: "h", Command: "sidecar:hello", Data: json.RawMessage(`{"framing":"cbor"}`)})
+	s.sendEvent("tsnet:stopped", nil)
+
+	r := bufio.NewReader(&stdout)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read hello line: %v", err)
+	}
+	var hello struct {
+		Event string    `json:"event"`
+		Data  helloData `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(line), &hello); err != nil || hello.Event != "sidecar:hello" || hello.Data.Framing != framingCBOR {
+		t.Fatalf("hello = %s (err %v), want JSON sidecar:hello with framing cbor", line, err)
+	}
+	if !s.stdinCBOR.Load() {
+		t.Error("stdin still reads JSON lines after switching to CBOR")
+	}
+
+	payload, _, err := readCommandFrame(r, maxCommandBytes)
+	if err != nil {
+		t.Fatalf("read CBOR frame: %v", err)
+	}
+	var ev event
+	if err := cbor.Unmarshal(payload, &ev); err != nil || ev.Event != "tsnet:stopped" {
+		t.Errorf("post-switch event = %+v (err %v), want CBOR tsnet:stopped", ev, err)
+	}
+}
+
+// ── Event writer queue ────────────────────────────────────────────────────
+
+// takenEvents flattens a take() batch to its events.
+func takenEvents(items []*queuedEvent) []event {
+	out := make([]event, 0, len(items))
+	for _, it := range items {
+		out = append(out, it.ev)
+	}
+	return out
+}
+
+// TestEventQueueCoalesces verifies queued peerChanged events collapse to the
+// latest per peer (a queued join absorbing a later update), healthWarnings
+// collapse to the latest, and everything else keeps FIFO order in full.
+func TestEventQueueCoalesces(t *testing.T) {
+	q := newEventQueue(16)
+	peer := func(change, id, relay string) event {
+		return event{Event: "tsnet:peerChanged", Data: peerChangedData{ChangeType: change, PeerID: id, Peer: &peerInfo{ID: id, Relay: relay}}}
+	}
+	q.push(peer("joined", "n1", "fra"), false, nil)
+	q.push(event{Event: "tsnet:listening", Data: listeningData{Port: 1}}, false, nil)
+	q.push(peer("updated", "n1", "nyc"), false, nil)
+	q.push(peer("updated", "n2", "sfo"), false, nil)
+	q.push(event{Event: "tsnet:healthWarning", Data: healthWarningData{Warnings: []string{"a"}}}, false, nil)
+	q.push(peer("updated", "n2", "lhr"), false, nil)
+	q.push(event{Event: "tsnet:healthWarning", Data: healthWarningData{Warnings: []string{"b"}}}, false, nil)
+
+	items, dropped, _ := q.take()
+	evs := takenEvents(items)
+	if dropped != 0 || len(evs) != 4 {
+		t.Fatalf("got %d events (dropped %d), want 4: %+v", len(evs), dropped, evs)
+	}
+	n1 := evs[0].Data.(peerChangedData)
+	if n1.ChangeType != "joined" || n1.Peer.Relay != "nyc" {
+		t.Errorf("n1 = %s relay=%s, want joined with latest relay nyc", n1.ChangeType, n1.Peer.Relay)
+	}
+	if evs[1].Event != "tsnet:listening" {
+		t.Errorf("event 1 = %s, want tsnet:listening kept in order", evs[1].Event)
+	}
+	if n2 := evs[2].Data.(peerChangedData); n2.ChangeType != "updated" || n2.Peer.Relay != "lhr" {
+		t.Errorf("n2 = %s relay=%s, want updated relay lhr", n2.ChangeType, n2.Peer.Relay)
+	}
+	if hw := evs[3].Data.(healthWarningData); !equalStringSlices(hw.Warnings, []string{"b"}) {
+		t.Errorf("healthWarning = %v, want latest [b]", hw.Warnings)
+	}
+
+	// Taken items are out of the coalesce index: a new update is queued anew.
+	q.push(peer("updated", "n1", "ams"), false, nil)
+	if items, _, _ := q.take(); len(items) != 1 {
+		t.Errorf("post-take push queued %d items, want 1", len(items))
+	}
+}
+
+// blockingWriter stalls every Write until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+	mu      sync.Mutex
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+// TestSlowReaderDoesNotBlockEmitters verifies emitters return promptly while
+// stdout is stalled, that sheddable overflow is shed while replies and
+// uncoalescable events are not, and that the writer reports the shed count
+// on an events:dropped event once the reader catches up.
+func TestSlowReaderDoesNotBlockEmitters(t *testing.T) {
+	out := &blockingWriter{release: make(chan struct{})}
+	s := newTestShim()
+	s.writer = json.NewEncoder(out)
+	s.events = newEventQueue(8)
+	go s.runEventWriter()
+
+	done := make(chan struct{})
+	go func() {
+		// The first event is taken by the writer (and stalls in Write); the
+		// next 8 fill the queue; the last 5 must be shed.
+		for i := 0; i < 14; i++ {
+			id := fmt.Sprintf("n%d", i)
+			s.sendEvent("tsnet:peerChanged", peerChangedData{ChangeType: "updated", PeerID: id, Peer: &peerInfo{ID: id}})
+			if i == 0 {
+				time.Sleep(50 * time.Millisecond) // let the writer take event 0
+			}
+		}
+		// Over the cap, but a reply and an event nothing supersedes.
+		s.sendEventID("d", "bridge:dialResult", dialResultData{RequestID: "r"})
+		s.sendEvent("tsnet:listening", listeningData{Port: 1})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("sendEvent blocked on a stalled stdout reader")
+	}
+
+	close(out.release)
+	s.events.close(2 * time.Second)
+
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	evs := decodeEvents(t, &out.buf)
+	if len(evs) != 12 {
+		t.Fatalf("wrote %d events, want 11 delivered + events:dropped: %s", len(evs), out.buf.String())
+	}
+	if evs[9].Event != "bridge:dialResult" || evs[9].ID != "d" || evs[10].Event != "tsnet:listening" {
+		t.Errorf("events 9-10 = %s %s, want the reply and tsnet:listening kept", evs[9].Event, evs[10].Event)
+	}
+	last := evs[len(evs)-1]
+	var dd eventsDroppedData
+	// Events 9-13 were stamped 10-14 as they were shed.
+	if err := json.Unmarshal(last.Data, &dd); err != nil || last.Event != "events:dropped" || dd != (eventsDroppedData{Count: 5, FromSeq: 10, ToSeq: 14}) {
+		t.Errorf("last event = %s %s, want events:dropped count 5 seqs 10-14", last.Event, last.Data)
+	}
+	var seqs []uint64
+	dec := json.NewDecoder(bytes.NewReader(out.buf.Bytes()))
+	for dec.More() {
+		var ev event
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, ev.Seq)
+	}
+	if want := []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 15, 16, 17}; !slices.Equal(seqs, want) {
+		t.Errorf("seqs = %v, want %v", seqs, want)
+	}
+}
+
+// ── Event sequence numbers and replay ─────────────────────────────────────
+
+// TestEventSeqMonotonic verifies stdout events are numbered 1, 2, 3… in write
+// order.
+func TestEventSeqMonotonic(t *testing.T) {
+	var buf bytes.Buffer
+	s := newTestShim()
+	s.writer = json.NewEncoder(&buf)
+	for i := 0; i < 5; i++ {
+		s.sendEvent("tsnet:listening", listeningData{Port: uint16(i)})
+	}
+	var seqs []uint64
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var ev event
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, ev.Seq)
+	}
+	for i, seq := range seqs {
+		if seq != uint64(i+1) {
+			t.Fatalf("seqs = %v, want 1..5", seqs)
+		}
+	}
+}
+
+// replayResult runs events:replay and returns the re-emitted events and the
+// events:replayed summary.
+func replayResult(t *testing.T, s *shim, buf *bytes.Buffer, since uint64) ([]event, eventsReplayedData) {
+	t.Helper()
+	buf.Reset()
+	s.dispatch(command{ID: "r", Command: "events:replay", Data: json.RawMessage(fmt.Sprintf(`{"sinceSeq":%d}`, since))})
+	var out []event
+	var res eventsReplayedData
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var ev struct {
+			event
+			Data json.RawMessage `json:"data"`
+		}
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Event == "events:replayed" && !ev.Replay {
+			if err := json.Unmarshal(ev.Data, &res); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		out = append(out, ev.event)
+	}
+	return out, res
+}
+
+// TestEventsReplay verifies retained events are re-emitted with their
+// original seq and replay:true, and that a request reaching past the ring's
+// oldest event reports the evicted range as a gap.
+func TestEventsReplay(t *testing.T) {
+	var buf bytes.Buffer
+	s := newTestShim()
+	s.writer = json.NewEncoder(&buf)
+	s.ring = newEventRing(4)
+	for i := 0; i < 6; i++ { // seqs 1..6; ring keeps 3..6
+		s.sendEvent("tsnet:listening", listeningData{Port: uint16(i)})
+	}
+
+	evs, res := replayResult(t, s, &buf, 4)
+	if len(evs) != 2 || evs[0].Seq != 5 || evs[1].Seq != 6 || !evs[0].Replay {
+		t.Errorf("replay since 4 = %+v, want seqs 5,6 marked replay", evs)
+	}
+	if res.Count != 2 || res.Gap || res.LastSeq != 6 {
+		t.Errorf("summary = %+v, want count 2, no gap, lastSeq 6", res)
+	}
+
+	// The replayed copies were not recorded again: the ring still holds
+	// 4..7 (7 being the previous events:replayed), oldest seq 4.
+	evs, res = replayResult(t, s, &buf, 0)
+	if !res.Gap || res.MissedFrom != 1 || res.MissedTo != 3 {
+		t.Errorf("summary = %+v, want gap 1..3", res)
+	}
+	if len(evs) != 4 || evs[0].Seq != 4 {
+		t.Errorf("replay since 0 = %d events starting at %d, want 4 starting at 4", len(evs), evs[0].Seq)
+	}
+}
+
+// TestSetLogLevel checks that stderr logs are JSON records tagged by
+// component and that sidecar:setLogLevel changes one component's level
+// without touching the others.
+func TestSetLogLevel(t *testing.T) {
+	var logBuf bytes.Buffer
+	logs.out.setOutput(&logBuf)
+	logs.setLevel("", slog.LevelInfo)
+	t.Cleanup(func() {
+		logs.out.setOutput(os.Stderr)
+		logs.setLevel("", defaultLogLevel())
+	})
+
+	var buf bytes.Buffer
+	s := newTestShim()
+	s.writer = json.NewEncoder(&buf)
+
+	s.dispatch(command{ID: "l1", Command: "sidecar:setLogLevel", Data: json.RawMessage(`{"component":"bridge","level":"debug"}`)})
+	evs := decodeEvents(t, &buf)
+	if len(evs) != 1 || evs[0].Event != "sidecar:logLevels" || evs[0].ID != "l1" {
+		t.Fatalf("got %s, want one sidecar:logLevels with id l1", buf.String())
+	}
+	var ld logLevelsData
+	if err := json.Unmarshal(evs[0].Data, &ld); err != nil {
+		t.Fatalf("logLevels data: %v", err)
+	}
+	if ld.Levels[logBridge] != "debug" || ld.Levels[logUDP] != "info" || len(ld.Levels) != len(logComponents) {
+		t.Errorf("levels = %v, want bridge=debug and the rest info", ld.Levels)
+	}
+
+	logBuf.Reset()
+	bridgeLog.Debugf("bridge trace %d", 1)
+	udpLog.Debugf("udp trace %d", 2)
+	udpLog.Warnf("udp warning")
+
+	type record struct {
+		Level     string `json:"level"`
+		Msg       string `json:"msg"`
+		Component string `json:"component"`
+	}
+	var got []record
+	dec := json.NewDecoder(&logBuf)
+	for dec.More() {
+		var r record
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("log line is not JSON: %v", err)
+		}
+		got = append(got, r)
+	}
+	want := []record{
+		{Level: "DEBUG", Msg: "bridge trace 1", Component: logBridge},
+		{Level: "WARN", Msg: "udp warning", Component: logUDP},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("log records = %+v, want %+v", got, want)
+	}
+
+	for _, tc := range []struct{ data, why string }{
+		{`{"component":"bogus","level":"debug"}`, "unknown component"},
+		{`{"component":"udp","level":"loud"}`, "unknown level"},
+	} {
+		buf.Reset()
+		s.dispatch(command{ID: "bad", Command: "sidecar:setLogLevel", Data: json.RawMessage(tc.data)})
+		evs := decodeEvents(t, &buf)
+		if len(evs) != 1 || evs[0].Event != "tsnet:error" || !bytes.Contains(evs[0].Data, []byte("LOG_LEVEL_ERROR")) {
+			t.Errorf("%s: got %s, want LOG_LEVEL_ERROR", tc.why, buf.String())
+		}
+	}
+	if lvl := udpLog.level.Level(); lvl != slog.LevelInfo {
+		t.Errorf("udp level = %v after rejected updates, want INFO", lvl)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for an emitter goroutine and a polling
+// test to share.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// events decodes a snapshot of everything written so far.
+func (b *lockedBuffer) events(t *testing.T) []wireEvent {
+	t.Helper()
+	b.mu.Lock()
+	snap := bytes.NewBuffer(append([]byte(nil), b.buf.Bytes()...))
+	b.mu.Unlock()
+	return decodeEvents(t, snap)
+}
+
+// waitEvent polls until an event named name has been written, or fails.
+// A zero timeout checks once.
+func (b *lockedBuffer) waitEvent(t *testing.T, name string, timeout time.Duration) wireEvent {
+	t.Helper()
+	return b.waitFor(t, name, timeout, func(wireEvent) bool { return true })
+}
+
+// waitFor is waitEvent restricted to events that also satisfy match.
+func (b *lockedBuffer) waitFor(t *testing.T, name string, timeout time.Duration, match func(wireEvent) bool) wireEvent {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, ev := range b.events(t) {
+			if ev.Event == name && match(ev) {
+				return ev
+			}
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no matching %s event within %v", name, timeout)
+	return wireEvent{}
+}
+
+// TestDrainClosesListenersAndWaitsForBridges checks that tsnet:drain stops
+// intake at once, reports the live bridge count, and finishes as soon as the
+// last bridged stream ends.
+func TestDrainClosesListenersAndWaitsForBridges(t *testing.T) {
+	var out lockedBuffer
+	s := newTestShim()
+	s.writer = json.NewEncoder(&out)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.dynamicListeners[9417] = ln
+	s.bridgeConns.Add(1) // one stream mid-copy
+
+	s.drain("d1", 5*time.Second)
+
+	if _, err := ln.Accept(); err == nil {
+		t.Fatal("listener still accepting after drain")
+	}
+	if len(s.dynamicListeners) != 0 {
+		t.Errorf("dynamicListeners = %v, want empty", s.dynamicListeners)
+	}
+	var dd drainingData
+	if err := json.Unmarshal(out.waitEvent(t, "tsnet:draining", time.Second).Data, &dd); err != nil {
+		t.Fatal(err)
+	}
+	if dd.Remaining != 1 || dd.Bridges != 1 || dd.SecsLeft < 4 {
+		t.Errorf("draining = %+v, want 1 bridge and ~5s left", dd)
+	}
+
+	// A second drain while one is running is refused.
+	s.drain("d2", time.Second)
+	if evs := out.events(t); !bytes.Contains(evs[len(evs)-1].Data, []byte("DRAIN_ERROR")) {
+		t.Errorf("second drain: got %s, want DRAIN_ERROR", evs[len(evs)-1].Event)
+	}
+
+	// Nothing new that would hold the drain open is accepted meanwhile.
+	s.setServer(&tsnet.Server{})
+	s.dispatch(command{ID: "u1", Command: "tsnet:listenPacket", Data: json.RawMessage(`{"port":9418}`)})
+	if ev := out.waitFor(t, "tsnet:error", time.Second, func(e wireEvent) bool { return e.ID == "u1" }); !bytes.Contains(ev.Data, []byte("DRAINING")) {
+		t.Errorf("listenPacket while draining = %s", ev.Data)
+	}
+	s.dispatch(command{ID: "b1", Command: "bridge:dial", Data: json.RawMessage(`{"requestId":"r1","target":"peer","port":80}`)})
+	var dr dialResultData
+	if err := json.Unmarshal(out.waitFor(t, "bridge:dialResult", time.Second, func(e wireEvent) bool { return e.ID == "b1" }).Data, &dr); err != nil {
+		t.Fatal(err)
+	}
+	if dr.Success || dr.Code != "DRAINING" {
+		t.Errorf("dial while draining = %+v", dr)
+	}
+	s.setServer(nil)
+
+	s.bridgeConns.Add(-1)
+	var done drainedData
+	ev := out.waitEvent(t, "tsnet:drained", 2*time.Second)
+	if err := json.Unmarshal(ev.Data, &done); err != nil {
+		t.Fatal(err)
+	}
+	if ev.ID != "d1" || done.Reason != "idle" || done.Remaining != 0 {
+		t.Errorf("drained = %+v (id %q), want idle with 0 remaining for d1", done, ev.ID)
+	}
+	if ev := out.waitEvent(t, "tsnet:unlistened", 0); ev.ID != "d1" {
+		t.Errorf("unlistened id = %q, want d1", ev.ID)
+	}
+}
+
+// TestDrainTimesOut checks that a stream outliving the deadline is reported
+// as remaining rather than waited on forever, and that a drained proxy is
+// deregistered and announced.
+func TestDrainTimesOut(t *testing.T) {
+	var out lockedBuffer
+	s := newTestShim()
+	s.writer = json.NewEncoder(&out)
+
+	pln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpSrv := &http.Server{Handler: http.NotFoundHandler()}
+	go httpSrv.Serve(pln)
+	s.proxies["p1"] = &proxyEntry{id: "p1", listener: pln, server: httpSrv}
+	s.bridgeConns.Add(1)
+	defer s.bridgeConns.Add(-1)
+
+	start := time.Now()
+	s.drain("d1", 300*time.Millisecond)
+
+	var done drainedData
+	if err := json.Unmarshal(out.waitEvent(t, "tsnet:drained", 3*time.Second).Data, &done); err != nil {
+		t.Fatal(err)
+	}
+	if done.Reason != "timeout" || done.Bridges != 1 {
+		t.Errorf("drained = %+v, want timeout with 1 bridge", done)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("drain finished after %v, before its deadline", elapsed)
+	}
+	if ev := out.waitEvent(t, "proxy:removed", 0); !bytes.Contains(ev.Data, []byte(`"p1"`)) {
+		t.Errorf("proxy:removed = %s, want p1", ev.Data)
+	}
+	if len(s.proxies) != 0 {
+		t.Errorf("proxies = %v, want empty after drain", s.proxies)
+	}
+	if _, err := net.DialTimeout("tcp", pln.Addr().String(), time.Second); err == nil {
+		t.Error("proxy listener still accepting after drain")
+	}
+}
+
+// TestStopAllSerializesWithDispatch checks the stdin-EOF shutdown waits for
+// a running command, and that commands a control-socket client sends after
+// it are dropped rather than starting a node.
+func TestStopAllSerializesWithDispatch(t *testing.T) {
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	s.lookupNode("work", true)
+
+	s.dispatchMu.Lock() // a command in flight
+	stopped := make(chan struct{})
+	go func() {
+		s.stopAll()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("stopAll ran alongside a command")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.dispatchMu.Unlock()
+	<-stopped
+	if n := len(out.events(t)); n != 2 {
+		t.Errorf("%d events from stopAll, want a tsnet:stopped per node", n)
+	}
+
+	s.dispatch(command{ID: "late", Node: "late", Command: "tsnet:start", Data: json.RawMessage(`{"sessionToken":"bad"}`)})
+	if s.lookupNode("late", false) != nil || len(out.events(t)) != 2 {
+		t.Error("command after stopAll was dispatched")
+	}
+}
+
+// TestCommandsRouteByNode checks that node-scoped commands reach the named
+// node, replies carry the node's name, unknown nodes are refused, and two
+// nodes can't share a state dir.
+func TestCommandsRouteByNode(t *testing.T) {
+	var buf bytes.Buffer
+	s := newTestShim()
+	s.writer = json.NewEncoder(&buf)
+	last := func() wireEvent {
+		t.Helper()
+		evs := decodeEvents(t, &buf)
+		buf.Reset()
+		if len(evs) == 0 {
+			t.Fatal("no event emitted")
+		}
+		return evs[len(evs)-1]
+	}
+
+	s.dispatch(command{ID: "g1", Node: "work", Command: "tsnet:getPeers"})
+	if ev := last(); ev.Node != "work" || !bytes.Contains(ev.Data, []byte("UNKNOWN_NODE")) {
+		t.Errorf("getPeers on unknown node: got %s/%s, want UNKNOWN_NODE tagged work", ev.Node, ev.Data)
+	}
+
+	// A tsnet:start that fails validation doesn't leave the node behind.
+	s.dispatch(command{ID: "s1", Node: "work", Command: "tsnet:start", Data: json.RawMessage(`{"stateDir":"/tmp/work","sessionToken":"bad"}`)})
+	if ev := last(); ev.Node != "work" || ev.ID != "s1" || !bytes.Contains(ev.Data, []byte("START_ERROR")) {
+		t.Errorf("start on work: got %+v, want START_ERROR tagged work", ev)
+	}
+	if s.lookupNode("work", false) != nil || len(s.allNodes()) != 1 {
+		t.Fatal("failed tsnet:start left the node registered")
+	}
+	s.dispatch(command{ID: "l1", Node: "work", Command: "tsnet:listen", Data: json.RawMessage(`{"port":80}`)})
+	if ev := last(); ev.Node != "work" || !bytes.Contains(ev.Data, []byte("UNKNOWN_NODE")) {
+		t.Errorf("listen on work: got %s/%s, want UNKNOWN_NODE tagged work", ev.Node, ev.Data)
+	}
+
+	// A registered node that isn't running refuses serving commands.
+	work := s.lookupNode("work", true)
+	s.dispatch(command{ID: "l2", Node: "work", Command: "tsnet:listen", Data: json.RawMessage(`{"port":80}`)})
+	if ev := last(); ev.Node != "work" || !bytes.Contains(ev.Data, []byte("NOT_RUNNING")) {
+		t.Errorf("listen on work: got %s/%s, want NOT_RUNNING tagged work", ev.Node, ev.Data)
+	}
+
+	// Process-wide commands answer untagged whatever node they name.
+	s.dispatch(command{ID: "h1", Node: "work", Command: "sidecar:hello"})
+	if ev := last(); ev.Event != "sidecar:hello" || ev.Node != "" {
+		t.Errorf("hello: got %s tagged %q, want untagged sidecar:hello", ev.Event, ev.Node)
+	}
+
+	// A running node owns its state dir.
+	work.serverMu.Lock()
+	work.server, work.stateDir = &tsnet.Server{}, "/tmp/shared"
+	work.serverMu.Unlock()
+	s.dispatch(command{ID: "s2", Command: "tsnet:start", Data: json.RawMessage(`{"stateDir":"/tmp/shared"}`)})
+	if ev := last(); ev.Node != "" || !bytes.Contains(ev.Data, []byte(`in use by node \"work\"`)) {
+		t.Errorf("start on shared dir: got %s, want START_ERROR naming work", ev.Data)
+	}
+	work.setServer(nil)
+
+	// Stopping a named node forgets it; the default node stays.
+	s.dispatch(command{ID: "x1", Node: "work", Command: "tsnet:stop"})
+	if ev := last(); ev.Event != "tsnet:stopped" || ev.Node != "work" {
+		t.Errorf("stop: got %s tagged %q, want tsnet:stopped tagged work", ev.Event, ev.Node)
+	}
+	if s.lookupNode("work", false) != nil || s.lookupNode("", false) != s {
+		t.Error("stop did not remove the named node (or removed the default)")
+	}
+}
+
+// TestProbeControl checks that any HTTP answer counts as reachable and a
+// refused connection does not.
+func TestProbeControl(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	if err := probeControl(context.Background(), srv.URL); err != nil {
+		t.Errorf("probe of a live server (404) = %v, want nil", err)
+	}
+	srv.Close()
+	if err := probeControl(context.Background(), srv.URL); err == nil {
+		t.Error("probe of a closed server succeeded")
+	}
+}
+
+// TestStartReportsUnreachableControl checks that a start against a dead
+// controlUrl ends in an error status with CONTROL_UNREACHABLE instead of
+// hanging in "starting", and leaves the node restartable.
+func TestStartReportsUnreachableControl(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a tsnet server")
+	}
+	netns.SetEnabled(false)
+	t.Cleanup(func() { netns.SetEnabled(true) })
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	var out lockedBuffer
+	s := newSidecar(json.NewEncoder(&out), &out).defaultNode()
+	s.dispatch(command{ID: "s1", Command: "tsnet:start", Data: mustJSON(t, startData{
+		Hostname: "dead-control", StateDir: t.TempDir(), BridgePort: 1,
+		SessionToken: hex.EncodeToString(testToken()), Ephemeral: true, ControlURL: dead.URL,
+	})})
+	ev := out.waitFor(t, "tsnet:status", 15*time.Second, func(ev wireEvent) bool {
+		return bytes.Contains(ev.Data, []byte(`"state":"error"`))
+	})
+	var st statusData
+	if err := json.Unmarshal(ev.Data, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Code != "CONTROL_UNREACHABLE" || ev.ID != "s1" {
+		t.Errorf("status = %+v (id %q), want CONTROL_UNREACHABLE for s1", st, ev.ID)
+	}
+	if s.getServer() != nil {
+		t.Error("server still published after an unreachable-control start")
+	}
+	if s.lifecycleCtx().Err() == nil {
+		t.Error("lifecycle still live after an unreachable-control start")
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) json.RawMessage {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// startTestControl runs a loopback DERP/STUN relay and a testcontrol
+// coordination server. With requireAuth, every new node key has to be
+// approved through CompleteAuth on the AuthURL it is handed.
+func startTestControl(t *testing.T, requireAuth bool) *testcontrol.Server {
+	t.Helper()
+	netns.SetEnabled(false) // no SO_MARK/bind-to-interface in tests
+	t.Cleanup(func() { netns.SetEnabled(true) })
+
+	d := derpserver.New(key.NewNode(), logger.Discard)
+	derpSrv := httptest.NewUnstartedServer(derpserver.Handler(d))
+	derpSrv.Config.ErrorLog = logger.StdLogger(logger.Discard)
+	derpSrv.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	derpSrv.StartTLS()
+	stunAddr, stunCleanup := stuntest.ServeWithPacketListener(t, nettype.Std{})
+	t.Cleanup(func() {
+		derpSrv.CloseClientConnections()
+		derpSrv.Close()
+		d.Close()
+		stunCleanup()
+	})
+
+	control := &testcontrol.Server{
+		DERPMap: &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "test", Nodes: []*tailcfg.DERPNode{{
+				Name: "t1", RegionID: 1, HostName: "127.0.0.1", IPv4: "127.0.0.1", IPv6: "none",
+				STUNPort: stunAddr.Port, DERPPort: derpSrv.Listener.Addr().(*net.TCPAddr).Port,
+				InsecureForTests: true, STUNTestIP: "127.0.0.1",
+			}}},
+		}},
+		DNSConfig:      &tailcfg.DNSConfig{Proxied: true},
+		MagicDNSDomain: "tail-scale.ts.net",
+		RequireAuth:    requireAuth,
+		Logf:           logger.Discard,
+	}
+	control.HTTPTestServer = httptest.NewUnstartedServer(control)
+	control.HTTPTestServer.Start()
+	t.Cleanup(control.HTTPTestServer.Close)
+	return control
+}
+
+// testNode is one shim started against testcontrol, with a loopback
+// listener standing in for the Rust core's bridge port.
+type testNode struct {
+	s    *shim
+	out  *lockedBuffer
+	core net.Listener
+	ip   string
+}
+
+func startTestNode(t *testing.T, controlURL, hostname string) *testNode {
+	t.Helper()
+	core, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &testNode{out: new(lockedBuffer), core: core}
+	n.s = newSidecar(json.NewEncoder(n.out), n.out).defaultNode()
+	t.Cleanup(func() {
+		n.s.handleStop("")
+		core.Close()
+	})
+
+	n.s.dispatch(command{ID: "start", Command: "tsnet:start", Data: mustJSON(t, startData{
+		Hostname: hostname, StateDir: t.TempDir(), Ephemeral: true, ControlURL: controlURL,
+		BridgePort: uint16(core.Addr().(*net.TCPAddr).Port), SessionToken: hex.EncodeToString(testToken()),
+	})})
+	var st statusData
+	if err := json.Unmarshal(n.out.waitEvent(t, "tsnet:started", time.Minute).Data, &st); err != nil {
+		t.Fatal(err)
+	}
+	n.ip = st.TailscaleIP
+	return n
+}
+
+// waitForPeer waits until to shows up in from's netmap, so from can dial it.
+func waitForPeer(t *testing.T, from, to *testNode) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for i := 0; ; i++ {
+		id := fmt.Sprintf("peers-%d", i)
+		from.s.dispatch(command{ID: id, Command: "tsnet:getPeers"})
+		ev := from.out.waitFor(t, "tsnet:peers", 10*time.Second, func(e wireEvent) bool { return e.ID == id })
+		if bytes.Contains(ev.Data, []byte(to.ip)) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never saw %s: %s", from.ip, to.ip, ev.Data)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// readTestHeader parses an RFC 003 bridge header off conn, checking the
+// magic, version and session token.
+func readTestHeader(t *testing.T, conn net.Conn) (direction byte, port uint16, requestID string) {
+	t.Helper()
+	fixed := make([]byte, 4+1+32+1+2)
+	if _, err := io.ReadFull(conn, fixed); err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+	if binary.BigEndian.Uint32(fixed) != headerMagic || fixed[4] != headerVersion || !bytes.Equal(fixed[5:37], testToken()) {
+		t.Fatalf("bad header prefix %x", fixed)
+	}
+	var fields [3]string
+	for i := range fields {
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			t.Fatalf("read header field: %v", err)
+		}
+		b := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatalf("read header field: %v", err)
+		}
+		fields[i] = string(b)
+	}
+	return fixed[37], binary.BigEndian.Uint16(fixed[38:]), fields[0]
+}
+
+// TestIntegrationBridgeBetweenNodes starts two shims against a local
+// testcontrol server, listens on one, dials it from the other, and checks
+// bytes flow end to end through both fake cores.
+func TestIntegrationBridgeBetweenNodes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts two tsnet nodes")
+	}
+	controlURL := startTestControl(t, false).HTTPTestServer.URL
+	a := startTestNode(t, controlURL, "node-a")
+	b := startTestNode(t, controlURL, "node-b")
+
+	a.s.dispatch(command{ID: "l1", Command: "tsnet:listen", Data: json.RawMessage(`{"port":9417}`)})
+	a.out.waitEvent(t, "tsnet:listening", 10*time.Second)
+
+	waitForPeer(t, b, a)
+
+	b.s.dispatch(command{ID: "d1", Command: "bridge:dial", Data: json.RawMessage(`{"requestId":"r1","target":"` + a.ip + `","port":9417,"tls":false}`)})
+
+	accept := func(n *testNode) net.Conn {
+		t.Helper()
+		n.core.(*net.TCPListener).SetDeadline(time.Now().Add(30 * time.Second))
+		c, err := n.core.Accept()
+		if err != nil {
+			t.Fatalf("core accept: %v (events: %+v)", err, n.out.events(t))
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetDeadline(time.Now().Add(30 * time.Second))
+		return c
+	}
+
+	out := accept(b)
+	if dir, port, rid := readTestHeader(t, out); dir != dirOutgoing || port != 9417 || rid != "r1" {
+		t.Errorf("outgoing header = dir %d port %d rid %q", dir, port, rid)
+	}
+	if _, err := out.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	in := accept(a)
+	if dir, port, _ := readTestHeader(t, in); dir != dirIncoming || port != 9417 {
+		t.Errorf("incoming header = dir %d port %d", dir, port)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(in, got); err != nil || string(got) != "ping" {
+		t.Fatalf("node-a core read %q, %v; want ping", got, err)
+	}
+	if _, err := in.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(out, got); err != nil || string(got) != "pong" {
+		t.Fatalf("node-b core read %q, %v; want pong", got, err)
+	}
+}
+
+// TestEncryptedStateStore checks sealing on disk, reopening with the right
+// and wrong key, and migration of an existing plaintext state file.
+func TestEncryptedStateStore(t *testing.T) {
+	dir := t.TempDir()
+	key := hex.EncodeToString(testToken())
+
+	// A plaintext node as tsnet's default FileStore leaves it.
+	plain, err := store.NewFileStore(t.Logf, filepath.Join(dir, plainStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.WriteState("_machinekey", []byte("privkey:secret-machine")); err != nil {
+		t.Fatal(err)
+	}
+
+	opt := &stateStoreData{Mode: stateStoreEncrypted, Key: key}
+	st, migrated, err := openStateStore(opt, dir, false)
+	if err != nil || migrated != 1 {
+		t.Fatalf("openStateStore = migrated %d, err %v; want 1 key migrated", migrated, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, plainStateFile)); !os.IsNotExist(err) {
+		t.Errorf("plaintext state file survived migration (stat err %v)", err)
+	}
+	if err := st.WriteState("profile", []byte("secret-profile")); err != nil {
+		t.Fatal(err)
+	}
+	onDisk, err := os.ReadFile(filepath.Join(dir, encryptedStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(onDisk, []byte("secret")) || bytes.Contains(onDisk, []byte(base64Of("secret-profile"))) {
+		t.Error("encrypted state file contains plaintext")
+	}
+
+	st, migrated, err = openStateStore(opt, dir, false)
+	if err != nil || migrated != 0 {
+		t.Fatalf("reopen = migrated %d, err %v", migrated, err)
+	}
+	for id, want := range map[ipn.StateKey]string{"_machinekey": "privkey:secret-machine", "profile": "secret-profile"} {
+		if got, err := st.ReadState(id); err != nil || string(got) != want {
+			t.Errorf("ReadState(%s) = %q, %v; want %q", id, got, err, want)
+		}
+	}
+	if _, err := st.ReadState("missing"); err != ipn.ErrStateNotExist {
+		t.Errorf("ReadState(missing) err = %v, want ErrStateNotExist", err)
+	}
+
+	wrong := &stateStoreData{Mode: stateStoreEncrypted, Key: strings.Repeat("ab", 32)}
+	if _, _, err := openStateStore(wrong, dir, false); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Errorf("open with wrong key err = %v, want a decrypt failure", err)
+	}
+}
+
+func base64Of(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+func TestOpenStateStoreModes(t *testing.T) {
+	if st, _, err := openStateStore(nil, t.TempDir(), false); st != nil || err != nil {
+		t.Errorf("default = %v, %v; want tsnet's own FileStore (nil)", st, err)
+	}
+	if _, _, err := openStateStore(&stateStoreData{Mode: stateStoreMem}, "", false); err == nil {
+		t.Error("mem store accepted for a non-ephemeral node")
+	}
+	if st, _, err := openStateStore(&stateStoreData{Mode: stateStoreMem}, "", true); err != nil {
+		t.Errorf("mem store for ephemeral = %v, %v", st, err)
+	}
+	if _, _, err := openStateStore(&stateStoreData{Mode: stateStoreEncrypted, Key: "00"}, t.TempDir(), false); err == nil {
+		t.Error("encrypted store accepted a short key")
+	}
+	if _, _, err := openStateStore(&stateStoreData{Mode: "vault"}, "", false); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+// TestIntegrationLogoutLogin starts a node against a testcontrol that wants
+// interactive auth, logs it out, and logs it back in through a fresh AuthURL.
+func TestIntegrationLogoutLogin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a tsnet node")
+	}
+	control := startTestControl(t, true)
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	t.Cleanup(func() { s.handleStop("") })
+
+	authURL := func(id string) string {
+		t.Helper()
+		var d authRequiredData
+		ev := out.waitFor(t, "tsnet:authRequired", time.Minute, func(e wireEvent) bool { return e.ID == id })
+		if err := json.Unmarshal(ev.Data, &d); err != nil || d.AuthURL == "" {
+			t.Fatalf("authRequired %s: %v", ev.Data, err)
+		}
+		return d.AuthURL
+	}
+	result := func(id string) authResultData {
+		t.Helper()
+		var r authResultData
+		ev := out.waitFor(t, "tsnet:authResult", time.Minute, func(e wireEvent) bool { return e.ID == id })
+		if err := json.Unmarshal(ev.Data, &r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	s.dispatch(command{ID: "start", Command: "tsnet:start", Data: mustJSON(t, startData{
+		Hostname: "auth-node", StateDir: t.TempDir(), ControlURL: control.HTTPTestServer.URL,
+		BridgePort: 1, SessionToken: hex.EncodeToString(testToken()),
+	})})
+	first := authURL("start")
+	if !control.CompleteAuth(first) {
+		t.Fatalf("CompleteAuth(%s) failed", first)
+	}
+	out.waitEvent(t, "tsnet:started", time.Minute)
+
+	s.dispatch(command{ID: "in0", Command: "tsnet:login"})
+	if r := result("in0"); r.Success || !strings.Contains(r.Error, "tsnet:reauth") {
+		t.Errorf("login while running = %+v, want a pointer to tsnet:reauth", r)
+	}
+
+	s.dispatch(command{ID: "out", Command: "tsnet:logout"})
+	if r := result("out"); !r.Success || r.State != "NeedsLogin" {
+		t.Fatalf("logout = %+v", r)
+	}
+	if s.getDNSName() != "" {
+		t.Errorf("dnsName = %q after logout, want empty", s.getDNSName())
+	}
+	out.waitFor(t, "tsnet:stateChange", time.Minute, func(e wireEvent) bool {
+		var d stateChangeData
+		return e.ID == "" && json.Unmarshal(e.Data, &d) == nil && d.State == "NeedsLogin"
+	})
+
+	// Logging out again has nothing left to wait for.
+	s.dispatch(command{ID: "out2", Command: "tsnet:logout"})
+	if r := result("out2"); !r.Success || r.State != "NeedsLogin" {
+		t.Errorf("second logout = %+v", r)
+	}
+
+	s.dispatch(command{ID: "reauth", Command: "tsnet:reauth"})
+	if r := result("reauth"); r.Success {
+		t.Errorf("reauth while logged out = %+v, want failure", r)
+	}
+
+	s.dispatch(command{ID: "in", Command: "tsnet:login"})
+	second := authURL("in")
+	if second == first {
+		t.Errorf("login reused the start AuthURL %s", first)
+	}
+	if !control.CompleteAuth(second) {
+		t.Fatalf("CompleteAuth(%s) failed", second)
+	}
+	if r := result("in"); !r.Success || r.State != "Running" {
+		t.Fatalf("login = %+v", r)
+	}
+	if !strings.HasPrefix(s.getDNSName(), "auth-node.") {
+		t.Errorf("dnsName = %q after login", s.getDNSName())
+	}
+	out.waitFor(t, "tsnet:status", 0, func(e wireEvent) bool { return e.ID == "in" })
+}
+
+// TestIntegrationLoginAfterExpiryKeepsPrefs logs a node back in after its key
+// expired, and checks the login kept the prefs it had.
+func TestIntegrationLoginAfterExpiryKeepsPrefs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a tsnet node")
+	}
+	control := startTestControl(t, true)
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	t.Cleanup(func() { s.handleStop("") })
+	authURL := func(id string) string {
+		t.Helper()
+		var d authRequiredData
+		ev := out.waitFor(t, "tsnet:authRequired", time.Minute, func(e wireEvent) bool { return e.ID == id })
+		if err := json.Unmarshal(ev.Data, &d); err != nil || d.AuthURL == "" {
+			t.Fatalf("authRequired %s: %v", ev.Data, err)
+		}
+		return d.AuthURL
+	}
+
+	s.dispatch(command{ID: "start", Command: "tsnet:start", Data: mustJSON(t, startData{
+		Hostname: "expiring", StateDir: t.TempDir(), ControlURL: control.HTTPTestServer.URL,
+		BridgePort: 1, SessionToken: hex.EncodeToString(testToken()),
+	})})
+	control.CompleteAuth(authURL("start"))
+	out.waitEvent(t, "tsnet:started", time.Minute)
+	s.dispatch(command{ID: "edit", Command: "tsnet:editPrefs", Data: json.RawMessage(`{"shieldsUp":true}`)})
+	out.waitFor(t, "tsnet:prefs", 30*time.Second, func(e wireEvent) bool { return e.ID == "edit" })
+
+	control.SetExpireAllNodes(true)
+	out.waitFor(t, "tsnet:stateChange", time.Minute, func(e wireEvent) bool {
+		var d stateChangeData
+		return e.ID == "" && json.Unmarshal(e.Data, &d) == nil && d.State == "NeedsLogin"
+	})
+	control.SetExpireAllNodes(false)
+
+	s.dispatch(command{ID: "in", Command: "tsnet:login"})
+	control.CompleteAuth(authURL("in"))
+	var r authResultData
+	if err := json.Unmarshal(out.waitFor(t, "tsnet:authResult", time.Minute, func(e wireEvent) bool { return e.ID == "in" }).Data, &r); err != nil || !r.Success {
+		t.Fatalf("login = %+v (%v)", r, err)
+	}
+	s.dispatch(command{ID: "get", Command: "tsnet:getPrefs"})
+	var d prefsData
+	if err := json.Unmarshal(out.waitFor(t, "tsnet:prefs", 10*time.Second, func(e wireEvent) bool { return e.ID == "get" }).Data, &d); err != nil {
+		t.Fatal(err)
+	}
+	if !d.ShieldsUp {
+		t.Errorf("prefs after re-login = %+v, want shieldsUp kept", d)
+	}
+}
+
+// fakeBus is an IPN bus the test pushes notifications (or a failure) into.
+type fakeBus struct {
+	notes chan ipn.Notify
+	errc  chan error
+}
+
+func (b *fakeBus) Next() (ipn.Notify, error) {
+	select {
+	case n := <-b.notes:
+		return n, nil
+	case err := <-b.errc:
+		return ipn.Notify{}, err
+	}
+}
+
+func (b *fakeBus) Close() error { return nil }
+
+type fakeStateSource struct {
+	bus        *fakeBus
+	st         *ipnstate.Status
+	watches    atomic.Int32
+	statusErrs atomic.Int32 // status calls left to fail
+}
+
+func (f *fakeStateSource) watch(context.Context) (ipnBus, error) {
+	f.watches.Add(1)
+	return f.bus, nil
+}
+
+func (f *fakeStateSource) status(context.Context) (*ipnstate.Status, error) {
+	if f.statusErrs.Add(-1) >= 0 {
+		return nil, errors.New("status unavailable")
+	}
+	return f.st, nil
+}
+
+func stateNotify(st ipn.State) ipn.Notify { return ipn.Notify{State: &st} }
+
+func TestWatchStateTransitions(t *testing.T) {
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	src := &fakeStateSource{
+		bus: &fakeBus{notes: make(chan ipn.Notify), errc: make(chan error)},
+		st: &ipnstate.Status{
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+			Self:         &ipnstate.PeerStatus{ID: "n1", DNSName: "box.tail.ts.net."},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.watchState(ctx, "start", "box", src)
+	}()
+
+	send := func(n ipn.Notify) {
+		t.Helper()
+		select {
+		case src.bus.notes <- n:
+		case <-time.After(5 * time.Second):
+			t.Fatal("watchState stopped reading the bus")
+		}
+	}
+	send(stateNotify(ipn.NoState))
+	login := stateNotify(ipn.NeedsLogin)
+	authURL := "https://login.example/a"
+	login.BrowseToURL = &authURL
+	send(login)
+	send(stateNotify(ipn.Starting))
+	send(stateNotify(ipn.Running))
+	out.waitEvent(t, "tsnet:started", 5*time.Second)
+	if got := s.getDNSName(); got != "box.tail.ts.net" {
+		t.Errorf("dnsName = %q", got)
+	}
+
+	// A resubscribe replays the current state; it must not read as a change.
+	src.bus.errc <- errors.New("bus reset")
+	send(stateNotify(ipn.Running))
+	send(stateNotify(ipn.Stopped))
+	send(ipn.Notify{Health: &health.State{Warnings: map[health.WarnableCode]health.UnhealthyState{
+		"dns": {Text: "DNS unavailable"},
+	}}})
+	send(ipn.Notify{SelfChange: &tailcfg.Node{KeyExpiry: time.Now().Add(time.Hour)}})
+	out.waitEvent(t, "tsnet:keyExpiring", 5*time.Second)
+	cancel()
+	<-done
+
+	type change struct{ id, prev, state string }
+	var changes []change
+	for _, ev := range out.events(t) {
+		switch ev.Event {
+		case "tsnet:stateChange":
+			var d stateChangeData
+			if err := json.Unmarshal(ev.Data, &d); err != nil {
+				t.Fatal(err)
+			}
+			changes = append(changes, change{ev.ID, d.Previous, d.State})
+		case "tsnet:authRequired":
+			if ev.ID != "start" || !strings.Contains(string(ev.Data), authURL) {
+				t.Errorf("authRequired = %+v", ev)
+			}
+		case "tsnet:healthWarning":
+			if !strings.Contains(string(ev.Data), "DNS unavailable") {
+				t.Errorf("healthWarning = %s", ev.Data)
+			}
+		}
+	}
+	want := []change{
+		{"start", "", "NoState"},
+		{"start", "NoState", "NeedsLogin"},
+		{"start", "NeedsLogin", "Starting"},
+		{"start", "Starting", "Running"},
+		{"", "Running", "Stopped"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("stateChanges =\n%v\nwant\n%v", changes, want)
+	}
+	if n := src.watches.Load(); n != 2 {
+		t.Errorf("watches = %d, want a resubscribe after the bus error", n)
+	}
+}
+
+// TestWatchStateRetriesAnnounce checks a failed status fetch at Running is
+// retried on its own, without another notify to prompt it.
+func TestWatchStateRetriesAnnounce(t *testing.T) {
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	src := &fakeStateSource{
+		bus: &fakeBus{notes: make(chan ipn.Notify), errc: make(chan error)},
+		st:  &ipnstate.Status{Self: &ipnstate.PeerStatus{ID: "n1", DNSName: "box.tail.ts.net."}},
+	}
+	src.statusErrs.Store(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.watchState(ctx, "start", "box", src)
+
+	src.bus.notes <- stateNotify(ipn.Running)
+	if ev := out.waitEvent(t, "tsnet:started", 10*time.Second); ev.ID != "start" {
+		t.Errorf("tsnet:started id = %q, want start", ev.ID)
+	}
+}
+
+func TestRefreshDNSNameReannouncesProxies(t *testing.T) {
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	s.setDNSName("old.tail.ts.net")
+	s.proxies["web"] = &proxyEntry{id: "web", listenPort: 80}
+	s.proxies["api"] = &proxyEntry{id: "api", listenPort: 8443}
+	s.proxies["pending"] = nil
+
+	s.refreshDNSName("", "new.tail.ts.net")
+	s.refreshDNSName("", "new.tail.ts.net") // unchanged: no re-announce
+	s.refreshDNSName("", "")
+
+	if got := s.getDNSName(); got != "new.tail.ts.net" {
+		t.Errorf("dnsName = %q", got)
+	}
+	var urls []string
+	for _, ev := range out.events(t) {
+		if ev.Event != "proxy:added" {
+			continue
+		}
+		var d proxyAddedEventData
+		if err := json.Unmarshal(ev.Data, &d); err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, d.ID+" "+d.URL)
+	}
+	want := []string{"api http://new.tail.ts.net:8443", "web http://new.tail.ts.net"}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("proxy:added = %v, want %v", urls, want)
+	}
+}
+
+func TestSetHostnameAndTagsValidate(t *testing.T) {
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	for _, tc := range []struct {
+		cmd, data, code string
+	}{
+		{"tsnet:setHostname", `{"hostname":"bad_name!"}`, "SET_HOSTNAME_ERROR"},
+		{"tsnet:setHostname", `{"hostname":""}`, "SET_HOSTNAME_ERROR"},
+		{"tsnet:setHostname", `{"hostname":"fine"}`, "NOT_RUNNING"},
+		{"tsnet:setTags", `{"tags":["server"]}`, "SET_TAGS_ERROR"},
+		{"tsnet:setTags", `{"tags":["tag:server"]}`, "NOT_RUNNING"},
+	} {
+		id := tc.cmd + tc.data
+		s.dispatch(command{ID: id, Command: tc.cmd, Data: json.RawMessage(tc.data)})
+		ev := out.waitFor(t, "tsnet:error", 0, func(e wireEvent) bool { return e.ID == id })
+		if !strings.Contains(string(ev.Data), tc.code) {
+			t.Errorf("%s %s: %s, want %s", tc.cmd, tc.data, ev.Data, tc.code)
+		}
+	}
+}
+
+// TestIntegrationSetHostname renames a running node in place and checks the
+// backend prefs follow.
+func TestIntegrationSetHostname(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a tsnet node")
+	}
+	n := startTestNode(t, startTestControl(t, false).HTTPTestServer.URL, "before")
+	n.s.dispatch(command{ID: "rename", Command: "tsnet:setHostname", Data: mustJSON(t, setHostnameData{Hostname: "after"})})
+	var d hostnameSetData
+	if err := json.Unmarshal(n.out.waitEvent(t, "tsnet:hostnameSet", 30*time.Second).Data, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Hostname != "after" || d.DNSName == "" {
+		t.Errorf("hostnameSet = %+v", d)
+	}
+	lc, err := n.s.getServer().LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefs, err := lc.GetPrefs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefs.Hostname != "after" {
+		t.Errorf("prefs.Hostname = %q, want after", prefs.Hostname)
+	}
+	if h, _ := n.s.nameAndTags(); h != "after" {
+		t.Errorf("hostname kept for login and restart = %q, want after", h)
+	}
+}
+
+func TestEditPrefsDataMaskedPrefs(t *testing.T) {
+	var d editPrefsData
+	if err := json.Unmarshal([]byte(`{"shieldsUp":true,"advertiseRoutes":["10.0.0.0/24","0.0.0.0/0"],"exitNodeId":""}`), &d); err != nil {
+		t.Fatal(err)
+	}
+	mp, err := d.maskedPrefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mp.ShieldsUpSet || !mp.ShieldsUp || mp.RouteAllSet || mp.RunSSHSet {
+		t.Errorf("bool masks = %+v", mp)
+	}
+	if !mp.AdvertiseRoutesSet || len(mp.AdvertiseRoutes) != 2 || mp.AdvertiseRoutes[1] != netip.MustParsePrefix("0.0.0.0/0") {
+		t.Errorf("routes = %v", mp.AdvertiseRoutes)
+	}
+	if !mp.ExitNodeIDSet || !mp.ExitNodeIPSet || mp.ExitNodeID != "" {
+		t.Errorf("exit node masks = %+v", mp)
+	}
+
+	for _, bad := range []string{`{"advertiseRoutes":["10.0.0.1/24"]}`, `{"advertiseRoutes":["nope"]}`} {
+		var d editPrefsData
+		if err := json.Unmarshal([]byte(bad), &d); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.maskedPrefs(); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestWatchStateEmitsPrefsChanged(t *testing.T) {
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	src := &fakeStateSource{bus: &fakeBus{notes: make(chan ipn.Notify), errc: make(chan error)}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.watchState(ctx, "", "", src)
+	}()
+	prefs := func(edit func(*ipn.Prefs)) ipn.Notify {
+		p := ipn.NewPrefs()
+		edit(p)
+		v := p.View()
+		return ipn.Notify{Prefs: &v}
+	}
+	src.bus.notes <- prefs(func(*ipn.Prefs) {})                            // baseline
+	src.bus.notes <- prefs(func(p *ipn.Prefs) { p.Hostname = "renamed" })  // outside the subset
+	src.bus.notes <- prefs(func(p *ipn.Prefs) { p.ExitNodeID = "exit-1" }) // change
+	ev := out.waitEvent(t, "tsnet:prefsChanged", 5*time.Second)
+	cancel()
+	<-done
+
+	var d prefsData
+	if err := json.Unmarshal(ev.Data, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.ExitNodeID != "exit-1" {
+		t.Errorf("prefsChanged = %+v", d)
+	}
+	n := 0
+	for _, e := range out.events(t) {
+		if e.Event == "tsnet:prefsChanged" {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("%d prefsChanged events, want 1", n)
+	}
+}
+
+// TestWatchStateReportsErrMessage checks a backend error message on a
+// running node is reported as an error status and doesn't end the watch.
+func TestWatchStateReportsErrMessage(t *testing.T) {
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	src := &fakeStateSource{
+		bus: &fakeBus{notes: make(chan ipn.Notify), errc: make(chan error)},
+		st:  &ipnstate.Status{Self: &ipnstate.PeerStatus{ID: "n1", DNSName: "box.tail.ts.net."}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.watchState(ctx, "start", "box", src)
+
+	src.bus.notes <- stateNotify(ipn.Running)
+	out.waitEvent(t, "tsnet:started", 5*time.Second)
+	msg := "key expired; log in again"
+	src.bus.notes <- ipn.Notify{ErrMessage: &msg}
+	ev := out.waitFor(t, "tsnet:status", 5*time.Second, func(e wireEvent) bool { return bytes.Contains(e.Data, []byte(`"state":"error"`)) })
+	if ev.ID != "" || !strings.Contains(string(ev.Data), msg) {
+		t.Errorf("error status = %+v", ev)
+	}
+	select {
+	case src.bus.notes <- stateNotify(ipn.NeedsLogin):
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchState stopped reading the bus after ErrMessage")
+	}
+	out.waitFor(t, "tsnet:stateChange", 5*time.Second, func(e wireEvent) bool { return bytes.Contains(e.Data, []byte("NeedsLogin")) })
+}
+
+// TestWatchStateReannouncesExitNode checks an exit node change in prefs,
+// which no tsnet:setExitNode reported, re-emits the running status.
+func TestWatchStateReannouncesExitNode(t *testing.T) {
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	src := &fakeStateSource{
+		bus: &fakeBus{notes: make(chan ipn.Notify), errc: make(chan error)},
+		st:  &ipnstate.Status{Self: &ipnstate.PeerStatus{ID: "n1", HostName: "box", DNSName: "box.tail.ts.net."}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.watchState(ctx, "start", "box", src)
+
+	prefs := func(exitNode tailcfg.StableNodeID) ipn.Notify {
+		p := ipn.NewPrefs()
+		p.ExitNodeID = exitNode
+		v := p.View()
+		return ipn.Notify{Prefs: &v}
+	}
+	src.bus.notes <- prefs("")
+	src.bus.notes <- stateNotify(ipn.Running)
+	out.waitEvent(t, "tsnet:started", 5*time.Second)
+
+	src.st = &ipnstate.Status{
+		Self:           src.st.Self,
+		ExitNodeStatus: &ipnstate.ExitNodeStatus{ID: "exit-1"},
+	}
+	src.bus.notes <- prefs("exit-1")
+	ev := out.waitFor(t, "tsnet:status", 5*time.Second, func(e wireEvent) bool { return e.ID == "" })
+	var st statusData
+	if err := json.Unmarshal(ev.Data, &st); err != nil || st.ExitNode != "exit-1" || st.State != "running" {
+		t.Errorf("re-announced status = %s (%v), want running via exit-1", ev.Data, err)
+	}
+}
+
+// TestIntegrationEditPrefs advertises a subnet route on a running node and
+// reads it back.
+func TestIntegrationEditPrefs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a tsnet node")
+	}
+	n := startTestNode(t, startTestControl(t, false).HTTPTestServer.URL, "router")
+	n.s.dispatch(command{ID: "edit", Command: "tsnet:editPrefs", Data: json.RawMessage(`{"shieldsUp":true,"advertiseRoutes":["10.9.0.0/16"]}`)})
+	n.out.waitFor(t, "tsnet:prefs", 30*time.Second, func(e wireEvent) bool { return e.ID == "edit" })
+	n.out.waitEvent(t, "tsnet:prefsChanged", 10*time.Second)
+
+	n.s.dispatch(command{ID: "get", Command: "tsnet:getPrefs"})
+	var d prefsData
+	if err := json.Unmarshal(n.out.waitFor(t, "tsnet:prefs", 10*time.Second, func(e wireEvent) bool { return e.ID == "get" }).Data, &d); err != nil {
+		t.Fatal(err)
+	}
+	if !d.ShieldsUp || !reflect.DeepEqual(d.AdvertiseRoutes, []string{"10.9.0.0/16"}) {
+		t.Errorf("prefs = %+v", d)
+	}
+}
+
+// TestIntegrationExitNode has one node advertise exit routes, approves them
+// in testcontrol, and routes a second node through it and back off.
+func TestIntegrationExitNode(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts two tsnet nodes")
+	}
+	control := startTestControl(t, false)
+	exit := startTestNode(t, control.HTTPTestServer.URL, "exit")
+	client := startTestNode(t, control.HTTPTestServer.URL, "client")
+
+	exitRoutes := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	exit.s.dispatch(command{ID: "adv", Command: "tsnet:editPrefs", Data: json.RawMessage(`{"advertiseRoutes":["0.0.0.0/0","::/0"]}`)})
+	exit.out.waitFor(t, "tsnet:prefs", 30*time.Second, func(e wireEvent) bool { return e.ID == "adv" })
+	lc, err := exit.s.getServer().LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, err := lc.StatusWithoutPeers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	control.SetSubnetRoutes(self.Self.PublicKey, exitRoutes)
+
+	client.s.dispatch(command{ID: "bad", Command: "tsnet:setExitNode", Data: mustJSON(t, setExitNodeData{NodeID: "nope"})})
+	client.out.waitFor(t, "tsnet:error", 10*time.Second, func(e wireEvent) bool { return e.ID == "bad" })
+
+	var nodes exitNodesData
+	for deadline := time.Now().Add(30 * time.Second); ; {
+		id := fmt.Sprintf("list-%d", time.Now().UnixNano())
+		client.s.dispatch(command{ID: id, Command: "tsnet:exitNodes"})
+		ev := client.out.waitFor(t, "tsnet:exitNodes", 10*time.Second, func(e wireEvent) bool { return e.ID == id })
+		if err := json.Unmarshal(ev.Data, &nodes); err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes.Nodes) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("exit node never offered to client")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if got := nodes.Nodes[0]; got.ID != string(self.Self.ID) || got.Hostname != "exit" || got.Active {
+		t.Fatalf("exitNodes = %+v, want inactive %s", nodes.Nodes, self.Self.ID)
+	}
+
+	client.s.dispatch(command{ID: "use", Command: "tsnet:setExitNode", Data: mustJSON(t, setExitNodeData{NodeID: string(self.Self.ID)})})
+	client.out.waitFor(t, "tsnet:exitNodeSet", 10*time.Second, func(e wireEvent) bool { return e.ID == "use" })
+	var st statusData
+	if err := json.Unmarshal(client.out.waitFor(t, "tsnet:status", 10*time.Second, func(e wireEvent) bool { return e.ID == "use" }).Data, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.ExitNode != string(self.Self.ID) {
+		t.Errorf("status exitNode = %q, want %s", st.ExitNode, self.Self.ID)
+	}
+
+	client.s.dispatch(command{ID: "off", Command: "tsnet:setExitNode", Data: mustJSON(t, setExitNodeData{NodeID: "none"})})
+	client.out.waitFor(t, "tsnet:exitNodeSet", 10*time.Second, func(e wireEvent) bool { return e.ID == "off" })
+	st = statusData{}
+	if err := json.Unmarshal(client.out.waitFor(t, "tsnet:status", 10*time.Second, func(e wireEvent) bool { return e.ID == "off" }).Data, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.ExitNode != "" {
+		t.Errorf("status exitNode = %q after none", st.ExitNode)
+	}
+}
+
+func TestHeartbeatWatchdogStopsWedgedParent(t *testing.T) {
+	out := new(lockedBuffer)
+	sc := newSidecar(json.NewEncoder(out), out)
+	s := sc.defaultNode()
+	ctx := s.armLifecycle(testToken(), 9999)
+	const interval = 20 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.watchHeartbeat(ctx, interval)
+	}()
+
+	// A live parent keeps the node up.
+	for range 10 {
+		sc.dispatch(command{Command: "sidecar:heartbeat"})
+		time.Sleep(interval / 2)
+	}
+	for _, ev := range out.events(t) {
+		if ev.Event == "tsnet:heartbeatLost" {
+			t.Fatal("heartbeatLost while the parent was beating")
+		}
+	}
+	out.waitEvent(t, "sidecar:heartbeat", time.Second)
+
+	// A silent one gets the node drained and stopped.
+	var lost heartbeatLostData
+	if err := json.Unmarshal(out.waitEvent(t, "tsnet:heartbeatLost", 2*time.Second).Data, &lost); err != nil {
+		t.Fatal(err)
+	}
+	if lost.Missed < heartbeatMissLimit {
+		t.Errorf("heartbeatLost = %+v", lost)
+	}
+	out.waitEvent(t, "tsnet:drained", 2*time.Second)
+	out.waitEvent(t, "tsnet:stopped", 2*time.Second)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("watchdog did not exit after stopping the node")
+	}
+}
+
+// TestHeartbeatWatchdogDuringDrain checks a lost parent cuts a drain it had
+// started short without reporting a drain error of its own.
+func TestHeartbeatWatchdogDuringDrain(t *testing.T) {
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	ctx := s.armLifecycle(testToken(), 9999)
+	s.bridgeConns.Add(1) // keeps the parent's drain going
+	defer s.bridgeConns.Add(-1)
+	s.drain("d", time.Minute)
+	go s.watchHeartbeat(ctx, 20*time.Millisecond)
+
+	out.waitEvent(t, "tsnet:stopped", 2*time.Second)
+	for _, ev := range out.events(t) {
+		if ev.Event == "tsnet:error" {
+			t.Errorf("watchdog reported %s", ev.Data)
+		}
+	}
+}
+
+// TestTrackAddReportsOutcome checks a tracked add's first outcome reaches
+// its waiter while its events still go out under the original id.
+func TestTrackAddReportsOutcome(t *testing.T) {
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+
+	failID, failed := s.trackAdd("a")
+	okID, served := s.trackAdd("")
+	s.sendErrorID(failID, "LISTEN_ERROR", "already listening on port 80")
+	s.sendEventID(okID, "tsnet:listening", listeningData{Port: 81})
+	s.sendEventID(okID, "tsnet:unlistened", unlistenedData{Port: 81})
+
+	if err := failed(context.Background()); err == nil || !strings.Contains(err.Error(), "already listening") {
+		t.Errorf("failed add = %v", err)
+	}
+	if err := served(context.Background()); err != nil {
+		t.Errorf("served add = %v", err)
+	}
+	var ids []string
+	for _, ev := range out.events(t) {
+		ids = append(ids, ev.ID)
+	}
+	if want := []string{"a", "", ""}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("event ids = %q, want %q", ids, want)
+	}
+}
+
+// TestIntegrationRecoverNodeReplaysServing fails a running node and checks
+// the supervisor restarts it with its listener, UDP relay and proxy.
+func TestIntegrationRecoverNodeReplaysServing(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a tsnet node")
+	}
+	n := startTestNode(t, startTestControl(t, false).HTTPTestServer.URL, "phoenix")
+	target := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer target.Close()
+	targetPort := target.Listener.Addr().(*net.TCPAddr).Port
+
+	n.s.dispatch(command{ID: "l", Command: "tsnet:listen", Data: json.RawMessage(`{"port":9417}`)})
+	n.out.waitFor(t, "tsnet:listening", 10*time.Second, func(e wireEvent) bool { return e.ID == "l" })
+	n.s.dispatch(command{ID: "u", Command: "tsnet:listenPacket", Data: json.RawMessage(`{"port":9418}`)})
+	n.out.waitFor(t, "tsnet:listeningPacket", 10*time.Second, func(e wireEvent) bool { return e.ID == "u" })
+	n.s.dispatch(command{ID: "p", Command: "proxy:add", Data: json.RawMessage(fmt.Sprintf(`{"id":"web","listenPort":8080,"tls":false,"targetPort":%d}`, targetPort))})
+	n.out.waitFor(t, "proxy:added", 10*time.Second, func(e wireEvent) bool { return e.ID == "p" })
+	before := n.s.getServer()
+
+	n.s.recoverNode(n.s.lifecycleCtx(), errors.New("injected failure"))
+
+	var rec recoveringData
+	if err := json.Unmarshal(n.out.waitEvent(t, "tsnet:recovering", 5*time.Second).Data, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Attempt != 1 || rec.Error != "injected failure" {
+		t.Errorf("recovering = %+v", rec)
+	}
+	var got recoveredData
+	if err := json.Unmarshal(n.out.waitEvent(t, "tsnet:recovered", time.Minute).Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := recoveredData{Attempts: 1, State: "Running", Listeners: 1, Relays: 1, Proxies: 1}
+	if got != want {
+		t.Errorf("recovered = %+v, want %+v", got, want)
+	}
+	if after := n.s.getServer(); after == nil || after == before {
+		t.Fatal("server not replaced")
+	}
+	n.out.waitFor(t, "tsnet:listening", 10*time.Second, func(e wireEvent) bool { return e.ID == "" })
+	n.out.waitFor(t, "tsnet:listeningPacket", 10*time.Second, func(e wireEvent) bool { return e.ID == "" })
+	n.out.waitFor(t, "proxy:added", 10*time.Second, func(e wireEvent) bool { return e.ID == "" })
+}
+
+// TestIntegrationSuperviseFailedStart points a start at a stateDir that
+// can't be created, then fixes it and checks the retry brings the node up.
+func TestIntegrationSuperviseFailedStart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a tsnet node")
+	}
+	controlURL := startTestControl(t, false).HTTPTestServer.URL
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	t.Cleanup(func() { s.handleStop("") })
+
+	dir := filepath.Join(t.TempDir(), "state")
+	if err := os.WriteFile(dir, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s.dispatch(command{ID: "start", Command: "tsnet:start", Data: mustJSON(t, startData{
+		Hostname: "retry", StateDir: dir, Ephemeral: true, ControlURL: controlURL,
+		BridgePort: 1, SessionToken: hex.EncodeToString(testToken()),
+	})})
+	var rec recoveringData
+	if err := json.Unmarshal(out.waitFor(t, "tsnet:recovering", 5*time.Second, func(e wireEvent) bool { return e.ID == "start" }).Data, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Attempt != 1 || rec.RetryInSecs != int(recoverBackoffMin/time.Second) {
+		t.Errorf("recovering = %+v", rec)
+	}
+	s.dispatch(command{ID: "again", Command: "tsnet:start", Data: json.RawMessage(`{}`)})
+	if ev := out.waitFor(t, "tsnet:error", time.Second, func(e wireEvent) bool { return e.ID == "again" }); !strings.Contains(string(ev.Data), "recovering") {
+		t.Errorf("start while recovering = %s", ev.Data)
+	}
+
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	out.waitFor(t, "tsnet:recovered", time.Minute, func(e wireEvent) bool { return e.ID == "start" })
+	out.waitFor(t, "tsnet:started", time.Minute, func(e wireEvent) bool { return e.ID == "start" })
+}
+
+func TestServeConfigValidateAndDiff(t *testing.T) {
+	for _, bad := range []string{
+		`{"listeners":[{"port":0}]}`,
+		`{"listeners":[{"port":80},{"port":80,"tls":true}]}`,
+		`{"relays":[{"port":53},{"port":53}]}`,
+		`{"proxies":[{"listenPort":8080}]}`,
+		`{"proxies":[{"id":"a","listenPort":8080},{"id":"a","listenPort":8081}]}`,
+		`{"proxies":[{"id":"a","listenPort":8080},{"id":"b","listenPort":8080}]}`,
+	} {
+		var c serveConfig
+		if err := json.Unmarshal([]byte(bad), &c); err != nil {
+			t.Fatal(err)
+		}
+		if c.validate() == nil {
+			t.Errorf("%s: validated", bad)
+		}
+	}
+
+	current := servingSpec{
+		listeners: []listenData{{Port: 80}, {Port: 443}, {Port: 9417}},
+		relays:    []uint16{53, 5353},
+		proxies: []json.RawMessage{
+			json.RawMessage(`{"id":"keep","listenPort":8080,"targetPort":3000}`),
+			json.RawMessage(`{"id":"move","listenPort":8081,"targetPort":3001}`),
+			json.RawMessage(`{"id":"drop","listenPort":8082,"targetPort":3002}`),
+		},
+	}
+	var desired serveConfig
+	if err := json.Unmarshal([]byte(`{
+		"listeners":[{"port":80},{"port":443,"tls":true},{"port":9000}],
+		"relays":[{"port":53},{"port":123}],
+		"proxies":[
+			{"targetPort":3000,"listenPort":8080,"id":"keep"},
+			{"id":"move","listenPort":8081,"targetPort":4001},
+			{"id":"new","listenPort":8083,"targetPort":3003}
+		]}`), &desired); err != nil {
+		t.Fatal(err)
+	}
+	if err := desired.validate(); err != nil {
+		t.Fatal(err)
+	}
+	d := diffServeConfig(current, desired)
+	if want := (configAppliedData{Added: 3, Removed: 3, Changed: 2, Unchanged: 3}); !reflect.DeepEqual(d.counts, want) {
+		t.Errorf("counts = %+v, want %+v", d.counts, want)
+	}
+	if !slices.Equal(d.unlisten, []uint16{443, 9417}) || !slices.Equal(d.listen, []listenData{{Port: 443, TLS: true}, {Port: 9000}}) {
+		t.Errorf("listeners: unlisten %v listen %v", d.unlisten, d.listen)
+	}
+	if !slices.Equal(d.unrelay, []uint16{5353}) || !slices.Equal(d.relay, []uint16{123}) {
+		t.Errorf("relays: unrelay %v relay %v", d.unrelay, d.relay)
+	}
+	if !slices.Equal(d.removeProxy, []string{"move", "drop"}) || len(d.addProxy) != 2 {
+		t.Errorf("proxies: remove %v, %d added", d.removeProxy, len(d.addProxy))
+	}
+}
+
+// TestSlowServeApplyKeepsDispatching holds an apply on an add that never
+// reports, and checks heartbeats keep the watchdog fed and a tsnet:stop
+// goes through meanwhile, ending the apply.
+func TestSlowServeApplyKeepsDispatching(t *testing.T) {
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	ctx := s.armLifecycle(testToken(), 9999)
+	go s.watchHeartbeat(ctx, 20*time.Millisecond)
+
+	applied := make(chan struct{})
+	go func() {
+		defer close(applied)
+		s.runServeApply(ctx, func() *serveApply {
+			_, wait := s.trackAdd("apply") // its handler never reports
+			return &serveApply{id: "apply", persist: true, counts: configAppliedData{Added: 1},
+				adds: []pendingAdd{{configFailureData{Kind: "listener", Port: 9417}, wait}}}
+		})
+	}()
+	for waiting := false; !waiting; time.Sleep(time.Millisecond) {
+		s.adds.mu.Lock()
+		waiting = len(s.adds.pending) == 1
+		s.adds.mu.Unlock()
+	}
+
+	for i := 0; i < 10*heartbeatMissLimit; i++ {
+		s.dispatch(command{Command: "sidecar:heartbeat"})
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.dispatch(command{ID: "stop", Command: "tsnet:stop"})
+	out.waitFor(t, "tsnet:stopped", 2*time.Second, func(e wireEvent) bool { return e.ID == "stop" })
+	select {
+	case <-applied:
+	case <-time.After(2 * time.Second):
+		t.Fatal("apply still waiting after the node stopped")
+	}
+
+	var got configAppliedData
+	if err := json.Unmarshal(out.waitFor(t, "config:applied", 0, func(e wireEvent) bool { return e.ID == "apply" }).Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Failed) != 1 || got.Failed[0].Port != 9417 || got.Persisted {
+		t.Errorf("config:applied = %+v", got)
+	}
+	for _, ev := range out.events(t) {
+		if ev.Event == "tsnet:heartbeatLost" {
+			t.Error("watchdog starved while the apply waited")
+		}
+	}
+}
+
+// TestIntegrationServeConfig starts a node on a stateDir holding a serve
+// config, checks it's restored, then config:applies a change.
+func TestIntegrationServeConfig(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a tsnet node")
+	}
+	controlURL := startTestControl(t, false).HTTPTestServer.URL
+	dir := t.TempDir()
+	if err := writeServeConfig(dir, serveConfig{
+		Listeners: []listenData{{Port: 9417}},
+		Relays:    []listenPacketData{{Port: 9418}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	t.Cleanup(func() { s.handleStop("") })
+	s.dispatch(command{ID: "start", Command: "tsnet:start", Data: mustJSON(t, startData{
+		Hostname: "declared", StateDir: dir, Ephemeral: true, ControlURL: controlURL,
+		BridgePort: 1, SessionToken: hex.EncodeToString(testToken()),
+	})})
+
+	byID := func(id string) func(wireEvent) bool { return func(e wireEvent) bool { return e.ID == id } }
+	var got configAppliedData
+	if err := json.Unmarshal(out.waitFor(t, "config:applied", time.Minute, byID("start")).Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := (configAppliedData{Added: 2}); !reflect.DeepEqual(got, want) {
+		t.Errorf("restore = %+v, want %+v", got, want)
+	}
+	out.waitFor(t, "tsnet:listening", 10*time.Second, byID("start"))
+	out.waitFor(t, "tsnet:listeningPacket", 10*time.Second, byID("start"))
+
+	s.dispatch(command{ID: "apply", Command: "config:apply", Data: json.RawMessage(`{"listeners":[{"port":9417},{"port":9419}]}`)})
+	if err := json.Unmarshal(out.waitFor(t, "config:applied", 10*time.Second, byID("apply")).Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := (configAppliedData{Added: 1, Removed: 1, Unchanged: 1, Persisted: true}); !reflect.DeepEqual(got, want) {
+		t.Errorf("apply = %+v, want %+v", got, want)
+	}
+	out.waitFor(t, "tsnet:unlistenedPacket", 10*time.Second, byID("apply"))
+	if ev := out.waitFor(t, "tsnet:listening", 10*time.Second, byID("apply")); !strings.Contains(string(ev.Data), "9419") {
+		t.Errorf("listening = %s", ev.Data)
+	}
+	c, err := readServeConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Listeners) != 2 || len(c.Relays) != 0 {
+		t.Errorf("persisted = %+v", c)
+	}
+
+	// A proxy on a listener's port fails; it's reported and not persisted.
+	s.dispatch(command{ID: "clash", Command: "config:apply", Data: json.RawMessage(`{"listeners":[{"port":9417},{"port":9419}],"proxies":[{"id":"web","listenPort":9417,"targetPort":1}]}`)})
+	got = configAppliedData{}
+	if err := json.Unmarshal(out.waitFor(t, "config:applied", 10*time.Second, byID("clash")).Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Failed) != 1 || got.Failed[0].Kind != "proxy" || got.Failed[0].ID != "web" || !strings.Contains(got.Failed[0].Error, "PORT_IN_USE") {
+		t.Errorf("failed = %+v", got.Failed)
+	}
+	if got.Added != 1 || got.Unchanged != 2 || !got.Persisted {
+		t.Errorf("clash = %+v", got)
+	}
+	if c, err := readServeConfig(dir); err != nil || len(c.Listeners) != 2 || len(c.Proxies) != 0 {
+		t.Errorf("persisted = %+v, %v", c, err)
+	}
+
+	s.dispatch(command{ID: "bad", Command: "config:apply", Data: json.RawMessage(`{"listeners":[{"port":0}]}`)})
+	out.waitFor(t, "tsnet:error", time.Second, byID("bad"))
+}
+
+// TestStartQueueAbortsOnStop queues serving commands on a starting node and
+// checks a stop fails each one, while other commands run straight away.
+func TestStartQueueAbortsOnStop(t *testing.T) {
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	s.queueing = true
+
+	s.dispatch(command{ID: "l", Command: "tsnet:listen", Data: json.RawMessage(`{"port":9417}`)})
+	s.dispatch(command{ID: "p", Command: "proxy:add", Data: json.RawMessage(`{"id":"web","listenPort":8080}`)})
+	s.dispatch(command{ID: "peers", Command: "tsnet:getPeers"})
+	var q queuedData
+	if err := json.Unmarshal(out.waitFor(t, "tsnet:queued", time.Second, func(e wireEvent) bool { return e.ID == "p" }).Data, &q); err != nil {
+		t.Fatal(err)
+	}
+	if q != (queuedData{Command: "proxy:add", Position: 2}) {
+		t.Errorf("queued = %+v", q)
+	}
+	if ev := out.waitFor(t, "tsnet:error", time.Second, func(e wireEvent) bool { return e.ID == "peers" }); !strings.Contains(string(ev.Data), "NOT_RUNNING") {
+		t.Errorf("getPeers = %s", ev.Data)
+	}
+
+	s.dispatch(command{ID: "stop", Command: "tsnet:stop"})
+	for _, id := range []string{"l", "p"} {
+		ev := out.waitFor(t, "tsnet:error", time.Second, func(e wireEvent) bool { return e.ID == id })
+		if !strings.Contains(string(ev.Data), "QUEUE_ABORTED") || !strings.Contains(string(ev.Data), "node stopped") {
+			t.Errorf("%s = %s", id, ev.Data)
+		}
+	}
+	if s.queued() {
+		t.Error("queue still active after stop")
+	}
+}
+
+// TestIntegrationStartQueue sends a tsnet:listen straight after a queueing
+// tsnet:start and checks it runs once the node is up.
+func TestIntegrationStartQueue(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a tsnet node")
+	}
+	controlURL := startTestControl(t, false).HTTPTestServer.URL
+	out := new(lockedBuffer)
+	s := newSidecar(json.NewEncoder(out), out).defaultNode()
+	t.Cleanup(func() { s.handleStop("") })
+	s.dispatch(command{ID: "start", Command: "tsnet:start", Data: mustJSON(t, startData{
+		Hostname: "queued", StateDir: t.TempDir(), Ephemeral: true, ControlURL: controlURL,
+		BridgePort: 1, SessionToken: hex.EncodeToString(testToken()), QueueUntilRunning: true,
+	})})
+	s.dispatch(command{ID: "l", Command: "tsnet:listen", Data: json.RawMessage(`{"port":9417}`)})
+	out.waitFor(t, "tsnet:queued", time.Second, func(e wireEvent) bool { return e.ID == "l" })
+	out.waitFor(t, "tsnet:listening", time.Minute, func(e wireEvent) bool { return e.ID == "l" })
+
+	var started, listening int
+	for i, e := range out.events(t) {
+		switch {
+		case e.Event == "tsnet:started":
+			started = i
+		case e.Event == "tsnet:listening":
+			listening = i
+		}
+	}
+	if listening < started {
+		t.Error("queued listen ran before tsnet:started")
+	}
+	s.dispatch(command{ID: "l2", Command: "tsnet:listen", Data: json.RawMessage(`{"port":9418}`)})
+	out.waitFor(t, "tsnet:listening", 10*time.Second, func(e wireEvent) bool { return e.ID == "l2" })
+}
+
+// startMuxCore plays the core's side of the multiplexed bridge: it accepts
+// mux connections and hands over every stream opened on them.
+func startMuxCore(tb testing.TB) (port uint16, streams <-chan *muxStream) {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	ch := make(chan *muxStream, 64)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if err := readMuxPreamble(conn, testToken()); err != nil {
+				conn.Close()
+				continue
+			}
+			m := newMuxSession(conn, true)
+			go func() {
+				for {
+					st, err := m.accept()
+					if err != nil {
+						return
+					}
+					ch <- st
+				}
+			}()
+		}
+	}()
+	return uint16(ln.Addr().(*net.TCPAddr).Port), ch
+}
+
+// newMuxTestShim returns a shim bridging to port over conns mux connections.
+func newMuxTestShim(port uint16, conns int) *shim {
+	s := newTestShim()
+	s.armLifecycle(testToken(), port)
+	s.mux = newMuxPool(s, conns)
+	return s
+}
+
+// TestMuxBridgeStreams bridges several connections over one mux connection
+// and checks headers, echoed data, half close, and that a stream whose
+// reader stalls past its window doesn't hold up the others.
+func TestMuxBridgeStreams(t *testing.T) {
+	port, streams := startMuxCore(t)
+	s := newMuxTestShim(port, 1)
+	defer s.mux.closeAll()
+
+	// A stalled stream: the core doesn't read it until the end.
+	stalled, stalledPeer := net.Pipe()
+	go s.bridgeToRust(stalledPeer, bridgeMeta{direction: dirIncoming, port: 9417, remoteAddr: "100.64.0.9:1"}, nil)
+	stalledCore := <-streams
+	big := make([]byte, 4*muxInitialWindow)
+	for i := range big {
+		big[i] = byte(i * 7)
+	}
+	go stalled.Write(big)
+
+	for i := range 3 {
+		app, tsnetSide := net.Pipe()
+		addr := fmt.Sprintf("100.64.0.%d:4000", i+1)
+		go s.bridgeToRust(tsnetSide, bridgeMeta{direction: dirOutgoing, port: 8080, requestID: fmt.Sprintf("req-%d", i), remoteAddr: addr, target: "peer"}, nil)
+		core := <-streams
+
+		var want bytes.Buffer
+		if err := writeHeader(&want, testToken(), dirOutgoing, 8080, fmt.Sprintf("req-%d", i), addr, "peer"); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(core.header, want.Bytes()) {
+			t.Fatalf("stream %d header = %x, want %x", i, core.header, want.Bytes())
+		}
+		go func() {
+			io.Copy(core, core)
+			core.CloseWrite()
+		}()
+		msg := fmt.Sprintf("hello %d", i)
+		go app.Write([]byte(msg))
+		got := make([]byte, len(msg))
+		app.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(app, got); err != nil || string(got) != msg {
+			t.Fatalf("stream %d echo = %q, %v", i, got, err)
+		}
+		app.Close()
+	}
+
+	stalledCore.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, len(big))
+	if _, err := io.ReadFull(stalledCore, got); err != nil || !bytes.Equal(got, big) {
+		t.Fatalf("stalled stream: %v", err)
+	}
+	if n := len(s.mux.sessions); n != 1 || s.mux.sessions[0].closed() {
+		t.Fatal("mux connection not kept")
+	}
+}
+
+// TestMuxPoolDialsOutsideLock wedges the dial of a second mux connection
+// and checks opens keep going over the live one meanwhile.
+func TestMuxPoolDialsOutsideLock(t *testing.T) {
+	port, streams := startMuxCore(t)
+	s := newMuxTestShim(port, 2)
+	defer s.mux.closeAll()
+	dial, gate := s.mux.connect, make(chan struct{})
+	var dials atomic.Int32
+	s.mux.connect = func() (net.Conn, error) {
+		if dials.Add(1) > 1 {
+			<-gate // the core stops taking connections
+		}
+		return dial()
+	}
+
+	if _, err := s.mux.open([]byte("h1")); err != nil {
+		t.Fatal(err)
+	}
+	<-streams
+	wedged := make(chan error, 1)
+	go func() {
+		_, err := s.mux.open([]byte("h2")) // busy pool: dials the empty slot
+		wedged <- err
+	}()
+	for dials.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	opened := make(chan error, 1)
+	go func() {
+		_, err := s.mux.open([]byte("h3"))
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("open blocked behind another open's dial")
+	}
+	if core := <-streams; string(core.header) != "h3" {
+		t.Fatalf("stream header = %q, want h3", core.header)
+	}
+
+	close(gate)
+	if err := <-wedged; err != nil {
+		t.Fatal(err)
+	}
+	if core := <-streams; string(core.header) != "h2" {
+		t.Fatalf("stream header = %q, want h2", core.header)
+	}
+}
+
+// TestMuxSessionResetsStreamsOnClose checks a dropped mux connection fails
+// its streams and the pool redials.
+func TestMuxSessionResetsStreamsOnClose(t *testing.T) {
+	port, streams := startMuxCore(t)
+	s := newMuxTestShim(port, 1)
+	defer s.mux.closeAll()
+
+	st, err := s.mux.open([]byte("h1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	core := <-streams
+	first := s.mux.sessions[0]
+	core.sess.close(errMuxClosed)
+
+	st.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, errMuxReset) {
+		t.Fatalf("read on dropped connection = %v, want reset", err)
+	}
+	<-first.done
+	if _, err := s.mux.open([]byte("h2")); err != nil {
+		t.Fatal(err)
+	}
+	if core := <-streams; string(core.header) != "h2" || s.mux.sessions[0] == first {
+		t.Fatal("pool did not redial")
+	}
+}
+
+// BenchmarkBridgeConnect measures opening a bridged connection and one
+// round trip through it, per-connection dial versus a mux stream.
+func BenchmarkBridgeConnect(b *testing.B) {
+	var hdr bytes.Buffer
+	writeHeader(&hdr, testToken(), dirIncoming, 9417, "", "100.64.0.2:12345", "")
+	hdrLen := hdr.Len()
+
+	roundTrip := func(b *testing.B, s *shim) {
+		for b.Loop() {
+			app, tsnetSide := net.Pipe()
+			go s.bridgeToRust(tsnetSide, bridgeMeta{direction: dirIncoming, port: 9417, remoteAddr: "100.64.0.2:12345"}, nil)
+			if _, err := app.Write([]byte{1}); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.ReadFull(app, make([]byte, 1)); err != nil {
+				b.Fatal(err)
+			}
+			app.Close()
+		}
+	}
+	echoOne := func(c net.Conn) {
+		defer c.Close()
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(c, buf); err == nil {
+			c.Write(buf)
+		}
+		io.Copy(io.Discard, c)
+	}
+
+	b.Run("direct", func(b *testing.B) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					if _, err := io.ReadFull(c, make([]byte, hdrLen)); err == nil {
+						echoOne(c)
+					}
+				}()
+			}
+		}()
+		s := newTestShim()
+		s.armLifecycle(testToken(), uint16(ln.Addr().(*net.TCPAddr).Port))
+		roundTrip(b, s)
+	})
+	b.Run("mux", func(b *testing.B) {
+		port, streams := startMuxCore(b)
+		go func() {
+			for st := range streams {
+				go echoOne(st)
+			}
+		}()
+		s := newMuxTestShim(port, 1)
+		defer s.mux.closeAll()
+		roundTrip(b, s)
+	})
+}
+
+// TestBridgeSocket bridges a connection over a Unix socket bridge and
+// checks the socket's permissions are enforced at start.
+func TestBridgeSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix socket permissions")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bridge.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if err := os.Chmod(path, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkBridgeSocket(path); err == nil {
+		t.Error("world-writable socket accepted")
+	}
+	if err := checkBridgeSocket(filepath.Join(dir, "missing.sock")); err == nil {
+		t.Error("missing socket accepted")
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkBridgeSocket(path); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestShim()
+	s.armLifecycle(testToken(), 1)
+	s.bridgeSocket = path
+	app, tsnetSide := net.Pipe()
+	defer app.Close()
+	go s.bridgeToRust(tsnetSide, bridgeMeta{direction: dirIncoming, port: 9417, remoteAddr: "100.64.0.2:12345"}, nil)
+
+	core, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer core.Close()
+	core.SetDeadline(time.Now().Add(5 * time.Second))
+	if dir, port, _ := readTestHeader(t, core); dir != dirIncoming || port != 9417 {
+		t.Errorf("header = %d :%d", dir, port)
+	}
+	go app.Write([]byte("ping"))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(core, got); err != nil || string(got) != "ping" {
+		t.Errorf("bridged %q, %v", got, err)
+	}
+}
+
+// readTestHeaderV2 parses a v2 bridge header off conn, checking the magic,
+// version and session token, and returns its fields by type.
+func readTestHeaderV2(t *testing.T, conn net.Conn) (direction byte, port uint16, fields map[uint16][][]byte) {
+	t.Helper()
+	fixed := make([]byte, 4+1+32+1+2+4)
+	if _, err := io.ReadFull(conn, fixed); err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+	if binary.BigEndian.Uint32(fixed) != headerMagic || fixed[4] != headerVersion2 || !bytes.Equal(fixed[5:37], testToken()) {
+		t.Fatalf("bad header prefix %x", fixed)
+	}
+	block := make([]byte, binary.BigEndian.Uint32(fixed[40:]))
+	if _, err := io.ReadFull(conn, block); err != nil {
+		t.Fatalf("read header fields: %v", err)
+	}
+	fields = make(map[uint16][][]byte)
+	for len(block) > 0 {
+		if len(block) < 4 {
+			t.Fatalf("truncated field %x", block)
+		}
+		typ, n := binary.BigEndian.Uint16(block), int(binary.BigEndian.Uint16(block[2:]))
+		if len(block) < 4+n {
+			t.Fatalf("truncated field %x", block)
+		}
+		fields[typ] = append(fields[typ], block[4:4+n])
+		block = block[4+n:]
+	}
+	return fixed[37], binary.BigEndian.Uint16(fixed[38:]), fields
+}
+
+// TestIntegrationBridgeHeaderV2 dials a node whose core asked for v2
+// headers and checks the incoming header describes the dialling peer.
+func TestIntegrationBridgeHeaderV2(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts two tsnet nodes")
+	}
+	controlURL := startTestControl(t, false).HTTPTestServer.URL
+	a := startTestNode(t, controlURL, "node-a")
+	b := startTestNode(t, controlURL, "node-b")
+	a.s.serverMu.Lock()
+	a.s.headerVersion = headerVersion2
+	a.s.serverMu.Unlock()
+
+	a.s.dispatch(command{ID: "l1", Command: "tsnet:listen", Data: json.RawMessage(`{"port":9417}`)})
+	var ld listeningData
+	if err := json.Unmarshal(a.out.waitEvent(t, "tsnet:listening", 10*time.Second).Data, &ld); err != nil {
+		t.Fatal(err)
+	}
+	if ld.ListenerID == 0 {
+		t.Error("tsnet:listening has no listenerId")
+	}
+
+	waitForPeer(t, b, a)
+	b.s.dispatch(command{ID: "d1", Command: "bridge:dial", Data: json.RawMessage(`{"requestId":"r1","target":"` + a.ip + `","port":9417,"tls":false}`)})
+
+	a.core.(*net.TCPListener).SetDeadline(time.Now().Add(30 * time.Second))
+	in, err := a.core.Accept()
+	if err != nil {
+		t.Fatalf("core accept: %v (events: %+v)", err, a.out.events(t))
+	}
+	defer in.Close()
+	in.SetDeadline(time.Now().Add(30 * time.Second))
+	dir, port, fields := readTestHeaderV2(t, in)
+	if dir != dirIncoming || port != 9417 {
+		t.Errorf("incoming header = dir %d port %d", dir, port)
+	}
+	if dns := fields[hdrFieldPeerDNSName]; len(dns) != 1 || !strings.HasPrefix(string(dns[0]), "node-b") {
+		t.Errorf("peer dnsName = %q", dns)
+	}
+	if len(fields[hdrFieldPeerNodeID]) != 1 || len(fields[hdrFieldConnID]) != 1 {
+		t.Errorf("missing nodeId/connId: %v", fields)
+	}
+	if id := fields[hdrFieldListenerID]; len(id) != 1 || binary.BigEndian.Uint32(id[0]) != ld.ListenerID {
+		t.Errorf("listenerId = %x, want %d", id, ld.ListenerID)
+	}
+}
+
+// TestBridgeAck runs bridges against a core that accepts, rejects, or hangs
+// up instead of acknowledging.
+func TestBridgeAck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := newTestShim()
+	s.armLifecycle(testToken(), uint16(ln.Addr().(*net.TCPAddr).Port))
+	s.bridgeAck = true
+
+	for _, tc := range []struct {
+		verdict []byte // nil: hang up
+		code    string
+	}{
+		{[]byte{bridgeAckAccepted}, ""},
+		{[]byte{bridgeAckBadToken}, "BRIDGE_REJECTED_TOKEN"},
+		{[]byte{bridgeAckUnknownPort}, "BRIDGE_REJECTED_PORT"},
+		{[]byte{0x7f}, "BRIDGE_REJECTED"},
+		{nil, "BRIDGE_ACK_FAILED"},
+	} {
+		app, tsnetSide := net.Pipe()
+		var accepted atomic.Bool
+		errc := make(chan error, 1)
+		go func() {
+			errc <- s.bridgeToRust(tsnetSide, bridgeMeta{direction: dirOutgoing, port: 9417, requestID: "r"}, func() { accepted.Store(true) })
+		}()
+		core, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		core.SetDeadline(time.Now().Add(5 * time.Second))
+		readTestHeader(t, core)
+		if tc.verdict == nil {
+			core.Close()
+		} else {
+			core.Write(tc.verdict)
+		}
+
+		if tc.code == "" {
+			go app.Write([]byte("hi"))
+			got := make([]byte, 2)
+			if _, err := io.ReadFull(core, got); err != nil || string(got) != "hi" || !accepted.Load() {
+				t.Errorf("accepted bridge: read %q, %v, accepted %v", got, err, accepted.Load())
+			}
+			app.Close()
+			core.Close()
+			<-errc
+			continue
+		}
+		var rejected *bridgeAckError
+		if err := <-errc; !errors.As(err, &rejected) || rejected.code != tc.code {
+			t.Errorf("verdict %x: err %v, want code %s", tc.verdict, err, tc.code)
+		}
+		if accepted.Load() {
+			t.Errorf("verdict %x: accepted called", tc.verdict)
+		}
+		if _, err := app.Read(make([]byte, 1)); err == nil {
+			t.Errorf("verdict %x: tsnet side left open", tc.verdict)
+		}
+		core.Close()
+	}
+}
+
+// TestIntegrationDialAck checks bridge:dialResult follows the core's
+// verdict when bridgeAck is on.
+func TestIntegrationDialAck(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts two tsnet nodes")
+	}
+	controlURL := startTestControl(t, false).HTTPTestServer.URL
+	a := startTestNode(t, controlURL, "node-a")
+	b := startTestNode(t, controlURL, "node-b")
+	b.s.serverMu.Lock()
+	b.s.bridgeAck = true
+	b.s.serverMu.Unlock()
+
+	a.s.dispatch(command{ID: "l1", Command: "tsnet:listen", Data: json.RawMessage(`{"port":9417}`)})
+	a.out.waitEvent(t, "tsnet:listening", 10*time.Second)
+	// node-a's core takes the incoming side and holds it open.
+	held := make(chan net.Conn, 8)
+	t.Cleanup(func() {
+		for {
+			select {
+			case c := <-held:
+				c.Close()
+			default:
+				return
+			}
+		}
+	})
+	go func() {
+		for {
+			c, err := a.core.Accept()
+			if err != nil {
+				return
+			}
+			held <- c
+		}
+	}()
+
+	waitForPeer(t, b, a)
+
+	dial := func(rid string, verdict byte) dialResultData {
+		t.Helper()
+		b.s.dispatch(command{ID: rid, Command: "bridge:dial", Data: json.RawMessage(`{"requestId":"` + rid + `","target":"` + a.ip + `","port":9417,"tls":false}`)})
+		b.core.(*net.TCPListener).SetDeadline(time.Now().Add(30 * time.Second))
+		c, err := b.core.Accept()
+		if err != nil {
+			t.Fatalf("core accept: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetDeadline(time.Now().Add(30 * time.Second))
+		if _, _, got := readTestHeader(t, c); got != rid {
+			t.Fatalf("header requestId = %q, want %q", got, rid)
+		}
+		c.Write([]byte{verdict})
+		var r dialResultData
+		if err := json.Unmarshal(b.out.waitFor(t, "bridge:dialResult", 10*time.Second, func(e wireEvent) bool { return e.ID == rid }).Data, &r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	if r := dial("ok", bridgeAckAccepted); !r.Success || r.Code != "" {
+		t.Errorf("accepted dial = %+v", r)
+	}
+	if r := dial("bad", bridgeAckUnknownPort); r.Success || r.Code != "BRIDGE_REJECTED_PORT" {
+		t.Errorf("rejected dial = %+v", r)
+	}
+}
+
+// gonetTimeoutConn stands in for a tsnet conn: gVisor's gonet reports a
+// passed deadline with its own timeout error, not os.ErrDeadlineExceeded.
+type gonetTimeoutConn struct{ net.Conn }
+
+func (c gonetTimeoutConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = gonetTimeoutError{}
+	}
+	return n, err
+}
+
+type gonetTimeoutError struct{}
+
+func (gonetTimeoutError) Error() string   { return "i/o timeout" }
+func (gonetTimeoutError) Timeout() bool   { return true }
+func (gonetTimeoutError) Temporary() bool { return true }
+
+// TestBridgeConnTable checks bridge:list reports live bridges with their byte
+// counts, and bridge:closed reports each one's end with the right reason.
+func TestBridgeConnTable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var out lockedBuffer
+	s := newTestShim()
+	s.writer = json.NewEncoder(&out)
+	s.armLifecycle(testToken(), uint16(ln.Addr().(*net.TCPAddr).Port))
+
+	// open bridges one connection and returns its app and core ends.
+	open := func(m bridgeMeta, wrap func(net.Conn) net.Conn) (app, core net.Conn) {
+		app, tsnetSide := net.Pipe()
+		if wrap != nil {
+			tsnetSide = wrap(tsnetSide)
+		}
+		go s.bridgeToRust(tsnetSide, m, nil)
+		core, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		core.SetDeadline(time.Now().Add(5 * time.Second))
+		readTestHeader(t, core)
+		return app, core
+	}
+	closed := func(connID uint64) bridgeClosedData {
+		var d bridgeClosedData
+		ev := out.waitFor(t, "bridge:closed", 5*time.Second, func(e wireEvent) bool {
+			return json.Unmarshal(e.Data, &d) == nil && d.ConnID == connID
+		})
+		json.Unmarshal(ev.Data, &d)
+		return d
+	}
+
+	app1, core1 := open(bridgeMeta{direction: dirIncoming, port: 9417, remoteAddr: "100.64.0.2:1", identity: peerIdentityData{DNSName: "peer"}}, nil)
+	app2, core2 := open(bridgeMeta{direction: dirOutgoing, port: 443, requestID: "r2", target: "b"}, nil)
+	go app1.Write([]byte("hello"))
+	if _, err := io.ReadFull(core1, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	core1.Write([]byte("hi"))
+	if _, err := io.ReadFull(app1, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A pipe write returns (and is counted) just after the read it feeds, so
+	// list until the counts settle.
+	var list bridgeListData
+	for i := 0; ; i++ {
+		id := fmt.Sprintf("l%d", i)
+		s.dispatch(command{ID: id, Command: "bridge:list"})
+		if err := json.Unmarshal(out.waitFor(t, "bridge:list", time.Second, func(e wireEvent) bool { return e.ID == id }).Data, &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Connections) != 2 || list.Connections[0].BytesOut == 2 || i == 100 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(list.Connections) != 2 {
+		t.Fatalf("bridge:list = %+v, want 2 connections", list.Connections)
+	}
+	c1, c2 := list.Connections[0], list.Connections[1]
+	if c1.Direction != "incoming" || c1.Port != 9417 || c1.Peer == nil || c1.Peer.DNSName != "peer" || c1.BytesIn != 5 || c1.BytesOut != 2 {
+		t.Errorf("incoming entry = %+v", c1)
+	}
+	if c2.Direction != "outgoing" || c2.RequestID != "r2" || c2.Target != "b" || c2.Peer != nil || c2.ConnID <= c1.ConnID {
+		t.Errorf("outgoing entry = %+v", c2)
+	}
+
+	// Forced close: reported under the close command's id.
+	s.dispatch(command{ID: "c1", Command: "bridge:close", Data: mustJSON(t, bridgeCloseData{ConnID: c1.ConnID})})
+	if d := closed(c1.ConnID); d.Reason != closeReasonClosed || d.BytesIn != 5 || d.BytesOut != 2 {
+		t.Errorf("bridge:closed = %+v", d)
+	}
+	if ev := out.waitFor(t, "bridge:closed", 0, func(e wireEvent) bool {
+		return strings.Contains(string(e.Data), fmt.Sprintf(`"connId":%d,`, c1.ConnID))
+	}); ev.ID != "c1" {
+		t.Errorf("bridge:closed id = %q, want c1", ev.ID)
+	}
+	if _, err := core1.Read(make([]byte, 1)); err == nil {
+		t.Error("core side left open after bridge:close")
+	}
+	s.dispatch(command{ID: "c2", Command: "bridge:close", Data: mustJSON(t, bridgeCloseData{ConnID: c1.ConnID})})
+	if ev := out.waitFor(t, "tsnet:error", time.Second, func(e wireEvent) bool { return e.ID == "c2" }); !strings.Contains(string(ev.Data), "BRIDGE_CLOSE_ERROR") {
+		t.Errorf("closing a closed bridge = %s", ev.Data)
+	}
+
+	// The core half-closing doesn't cut off the app's reply: a pipe can't
+	// half-close, so it stays open.
+	core2.(*net.TCPConn).CloseWrite()
+	time.Sleep(50 * time.Millisecond) // let the bridge see the EOF
+	go app2.Write([]byte("late"))
+	if _, err := io.ReadFull(core2, make([]byte, 4)); err != nil {
+		t.Fatalf("reply after the core's half-close: %v", err)
+	}
+
+	// Both sides finishing is an EOF.
+	app2.Close()
+	core2.Close()
+	if d := closed(c2.ConnID); d.Reason != closeReasonEOF || d.Direction != "outgoing" {
+		t.Errorf("bridge:closed = %+v", d)
+	}
+
+	// An idle reap is reported as such from a tsnet conn's timeout error.
+	s.setIdleTimeout(50 * time.Millisecond)
+	app3, core3 := open(bridgeMeta{direction: dirIncoming, port: 9417}, func(c net.Conn) net.Conn { return gonetTimeoutConn{c} })
+	defer app3.Close()
+	defer core3.Close()
+	if d := closed(c2.ConnID + 1); d.Reason != closeReasonIdle || d.Error != "" {
+		t.Errorf("bridge:closed = %+v", d)
+	}
+	s.setIdleTimeout(0)
+
+	// Stopping the node closes whatever is left.
+	app4, core4 := open(bridgeMeta{direction: dirIncoming, port: 9417}, nil)
+	defer app4.Close()
+	defer core4.Close()
+	s.closeBridges(closeReasonStop, "")
+	if d := closed(c2.ConnID + 2); d.Reason != closeReasonStop {
+		t.Errorf("bridge:closed = %+v", d)
+	}
+	s.bridgesMu.Lock()
+	defer s.bridgesMu.Unlock()
+	if len(s.bridges) != 0 {
+		t.Errorf("bridges = %v, want empty", s.bridges)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import "net"
+
+// peerUID is unsupported here; the bridge socket relies on its filesystem
+// permissions and the session token alone.
+func peerUID(*net.UnixConn) (uint32, error) {
+	return 0, errPeerCredUnsupported
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnixPrivate binds a Unix socket under umask 077, so the socket file
+// is never reachable by anyone but the owner, not even before a chmod.
+// The umask is process-wide; callers bind before other goroutines create
+// files.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	old := syscall.Umask(0o077)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}